@@ -0,0 +1,202 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	goproto "google.golang.org/protobuf/proto"
+
+	"github.com/iotexproject/pebble-server/db"
+	"github.com/iotexproject/pebble-server/metrics"
+	"github.com/iotexproject/pebble-server/proto"
+)
+
+// The binding handshake: the holder of the ioID nft of a created device signs a proposal, the device receives
+// the proposal as a SensorConfirm in its query response, and once the user accepts it on the device, the device
+// uploads a ConfirmPackage signed over the proposer address, which confirms the device is bound to its owner.
+// The owner is always the ioID nft holder, a transfer of the nft resets the handshake.
+
+type proposeReq struct {
+	Proposer string `json:"proposer"                   binding:"required"`
+	ownerAuth
+}
+
+func (s *httpServer) proposeDevice(c *gin.Context) {
+	req := &proposeReq{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		slog.Error("failed to bind request", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid request payload")))
+		return
+	}
+	if !common.IsHexAddress(req.Proposer) {
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Errorf("invalid proposer address %s", req.Proposer)))
+		return
+	}
+	proposer := common.HexToAddress(req.Proposer)
+	id := c.Param("id")
+	d, err := s.db.Device(id)
+	if err != nil {
+		slog.Error("failed to query device", "error", err, "device_id", id)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to query device")))
+		return
+	}
+	if err := checkDevice(d); err != nil {
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+	if proposer != common.HexToAddress(d.Owner) {
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Errorf("proposer %s is not the owner of the device", proposer)))
+		return
+	}
+	if err := s.verifyOwner(proposer, "propose_device", d.ID, &req.ownerAuth, req); err != nil {
+		slog.Error("failed to verify proposer signature", "error", err, "device_id", id)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to verify proposer signature")))
+		return
+	}
+	ok, err := s.db.ProposeDevice(d.ID, proposer)
+	if err != nil {
+		slog.Error("failed to propose device", "error", err, "device_id", id)
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Errorf("the device can not be proposed in status %d", d.Status)))
+		return
+	}
+	d.Status, d.Proposer = db.PROPOSAL, proposer.String()
+	c.JSON(http.StatusOK, newDeviceResp(d))
+}
+
+// newProposal returns the base64 encoded SensorConfirm of the pending proposal of the device,
+// or empty if the device has no pending proposal
+func newProposal(d *db.Device) (string, error) {
+	if d.Status != db.PROPOSAL || d.Proposer == "" {
+		return "", nil
+	}
+	data, err := goproto.Marshal(&proto.SensorConfirm{Owner: goproto.String(d.Proposer)})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal proposal")
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// confirmDigest computes the digest signed by the device firmware over the ConfirmPackage fields:
+// sha256(owner || timestamp(uint32, big endian) || channel(uint32, big endian))
+func confirmDigest(pkg *proto.ConfirmPackage) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.Write(pkg.GetOwner())
+	if err := binary.Write(buf, binary.BigEndian, pkg.GetTimestamp()); err != nil {
+		return nil, errors.Wrap(err, "failed to write package timestamp")
+	}
+	if err := binary.Write(buf, binary.BigEndian, pkg.GetChannel()); err != nil {
+		return nil, errors.Wrap(err, "failed to write package channel")
+	}
+	h := sha256.Sum256(buf.Bytes())
+	return h[:], nil
+}
+
+func (s *httpServer) confirm(c *gin.Context) {
+	req := &receiveReq{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		slog.Error("failed to bind request", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid request payload")))
+		return
+	}
+
+	metrics.TrackRequestCount("confirm")
+	now := time.Now()
+	defer func() {
+		metrics.TrackRequestDuration("confirm", time.Since(now))
+	}()
+
+	if err := s.confirmDevice(req); err != nil {
+		slog.Error("failed to confirm device", "error", err, "device_id", req.DeviceID)
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// confirmDevice authenticates the upload request, then verifies the ConfirmPackage it carries and binds the
+// device to the confirmed proposer. It is shared by the http and mqtt front-ends.
+func (s *httpServer) confirmDevice(req *receiveReq) error {
+	deviceAddr := common.HexToAddress(strings.TrimPrefix(req.DeviceID, "did:io:"))
+	sigStr := req.Signature
+	req.Signature = ""
+
+	ok, err := s.verifySignature(deviceAddr, sigStr, req)
+	if err != nil {
+		return errors.Wrap(err, "failed to verify signature")
+	}
+	if !ok {
+		return errors.New("signature mismatch")
+	}
+
+	d, err := s.db.Device(req.DeviceID)
+	if err != nil {
+		return errors.Wrap(err, "failed to query device")
+	}
+	if err := checkDevice(d); err != nil {
+		return err
+	}
+	if d.Status != db.PROPOSAL {
+		return errors.Errorf("the device has no pending proposal, status %d", d.Status)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(req.Payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode base64 data")
+	}
+	pkg := &proto.ConfirmPackage{}
+	if err := goproto.Unmarshal(payload, pkg); err != nil {
+		return errors.Wrap(err, "failed to unmarshal confirm package")
+	}
+	if len(pkg.GetOwner()) != common.AddressLength {
+		return errors.Errorf("invalid owner length %d", len(pkg.GetOwner()))
+	}
+	owner := common.BytesToAddress(pkg.GetOwner())
+	if owner != common.HexToAddress(d.Proposer) {
+		return errors.Errorf("confirmed owner %s is not the proposer %s", owner, d.Proposer)
+	}
+	if owner != common.HexToAddress(d.Owner) {
+		return errors.Errorf("confirmed owner %s is not the owner %s", owner, d.Owner)
+	}
+	h, err := confirmDigest(pkg)
+	if err != nil {
+		return err
+	}
+	verified, err := s.verifyDigest(deviceAddr, pkg.GetSignature(), h)
+	if err != nil {
+		return errors.Wrap(err, "failed to verify confirm package signature")
+	}
+	if !verified {
+		return errors.New("confirm package signature mismatch")
+	}
+	err = s.transaction(func(s *httpServer) error {
+		if err := s.checkReplay(d, pkg.GetTimestamp()); err != nil {
+			return errors.Wrap(err, "replayed package")
+		}
+		ok, err := s.db.ConfirmDevice(d.ID, owner, pkg.GetChannel())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("the proposal has been changed")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("device confirmed", "device_id", d.ID, "owner", owner, "channel", pkg.GetChannel())
+	return nil
+}
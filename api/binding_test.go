@@ -0,0 +1,30 @@
+package api
+
+import (
+	"encoding/hex"
+	"testing"
+
+	goproto "google.golang.org/protobuf/proto"
+
+	"github.com/iotexproject/pebble-server/proto"
+)
+
+func TestConfirmDigest(t *testing.T) {
+	owner := make([]byte, 20)
+	for i := range owner {
+		owner[i] = byte(i + 1)
+	}
+	h, err := confirmDigest(&proto.ConfirmPackage{
+		Owner:     owner,
+		Timestamp: goproto.Uint32(0x5f5e1000),
+		Channel:   goproto.Uint32(7),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha256(0x0102..14 || 0x5f5e1000 || 0x00000007)
+	want := "7869ad65352a807214ca6a5d8369dda6acc3d3cfa805cfe2a92971e029a09eec"
+	if got := hex.EncodeToString(h); got != want {
+		t.Errorf("unexpected confirm digest %s, want %s", got, want)
+	}
+}
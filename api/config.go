@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/iotexproject/pebble-server/db"
+	"github.com/iotexproject/pebble-server/proto"
+)
+
+// pendingConfig is the SensorConfig an owner wants the device to apply, it is kept in Device.Config
+// until a CONFIG package of the device reports the same values
+type pendingConfig struct {
+	Version                int64  `json:"version"`
+	BulkUpload             uint32 `json:"bulkUpload"`
+	DataChannel            uint32 `json:"dataChannel"`
+	UploadPeriod           uint32 `json:"uploadPeriod"`
+	BulkUploadSamplingCnt  uint32 `json:"bulkUploadSamplingCnt"`
+	BulkUploadSamplingFreq uint32 `json:"bulkUploadSamplingFreq"`
+	Beep                   uint32 `json:"beep"`
+}
+
+// setConfigReq sets the desired config of the device, omitted fields keep the values reported by the device
+type setConfigReq struct {
+	BulkUpload             *uint32 `json:"bulkUpload,omitempty"`
+	DataChannel            *uint32 `json:"dataChannel,omitempty"`
+	UploadPeriod           *uint32 `json:"uploadPeriod,omitempty"`
+	BulkUploadSamplingCnt  *uint32 `json:"bulkUploadSamplingCnt,omitempty"`
+	BulkUploadSamplingFreq *uint32 `json:"bulkUploadSamplingFreq,omitempty"`
+	Beep                   *uint32 `json:"beep,omitempty"`
+	ownerAuth
+}
+
+func parsePendingConfig(d *db.Device) (*pendingConfig, error) {
+	if d.Config == "" {
+		return nil, nil
+	}
+	c := &pendingConfig{}
+	if err := json.Unmarshal([]byte(d.Config), c); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal pending config, device_id %s", d.ID)
+	}
+	return c, nil
+}
+
+func (c *pendingConfig) matches(data *proto.SensorConfig) bool {
+	return c.BulkUpload == data.GetBulkUpload() &&
+		c.DataChannel == data.GetDataChannel() &&
+		c.UploadPeriod == data.GetUploadPeriod() &&
+		c.BulkUploadSamplingCnt == data.GetBulkUploadSamplingCnt() &&
+		c.BulkUploadSamplingFreq == data.GetBulkUploadSamplingFreq() &&
+		c.Beep == data.GetBeep()
+}
+
+func newPendingConfig(d *db.Device, req *setConfigReq) *pendingConfig {
+	c := &pendingConfig{
+		Version:                time.Now().UnixMilli(),
+		BulkUpload:             uint32(d.BulkUpload),
+		DataChannel:            uint32(d.DataChannel),
+		UploadPeriod:           uint32(d.UploadPeriod),
+		BulkUploadSamplingCnt:  uint32(d.BulkUploadSamplingCnt),
+		BulkUploadSamplingFreq: uint32(d.BulkUploadSamplingFreq),
+		Beep:                   uint32(d.Beep),
+	}
+	for _, f := range []struct {
+		dst *uint32
+		src *uint32
+	}{
+		{&c.BulkUpload, req.BulkUpload},
+		{&c.DataChannel, req.DataChannel},
+		{&c.UploadPeriod, req.UploadPeriod},
+		{&c.BulkUploadSamplingCnt, req.BulkUploadSamplingCnt},
+		{&c.BulkUploadSamplingFreq, req.BulkUploadSamplingFreq},
+		{&c.Beep, req.Beep},
+	} {
+		if f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	return c
+}
+
+func (s *httpServer) setConfig(c *gin.Context) {
+	req := &setConfigReq{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		slog.Error("failed to bind request", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid request payload")))
+		return
+	}
+	id := c.Param("id")
+	resp, err := s.setPendingConfig(id, req)
+	if err != nil {
+		slog.Error("failed to set device config", "error", err, "device_id", id)
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *httpServer) setPendingConfig(id string, req *setConfigReq) (*pendingConfig, error) {
+	d, err := s.db.Device(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query device")
+	}
+	if err := checkDevice(d); err != nil {
+		return nil, err
+	}
+	if err := s.verifyOwner(common.HexToAddress(d.Owner), "set_config", d.ID, &req.ownerAuth, req); err != nil {
+		return nil, errors.Wrap(err, "failed to verify owner signature")
+	}
+	if !d.Configurable || d.ConfigDisabled {
+		return nil, errors.New("the device is not configurable")
+	}
+
+	pending := newPendingConfig(d, req)
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal pending config")
+	}
+	if err := s.db.UpdateByID(d.ID, map[string]any{
+		"config":     string(data),
+		"updated_at": time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
@@ -0,0 +1,195 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	goproto "google.golang.org/protobuf/proto"
+
+	"github.com/iotexproject/pebble-server/proto"
+)
+
+// newConfigurableDevice returns a configurable test device owned by the returned key, which reports
+// an upload period of 60 seconds and beep on
+func newConfigurableDevice(t *testing.T, s *httpServer) (*testDevice, *ecdsa.PrivateKey) {
+	t.Helper()
+	d := newTestDevice(t, s)
+	owner, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.UpdateByID(d.id, map[string]any{
+		"owner":         crypto.PubkeyToAddress(owner.PublicKey).Hex(),
+		"configurable":  true,
+		"upload_period": 60,
+		"beep":          1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return d, owner
+}
+
+func newSetConfigReq(t *testing.T, owner *ecdsa.PrivateKey, target string, uploadPeriod uint32) *setConfigReq {
+	t.Helper()
+	req := &setConfigReq{UploadPeriod: goproto.Uint32(uploadPeriod)}
+	signOwner(t, owner, "set_config", target, &req.ownerAuth, req)
+	return req
+}
+
+func TestSetPendingConfigIsServedSigned(t *testing.T) {
+	s := newTestServer(t)
+	d, owner := newConfigurableDevice(t, s)
+
+	pending, err := s.setPendingConfig(d.id, newSetConfigReq(t, owner, d.id, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the omitted fields keep the reported values
+	if pending.UploadPeriod != 300 || pending.Beep != 1 || pending.Version == 0 {
+		t.Fatalf("unexpected pending config %+v", pending)
+	}
+
+	resp, err := s.queryDevice(d.queryReq(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Config == nil || *resp.Config != *pending {
+		t.Fatalf("expected the pending config in the query response, got %+v", resp.Config)
+	}
+	// the config is covered by the server signature
+	verifyQueryResp(t, s, resp)
+}
+
+// verifyQueryResp checks that the query response is signed by the server
+func verifyQueryResp(t *testing.T, s *httpServer, resp *queryResp) {
+	t.Helper()
+	sig, err := hexutil.Decode(resp.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := *resp
+	unsigned.Signature = ""
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(data)
+	pub, err := crypto.SigToPub(h[:], sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crypto.PubkeyToAddress(*pub) != crypto.PubkeyToAddress(s.prv.PublicKey) {
+		t.Fatal("the query response is not signed by the server")
+	}
+}
+
+func TestSetPendingConfigRequiresOwnerSignature(t *testing.T) {
+	s := newTestServer(t)
+	d, owner := newConfigurableDevice(t, s)
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]func() *setConfigReq{
+		"another signer": func() *setConfigReq { return newSetConfigReq(t, other, d.id, 300) },
+		"another device": func() *setConfigReq {
+			return newSetConfigReq(t, owner, "did:io:0x0000000000000000000000000000000000000001", 300)
+		},
+		"another action": func() *setConfigReq {
+			req := &setConfigReq{UploadPeriod: goproto.Uint32(300)}
+			signOwner(t, owner, "update_device", d.id, &req.ownerAuth, req)
+			return req
+		},
+		"changed payload": func() *setConfigReq {
+			req := newSetConfigReq(t, owner, d.id, 300)
+			req.UploadPeriod = goproto.Uint32(1)
+			return req
+		},
+	}
+	for name, req := range cases {
+		_, err := s.setPendingConfig(d.id, req())
+		if err == nil || !strings.Contains(err.Error(), "not signed by the owner") {
+			t.Errorf("%s: expected the request to be rejected, got %v", name, err)
+		}
+	}
+
+	// a signed request is accepted once
+	req := newSetConfigReq(t, owner, d.id, 300)
+	if _, err := s.setPendingConfig(d.id, req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.setPendingConfig(d.id, req); err == nil || !strings.Contains(err.Error(), "has been used") {
+		t.Errorf("expected the replayed request to be rejected, got %v", err)
+	}
+}
+
+func TestSetPendingConfigRejectsUnconfigurableDevices(t *testing.T) {
+	s := newTestServer(t)
+	for name, values := range map[string]map[string]any{
+		"not configurable": {"configurable": false},
+		"config disabled":  {"config_disabled": true},
+	} {
+		d, owner := newConfigurableDevice(t, s)
+		if err := s.db.UpdateByID(d.id, values); err != nil {
+			t.Fatal(err)
+		}
+		_, err := s.setPendingConfig(d.id, newSetConfigReq(t, owner, d.id, 300))
+		if err == nil || !strings.Contains(err.Error(), "not configurable") {
+			t.Errorf("%s: expected the config to be rejected, got %v", name, err)
+		}
+		dev, err := s.db.Device(d.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dev.Config != "" {
+			t.Errorf("%s: the pending config is stored", name)
+		}
+	}
+}
+
+func TestHandleConfigAcknowledgesPendingConfig(t *testing.T) {
+	s := newTestServer(t)
+	d, owner := newConfigurableDevice(t, s)
+	if _, err := s.setPendingConfig(d.id, newSetConfigReq(t, owner, d.id, 300)); err != nil {
+		t.Fatal(err)
+	}
+	report := func(uploadPeriod uint32) string {
+		t.Helper()
+		dev, err := s.db.Device(d.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.handleConfig(dev, &proto.SensorConfig{
+			UploadPeriod:       goproto.Uint32(uploadPeriod),
+			Beep:               goproto.Uint32(1),
+			DeviceConfigurable: goproto.Bool(true),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if dev, err = s.db.Device(d.id); err != nil {
+			t.Fatal(err)
+		}
+		return dev.Config
+	}
+
+	// the config reported before the device applied the pending one keeps it pending
+	if config := report(60); config == "" {
+		t.Fatal("the pending config is cleared by a config which does not match it")
+	}
+	if config := report(300); config != "" {
+		t.Fatalf("the pending config is kept after the device applied it: %s", config)
+	}
+	resp, err := s.queryDevice(d.queryReq(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Config != nil {
+		t.Errorf("the applied config is still served: %+v", resp.Config)
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/pkg/errors"
+
+	"github.com/iotexproject/pebble-server/db"
+)
+
+// firmwareManifest is the firmware served to a device, devices verify the downloaded binary with its
+// hash and size, and only update from a version not older than MinVersion
+type firmwareManifest struct {
+	Firmware   string
+	URI        string
+	Version    string
+	Hash       string
+	Size       uint64
+	MinVersion string
+	// rollout is the active rollout serving the firmware to the cohort of the device, the device is recorded
+	// as served once the firmware is in its response
+	rollout *db.Rollout
+}
+
+const mirrorRetryInterval = time.Minute
+
+type mirrorResult struct {
+	err       error
+	checkedAt time.Time
+}
+
+// firmwareMirror verifies the firmware artifacts against a local mirror before they are served,
+// the artifact of a firmware uri is the file with the same name in the mirror directory
+type firmwareMirror struct {
+	dir     string
+	mu      sync.Mutex
+	results map[string]*mirrorResult
+}
+
+func newFirmwareMirror(dir string) *firmwareMirror {
+	if dir == "" {
+		return nil
+	}
+	return &firmwareMirror{
+		dir:     dir,
+		results: map[string]*mirrorResult{},
+	}
+}
+
+// verify checks the size and hash of the mirrored artifact of m, manifests without a hash are not checked.
+// Successful checks are cached, failed checks are retried after mirrorRetryInterval.
+func (f *firmwareMirror) verify(m *firmwareManifest) error {
+	if f == nil || m.Hash == "" {
+		return nil
+	}
+	key := fmt.Sprintf("%s@%s/%d", m.URI, m.Hash, m.Size)
+	f.mu.Lock()
+	r, ok := f.results[key]
+	f.mu.Unlock()
+	if ok && (r.err == nil || time.Since(r.checkedAt) < mirrorRetryInterval) {
+		return r.err
+	}
+
+	err := f.check(m)
+	f.mu.Lock()
+	f.results[key] = &mirrorResult{err: err, checkedAt: time.Now()}
+	f.mu.Unlock()
+	return err
+}
+
+func (f *firmwareMirror) check(m *firmwareManifest) error {
+	u, err := url.Parse(m.URI)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse firmware uri %s", m.URI)
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return errors.Errorf("firmware uri %s has no file name", m.URI)
+	}
+	file, err := os.Open(filepath.Join(f.dir, name))
+	if err != nil {
+		return errors.Wrapf(err, "failed to open mirrored firmware %s", name)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read mirrored firmware %s", name)
+	}
+	if m.Size != 0 && uint64(n) != m.Size {
+		return errors.Errorf("mirrored firmware %s size mismatch, expected %d, actual %d", name, m.Size, n)
+	}
+	if actual := hexutil.Encode(h.Sum(nil)); actual != m.Hash {
+		return errors.Errorf("mirrored firmware %s hash mismatch, expected %s, actual %s", name, m.Hash, actual)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/iotexproject/pebble-server/db"
+)
+
+var testFirmware = []byte("pebble firmware 2.0.0")
+
+func testFirmwareHash() string {
+	h := sha256.Sum256(testFirmware)
+	return hexutil.Encode(h[:])
+}
+
+func writeFirmware(t *testing.T, dir, name string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFirmwareMirrorCheck(t *testing.T) {
+	dir := t.TempDir()
+	f := newFirmwareMirror(dir)
+	writeFirmware(t, dir, "pebble.bin", testFirmware)
+	writeFirmware(t, dir, "tampered.bin", []byte("pebble firmware 2.0.1"))
+
+	valid := &firmwareManifest{URI: "https://firmware.example/v2/pebble.bin", Hash: testFirmwareHash(), Size: uint64(len(testFirmware))}
+	if err := f.check(valid); err != nil {
+		t.Fatal(err)
+	}
+	for want, m := range map[string]*firmwareManifest{
+		"size mismatch":  {URI: valid.URI, Hash: valid.Hash, Size: valid.Size + 1},
+		"hash mismatch":  {URI: "https://firmware.example/v2/tampered.bin", Hash: valid.Hash},
+		"failed to open": {URI: "https://firmware.example/v2/missing.bin", Hash: valid.Hash},
+		"no file name":   {URI: "https://firmware.example/", Hash: valid.Hash},
+	} {
+		if err := f.check(m); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v", want, err)
+		}
+	}
+	// the size is not checked if the manifest has none
+	if err := f.check(&firmwareManifest{URI: valid.URI, Hash: valid.Hash}); err != nil {
+		t.Errorf("unexpected error without size: %v", err)
+	}
+}
+
+func TestFirmwareMirrorVerifyCachesResults(t *testing.T) {
+	dir := t.TempDir()
+	f := newFirmwareMirror(dir)
+	m := &firmwareManifest{URI: "https://firmware.example/v2/pebble.bin", Hash: testFirmwareHash(), Size: uint64(len(testFirmware))}
+
+	if newFirmwareMirror("") != nil {
+		t.Fatal("expected no mirror without a directory")
+	}
+	var disabled *firmwareMirror
+	if err := disabled.verify(m); err != nil {
+		t.Fatalf("a disabled mirror verifies nothing, got %v", err)
+	}
+	if err := f.verify(&firmwareManifest{URI: "https://firmware.example/v1/legacy.bin"}); err != nil {
+		t.Fatalf("a manifest without hash is not verified, got %v", err)
+	}
+
+	// a failure is retried once the retry interval has passed
+	if err := f.verify(m); err == nil {
+		t.Fatal("expected the missing artifact to fail")
+	}
+	writeFirmware(t, dir, "pebble.bin", testFirmware)
+	if err := f.verify(m); err == nil {
+		t.Fatal("expected the failure to be kept until the retry interval has passed")
+	}
+	for _, r := range f.results {
+		r.checkedAt = r.checkedAt.Add(-mirrorRetryInterval)
+	}
+	if err := f.verify(m); err != nil {
+		t.Fatalf("expected the artifact to be checked again, got %v", err)
+	}
+
+	// a success is cached for the manifest
+	writeFirmware(t, dir, "pebble.bin", []byte("replaced"))
+	if err := f.verify(m); err != nil {
+		t.Fatalf("expected the verified artifact to be cached, got %v", err)
+	}
+	// a manifest of another size is checked again
+	if err := f.verify(&firmwareManifest{URI: m.URI, Hash: m.Hash, Size: m.Size + 1}); err == nil {
+		t.Fatal("expected the manifest of another size to be checked")
+	}
+}
+
+func TestQueryServesVerifiedFirmwareManifest(t *testing.T) {
+	s := newTestServer(t)
+	dir := t.TempDir()
+	s.mirror = newFirmwareMirror(dir)
+	d := newTestDevice(t, s)
+	if err := s.db.UpdateByID(d.id, map[string]any{"project_id": 1, "real_firmware": "pebble 1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	key := crypto.Keccak256Hash([]byte("pebble_firmware"))
+	s.db.RegisterMetadataDecoder(1, key, db.FirmwareDecoder)
+	value := `{"name":"pebble","version":"2.0.0","url":"https://firmware.example/v2/pebble.bin",` +
+		`"hash":"` + strings.ToUpper(testFirmwareHash()[2:]) + `","size":21,"minVersion":"1.0.0"}`
+	if err := s.db.UpsertProjectMetadata(&types.Log{BlockNumber: 10, TxHash: common.HexToHash("0x01")},
+		1, "pebble_firmware", key, []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the firmware is not served until the mirrored artifact is verified
+	resp, err := s.queryDevice(d.queryReq(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Firmware != "" || resp.URI != "" {
+		t.Fatalf("the unverified firmware is served: %+v", resp)
+	}
+
+	writeFirmware(t, dir, "pebble.bin", testFirmware)
+	for _, r := range s.mirror.results {
+		r.checkedAt = time.Time{}
+	}
+	if resp, err = s.queryDevice(d.queryReq(t)); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Firmware != "pebble" || resp.Version != "2.0.0" || resp.URI != "https://firmware.example/v2/pebble.bin" ||
+		resp.Hash != testFirmwareHash() || resp.Size != uint64(len(testFirmware)) || resp.MinVersion != "1.0.0" {
+		t.Fatalf("unexpected firmware manifest %+v", resp)
+	}
+	verifyQueryResp(t, s, resp)
+}
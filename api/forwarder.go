@@ -0,0 +1,195 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	wsapi "github.com/iotexproject/w3bstream/service/apinode/api"
+	"github.com/pkg/errors"
+
+	"github.com/iotexproject/pebble-server/db"
+)
+
+// forwarder delivers the tasks accepted by receiveV2 to the w3bstream task endpoint.
+// Tasks are persisted as messages first, and retried with exponential backoff until
+// forwarded or moved to the dead letter after maxAttempts.
+// The delivery is at least once: a task accepted by w3bstream whose message can not be marked forwarded is
+// not sent again while the server runs, but it is resent after a restart. w3bstream derives the task id from
+// the device signature of the task, so a resent task has the same task id.
+type forwarder struct {
+	db           *db.DB
+	endpoint     string
+	client       *http.Client
+	pollInterval time.Duration
+	batchSize    int
+	maxAttempts  int32
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+	notify       chan struct{}
+	forwarded    map[uint]string // task ids of the accepted messages which are not marked forwarded yet
+}
+
+func newForwarder(db *db.DB, wsAddr string) *forwarder {
+	return &forwarder{
+		db:           db,
+		endpoint:     fmt.Sprintf("https://%s/v1/task", wsAddr),
+		client:       &http.Client{Timeout: 10 * time.Second},
+		pollInterval: 1 * time.Second,
+		batchSize:    50,
+		maxAttempts:  10,
+		baseBackoff:  2 * time.Second,
+		maxBackoff:   10 * time.Minute,
+		notify:       make(chan struct{}, 1),
+		forwarded:    map[uint]string{},
+	}
+}
+
+func (f *forwarder) enqueue(deviceID string, req *wsapi.CreateTaskReq) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal task request")
+	}
+	pid, ok := new(big.Int).SetString(req.ProjectID, 10)
+	if !ok {
+		return errors.Errorf("failed to decode project id string %s", req.ProjectID)
+	}
+	if err := f.db.CreateMessage(&db.Message{
+		MessageID:      crypto.Keccak256Hash(data).Hex(),
+		ClientID:       deviceID,
+		ProjectID:      pid.Uint64(),
+		ProjectVersion: req.ProjectVersion,
+		Data:           data,
+		Status:         db.MessagePending,
+		NextAttemptAt:  time.Now(),
+	}); err != nil {
+		return err
+	}
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (f *forwarder) backoff(attempts int32) time.Duration {
+	d := f.baseBackoff
+	for i := int32(1); i < attempts && d < f.maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, f.maxBackoff)
+}
+
+// send posts the task, the returned bool reports whether a failure is worth retrying
+func (f *forwarder) send(m *db.Message) (string, bool, error) {
+	resp, err := f.client.Post(f.endpoint, "application/json", bytes.NewReader(m.Data))
+	if err != nil {
+		return "", true, errors.Wrap(err, "failed to send http request")
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return "", true, errors.Wrap(err, "failed to read response body")
+	}
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		// the task is accepted, so it is not resent even if the task id can not be read from the response
+		r := &wsapi.CreateTaskResp{}
+		if err := json.Unmarshal(body, r); err != nil {
+			slog.Warn("failed to unmarshal w3bstream response", "error", err, "message_id", m.MessageID, "body", string(body))
+		}
+		return r.TaskID, false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return "", true, errors.Errorf("w3bstream unavailable, status %d, body %s", resp.StatusCode, body)
+	default:
+		return "", false, errors.Errorf("w3bstream rejected task, status %d, body %s", resp.StatusCode, body)
+	}
+}
+
+// forward sends the message unless it has been accepted already, and records the result. It returns the
+// db error of recording the result, the message is then left pending.
+func (f *forwarder) forward(m *db.Message) error {
+	taskID, ok := f.forwarded[m.ID]
+	if !ok {
+		id, retryable, err := f.send(m)
+		if err != nil {
+			return f.retry(m, retryable, err)
+		}
+		taskID = id
+		f.forwarded[m.ID] = taskID
+	}
+	if err := f.db.ForwardedMessage(m.ID, &db.Task{
+		ProjectID:      m.ProjectID,
+		InternalTaskID: taskID,
+		MessageIDs:     []byte(m.MessageID),
+	}); err != nil {
+		return errors.Wrapf(err, "failed to record forwarded message %s", m.MessageID)
+	}
+	delete(f.forwarded, m.ID)
+	return nil
+}
+
+// retry schedules the next attempt of the message which failed to be sent, or moves it to the dead letter
+func (f *forwarder) retry(m *db.Message, retryable bool, sendErr error) error {
+	attempts := m.Attempts + 1
+	if !retryable || attempts >= f.maxAttempts {
+		slog.Error("give up forwarding message to w3bstream", "error", sendErr, "message_id", m.MessageID, "attempts", attempts)
+		err := f.db.DeadMessage(m.ID, attempts, sendErr.Error())
+		return errors.Wrapf(err, "failed to record dead message %s", m.MessageID)
+	}
+	next := time.Now().Add(f.backoff(attempts))
+	slog.Warn("failed to forward message to w3bstream, will retry", "error", sendErr, "message_id", m.MessageID,
+		"attempts", attempts, "next_attempt_at", next)
+	err := f.db.RetryMessage(m.ID, attempts, next, sendErr.Error())
+	return errors.Wrapf(err, "failed to record retried message %s", m.MessageID)
+}
+
+// forwardPending forwards the due messages batch by batch. It stops at the first db error, the messages
+// left pending would be fetched again right away otherwise.
+func (f *forwarder) forwardPending() error {
+	for {
+		ms, err := f.db.PendingMessages(time.Now(), f.batchSize)
+		if err != nil {
+			return err
+		}
+		for _, m := range ms {
+			if err := f.forward(m); err != nil {
+				return err
+			}
+		}
+		if len(ms) < f.batchSize {
+			return nil
+		}
+	}
+}
+
+// run forwards the pending messages every pollInterval or once a message is enqueued,
+// it backs off up to maxBackoff while the db fails
+func (f *forwarder) run() {
+	interval := f.pollInterval
+	for {
+		// new messages do not cut the backoff short
+		notify := f.notify
+		if interval > f.pollInterval {
+			notify = nil
+		}
+		select {
+		case <-time.After(interval):
+		case <-notify:
+		}
+		if err := f.forwardPending(); err != nil {
+			interval = min(interval*2, f.maxBackoff)
+			slog.Error("failed to forward pending messages", "error", err, "retry_in", interval)
+			continue
+		}
+		interval = f.pollInterval
+	}
+}
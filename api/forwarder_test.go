@@ -0,0 +1,138 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/iotexproject/pebble-server/db"
+)
+
+func TestForwarderSend(t *testing.T) {
+	cases := []struct {
+		name      string
+		status    int
+		body      string
+		taskID    string
+		retryable bool
+		failed    bool
+	}{
+		{name: "accepted", status: http.StatusOK, body: `{"taskID":"0x01"}`, taskID: "0x01"},
+		{name: "accepted with unreadable body", status: http.StatusAccepted, body: "queued"},
+		{name: "unavailable", status: http.StatusServiceUnavailable, retryable: true, failed: true},
+		{name: "throttled", status: http.StatusTooManyRequests, retryable: true, failed: true},
+		{name: "rejected", status: http.StatusBadRequest, body: "invalid task", failed: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(c.status)
+				w.Write([]byte(c.body))
+			}))
+			defer srv.Close()
+
+			f := &forwarder{endpoint: srv.URL, client: srv.Client()}
+			taskID, retryable, err := f.send(&db.Message{MessageID: "m1", Data: []byte("{}")})
+			if (err != nil) != c.failed {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if taskID != c.taskID || retryable != c.retryable {
+				t.Errorf("got task id %q retryable %t, want %q %t", taskID, retryable, c.taskID, c.retryable)
+			}
+		})
+	}
+}
+
+func TestForwarderDoesNotResendAcceptedMessages(t *testing.T) {
+	s := newTestServer(t)
+	var sent atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		sent.Add(1)
+		w.Write([]byte(`{"taskID":"0x01"}`))
+	}))
+	defer srv.Close()
+	f := newForwarder(s.db, "")
+	f.endpoint, f.client = srv.URL, srv.Client()
+
+	for _, id := range []string{"m1", "m2"} {
+		if err := s.db.CreateMessage(&db.Message{
+			MessageID:     id,
+			Data:          []byte("{}"),
+			Status:        db.MessagePending,
+			NextAttemptAt: time.Now().Add(-time.Second),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the accepted messages can not be marked forwarded without the task table
+	raw, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := raw.Migrator().DropTable(&db.Task{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := f.forwardPending(); err == nil {
+			t.Fatal("expected the db error to be returned")
+		}
+	}
+	if n := sent.Load(); n != 1 {
+		t.Fatalf("expected the forwarding to stop at the db error without resending, sent %d", n)
+	}
+
+	if err := raw.AutoMigrate(&db.Task{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.forwardPending(); err != nil {
+		t.Fatal(err)
+	}
+	if n := sent.Load(); n != 2 {
+		t.Fatalf("expected each message to be sent once, sent %d", n)
+	}
+	if ms, err := s.db.PendingMessages(time.Now(), 10); err != nil || len(ms) != 0 {
+		t.Fatalf("unexpected pending messages %v %v", ms, err)
+	}
+	if len(f.forwarded) != 0 {
+		t.Fatalf("recorded messages are kept in memory: %v", f.forwarded)
+	}
+}
+
+func TestDeadLetterRequiresAdminToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := []struct {
+		name   string
+		token  string
+		header string
+		status int
+	}{
+		{name: "disabled", header: "Bearer ", status: http.StatusForbidden},
+		{name: "missing", token: "secret", status: http.StatusUnauthorized},
+		{name: "wrong", token: "secret", header: "Bearer other", status: http.StatusUnauthorized},
+		{name: "valid", token: "secret", header: "Bearer secret", status: http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &httpServer{engine: gin.New(), adminToken: c.token}
+			s.engine.GET("/v2/w3bstream/dead_letter", s.adminAuth, func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			req := httptest.NewRequest(http.MethodGet, "/v2/w3bstream/dead_letter", nil)
+			if c.header != "" {
+				req.Header.Set("Authorization", c.header)
+			}
+			w := httptest.NewRecorder()
+			s.engine.ServeHTTP(w, req)
+			if w.Code != c.status {
+				t.Errorf("got status %d, want %d", w.Code, c.status)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
@@ -19,7 +20,6 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/gin-gonic/gin"
 	"github.com/iotexproject/w3bstream/project"
 	wsapi "github.com/iotexproject/w3bstream/service/apinode/api"
@@ -52,13 +52,18 @@ type queryReq struct {
 }
 
 type queryResp struct {
-	Timestamp int32  `json:"timestamp"`
-	Status    int32  `json:"status"`
-	Owner     string `json:"owner"`
-	Firmware  string `json:"firmware,omitempty"`
-	URI       string `json:"uri,omitempty"`
-	Version   string `json:"version,omitempty"`
-	Signature string `json:"signature,omitempty"`
+	Timestamp  int32          `json:"timestamp"`
+	Status     int32          `json:"status"`
+	Owner      string         `json:"owner"`
+	Firmware   string         `json:"firmware,omitempty"`
+	URI        string         `json:"uri,omitempty"`
+	Version    string         `json:"version,omitempty"`
+	Hash       string         `json:"hash,omitempty"`
+	Size       uint64         `json:"size,omitempty"`
+	MinVersion string         `json:"minVersion,omitempty"`
+	Config     *pendingConfig `json:"config,omitempty"`
+	Proposal   string         `json:"proposal,omitempty"`
+	Signature  string         `json:"signature,omitempty"`
 }
 
 type queryRecordResp struct {
@@ -74,6 +79,20 @@ type queryRecordResp struct {
 	Accelerometer string `json:"accelerometer"`
 	Latitude      string `json:"latitude"`
 	Longitude     string `json:"longitude"`
+	Verified      bool   `json:"verified"` // whether the package signature of the record matches the device
+}
+
+type deviceRecordResp struct {
+	DeviceID  string  `json:"deviceID"`
+	Timestamp int64   `json:"timestamp"`
+	Distance  float64 `json:"distance"`
+	queryRecordResp
+}
+
+type queryRecordsResp struct {
+	Records []*deviceRecordResp `json:"records"`
+	Offset  int                 `json:"offset"`
+	Limit   int                 `json:"limit"`
 }
 
 type receiveReq struct {
@@ -86,16 +105,15 @@ type receiveReq struct {
 // Therefore, we’ll use only two codes: 200 for success and 400 for failure.
 // Specific error details will be provided in the returned error message.
 type httpServer struct {
-	wsAddr string
-	engine *gin.Engine
-	db     *db.DB
-	prv    *ecdsa.PrivateKey
-}
-
-var pebbleProject = project.Config{
-	SignedKeys:         []project.SignedKey{{Name: "timestamp", Type: "uint64"}},
-	SignatureAlgorithm: "ecdsa",
-	HashAlgorithm:      "sha256",
+	forwarder  *forwarder
+	engine     *gin.Engine
+	db         *db.DB
+	prv        *ecdsa.PrivateKey
+	clockSkew  time.Duration
+	geoRadius  float64
+	projects   map[uint64]*project.Config // signing config of the served projects
+	mirror     *firmwareMirror            // nil if firmware artifacts are not verified
+	adminToken string                     // bearer token of the admin endpoints, which are disabled if empty
 }
 
 func (s *httpServer) pubkey(c *gin.Context) {
@@ -112,194 +130,497 @@ func (s *httpServer) query(c *gin.Context) {
 		return
 	}
 
+	metrics.TrackRequestCount("get")
+	now := time.Now()
+	defer func() {
+		metrics.TrackRequestDuration("get", time.Since(now))
+	}()
+
+	resp, err := s.queryDevice(req)
+	if err != nil {
+		slog.Error("failed to query device", "error", err, "device_id", req.DeviceID)
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// checkDevice rejects devices which are not registered, removed from the ioID registry or deactivated
+func checkDevice(d *db.Device) error {
+	if d == nil {
+		return errors.New("the device has not been registered")
+	}
+	switch d.Status {
+	case db.REMOVED:
+		return errors.New("the device has been removed")
+	case db.DEACTIVATED:
+		return errors.New("the device has been deactivated")
+	}
+	return nil
+}
+
+// queryDevice authenticates the query request and builds the signed device status response.
+// It is shared by the http and mqtt front-ends.
+func (s *httpServer) queryDevice(req *queryReq) (*queryResp, error) {
 	deviceAddr := common.HexToAddress(strings.TrimPrefix(req.DeviceID, "did:io:"))
 	sigStr := req.Signature
 	req.Signature = ""
 
 	ok, err := s.verifySignature(deviceAddr, sigStr, req)
 	if err != nil {
-		slog.Error("failed to verify signature", "error", err)
-		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to verify signature")))
-		return
+		return nil, errors.Wrap(err, "failed to verify signature")
 	}
 	if !ok {
-		slog.Error("signature mismatch")
-		c.JSON(http.StatusBadRequest, newErrResp(errors.New("signature mismatch")))
-		return
+		return nil, errors.New("signature mismatch")
 	}
 
 	d, err := s.db.Device(req.DeviceID)
 	if err != nil {
-		slog.Error("failed to query device", "error", err, "device_id", req.DeviceID)
-		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to query device")))
-		return
+		return nil, errors.Wrap(err, "failed to query device")
 	}
-	if d == nil {
-		slog.Error("the device has not been registered", "device_id", req.DeviceID)
-		c.JSON(http.StatusBadRequest, newErrResp(errors.New("the device has not been registered")))
-		return
+	if err := checkDevice(d); err != nil {
+		return nil, err
 	}
 
 	metrics.TrackDeviceCount(req.DeviceID)
-	metrics.TrackRequestCount("get")
-	now := time.Now()
-	defer func() {
-		metrics.TrackRequestDuration("get", time.Since(now))
-	}()
 
-	var (
-		firmware string
-		uri      string
-		version  string
-	)
-	if parts := strings.Split(d.RealFirmware, " "); len(parts) == 2 {
-		app, err := s.db.App(parts[0])
-		if err != nil {
-			slog.Error("failed to query app", "error", err, "app_id", parts[0])
-			c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to query app")))
-			return
-		}
-		if app != nil {
-			firmware = app.ID
-			uri = app.Uri
-			version = app.Version
+	firmware, err := s.resolveFirmware(d)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve firmware")
+	}
+	// the firmware is not served until its mirrored artifact matches the manifest
+	if firmware != nil {
+		if err := s.mirror.verify(firmware); err != nil {
+			slog.Error("failed to verify firmware artifact", "error", err, "device_id", d.ID,
+				"firmware", firmware.Firmware, "version", firmware.Version)
+			firmware = nil
 		}
 	}
 
+	// the pending config is returned until the device reports it applied
+	config, err := parsePendingConfig(d)
+	if err != nil {
+		slog.Error("failed to parse pending config", "error", err, "device_id", d.ID)
+	}
+
+	proposal, err := newProposal(d)
+	if err != nil {
+		return nil, err
+	}
+
 	resp := &queryResp{
 		Timestamp: int32(time.Now().Unix()),
 		Status:    d.Status,
 		Owner:     d.Owner,
-		Firmware:  firmware,
-		URI:       uri,
-		Version:   version,
+		Config:    config,
+		Proposal:  proposal,
+	}
+	if firmware != nil {
+		resp.Firmware = firmware.Firmware
+		resp.URI = firmware.URI
+		resp.Version = firmware.Version
+		resp.Hash = firmware.Hash
+		resp.Size = firmware.Size
+		resp.MinVersion = firmware.MinVersion
 	}
 	respJ, err := json.Marshal(resp)
 	if err != nil {
-		slog.Error("failed to marshal response", "error", err)
-		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to marshal response")))
-		return
+		return nil, errors.Wrap(err, "failed to marshal response")
 	}
 	hash := sha256.New()
 	hash.Write(respJ)
 	h := hash.Sum(nil)
 	sig, err := crypto.Sign(h, s.prv)
 	if err != nil {
-		slog.Error("failed to sign response", "error", err)
-		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to sign response")))
-		return
+		return nil, errors.Wrap(err, "failed to sign response")
 	}
 	resp.Signature = hexutil.Encode(sig)
+	// the device is recorded as served only once the verified firmware is in the response
+	if firmware != nil {
+		if err := s.serveRollout(d, firmware); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
 
-	c.JSON(http.StatusOK, resp)
+func newQueryRecordResp(d *db.DeviceRecord) *queryRecordResp {
+	return &queryRecordResp{
+		Snr:           d.Snr,
+		Vbat:          d.Vbat,
+		GasResistance: d.GasResistance,
+		Temperature:   d.Temperature,
+		Temperature2:  d.Temperature2,
+		Pressure:      d.Pressure,
+		Humidity:      d.Humidity,
+		Light:         d.Light,
+		Gyroscope:     d.Gyroscope,
+		Accelerometer: d.Accelerometer,
+		Latitude:      d.Latitude,
+		Longitude:     d.Longitude,
+		Verified:      d.Verified,
+	}
+}
+
+// parseFloatQuery parses float query parameters in order, returning the first parse failure
+func parseFloatQuery(c *gin.Context, keys ...string) ([]float64, error) {
+	res := make([]float64, 0, len(keys))
+	for _, k := range keys {
+		v, err := strconv.ParseFloat(c.Query(k), 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", k)
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+const (
+	defaultRecordPageSize = 20
+	maxRecordPageSize     = 100
+	defaultHistoryRange   = 24 * time.Hour
+	maxLatestRecordRange  = 7 * 24 * time.Hour
+)
+
+func parsePagination(c *gin.Context) (offset, limit int, err error) {
+	offset, err = strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		return 0, 0, errors.New("invalid offset")
+	}
+	limit, err = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultRecordPageSize)))
+	if err != nil || limit <= 0 || limit > maxRecordPageSize {
+		return 0, 0, errors.Errorf("invalid limit, should be in range [1, %d]", maxRecordPageSize)
+	}
+	return offset, limit, nil
+}
+
+// recordReader returns the db view to read device records from, the optional source query parameter
+// restricts the read to the primary or the legacy db during the legacy db migration period
+func (s *httpServer) recordReader(c *gin.Context) (*db.DB, error) {
+	switch src := c.DefaultQuery("source", db.SourceAll.String()); src {
+	case db.SourceAll.String():
+		return s.db.From(db.SourceAll), nil
+	case db.SourcePrimary.String():
+		return s.db.From(db.SourcePrimary), nil
+	case db.SourceLegacy.String():
+		return s.db.From(db.SourceLegacy), nil
+	default:
+		return nil, errors.Errorf("invalid source %s", src)
+	}
 }
 
 func (s *httpServer) deviceRecord(c *gin.Context) {
-	lat := c.Query("lat")
-	lon := c.Query("lon")
+	mode := db.GeoQueryMode(c.DefaultQuery("mode", string(db.GeoQueryRadius)))
+	rd, err := s.recordReader(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+	if mode != db.GeoQueryRadius {
+		s.deviceRecords(c, rd, mode)
+		return
+	}
+
+	vs, err := parseFloatQuery(c, "lat", "lon")
+	if err != nil {
+		slog.Error("failed to parse coordinate", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
 
-	d, err := s.db.QueryDeviceRecord(lat, lon)
+	d, err := rd.QueryDeviceRecord(vs[0], vs[1], s.geoRadius)
 	if err != nil {
 		slog.Error("failed to query device record", "error", err)
+		var coordErr *db.InvalidCoordinateError
+		if errors.As(err, &coordErr) {
+			c.JSON(http.StatusBadRequest, newErrResp(err))
+			return
+		}
 		c.JSON(http.StatusInternalServerError, newErrResp(errors.Wrap(err, "failed to query device record")))
 		return
 	}
 	resp := &queryRecordResp{}
 	if d != nil {
-		resp = &queryRecordResp{
-			Snr:           d.Snr,
-			Vbat:          d.Vbat,
-			GasResistance: d.GasResistance,
-			Temperature:   d.Temperature,
-			Temperature2:  d.Temperature2,
-			Pressure:      d.Pressure,
-			Humidity:      d.Humidity,
-			Light:         d.Light,
-			Gyroscope:     d.Gyroscope,
-			Accelerometer: d.Accelerometer,
-			Latitude:      d.Latitude,
-			Longitude:     d.Longitude,
+		resp = newQueryRecordResp(d)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *httpServer) deviceRecords(c *gin.Context, rd *db.DB, mode db.GeoQueryMode) {
+	offset, limit, err := parsePagination(c)
+	if err != nil {
+		slog.Error("failed to parse pagination", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+
+	// only the devices with a record in the last day, or since the unix timestamp of the since query parameter
+	// which is at most maxLatestRecordRange ago, are queried
+	now := time.Now().Unix()
+	since := now - int64(defaultHistoryRange/time.Second)
+	if v := c.Query("since"); v != "" {
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < now-int64(maxLatestRecordRange/time.Second) {
+			slog.Error("failed to parse since", "since", v)
+			c.JSON(http.StatusBadRequest, newErrResp(errors.Errorf("invalid since, should be within %s", maxLatestRecordRange)))
+			return
+		}
+	}
+
+	q := &db.DeviceRecordQuery{
+		Mode:   mode,
+		Since:  since,
+		Offset: offset,
+		Limit:  limit,
+	}
+	switch mode {
+	case db.GeoQueryNearest:
+		vs, err := parseFloatQuery(c, "lat", "lon")
+		if err != nil {
+			slog.Error("failed to parse coordinate", "error", err)
+			c.JSON(http.StatusBadRequest, newErrResp(err))
+			return
+		}
+		q.Latitude, q.Longitude = vs[0], vs[1]
+	case db.GeoQueryBBox:
+		vs, err := parseFloatQuery(c, "min_lat", "min_lon", "max_lat", "max_lon")
+		if err != nil {
+			slog.Error("failed to parse bounding box", "error", err)
+			c.JSON(http.StatusBadRequest, newErrResp(err))
+			return
+		}
+		q.MinLatitude, q.MinLongitude, q.MaxLatitude, q.MaxLongitude = vs[0], vs[1], vs[2], vs[3]
+	default:
+		slog.Error("unsupported query mode", "mode", mode)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Errorf("unsupported query mode %s", mode)))
+		return
+	}
+
+	ds, err := rd.QueryDeviceRecords(q)
+	if err != nil {
+		slog.Error("failed to query device records", "error", err, "mode", mode)
+		var coordErr *db.InvalidCoordinateError
+		if errors.As(err, &coordErr) {
+			c.JSON(http.StatusBadRequest, newErrResp(err))
+			return
 		}
+		c.JSON(http.StatusInternalServerError, newErrResp(errors.Wrap(err, "failed to query device records")))
+		return
+	}
+	resp := &queryRecordsResp{
+		Records: make([]*deviceRecordResp, 0, len(ds)),
+		Offset:  offset,
+		Limit:   limit,
+	}
+	for _, d := range ds {
+		resp.Records = append(resp.Records, &deviceRecordResp{
+			DeviceID:        d.Imei,
+			Timestamp:       d.Timestamp,
+			Distance:        d.Distance,
+			queryRecordResp: *newQueryRecordResp(&d.DeviceRecord),
+		})
 	}
 	c.JSON(http.StatusOK, resp)
 }
 
-func (s *httpServer) receive(c *gin.Context) {
-	req := &receiveReq{}
-	if err := c.ShouldBindJSON(req); err != nil {
-		slog.Error("failed to bind request", "error", err)
-		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid request payload")))
+type historyResp struct {
+	DeviceID string           `json:"deviceID"`
+	Records  []map[string]any `json:"records"`
+	Offset   int              `json:"offset"`
+	Limit    int              `json:"limit"`
+}
+
+type bucketResp struct {
+	Timestamp int64                     `json:"timestamp"`
+	Count     int64                     `json:"count"`
+	Verified  int64                     `json:"verified"` // the number of records with a verified package signature
+	Fields    map[string]*db.FieldStats `json:"fields"`
+}
+
+type downsampleResp struct {
+	DeviceID string        `json:"deviceID"`
+	Interval int64         `json:"interval"`
+	Buckets  []*bucketResp `json:"buckets"`
+	Offset   int           `json:"offset"`
+	Limit    int           `json:"limit"`
+}
+
+// parseHistoryQuery parses the time range [from, to) in unix seconds, the comma separated fields and pagination,
+// the last 24 hours is queried by default
+func parseHistoryQuery(c *gin.Context, defaultFields []string) (*db.DeviceRecordHistoryQuery, error) {
+	offset, limit, err := parsePagination(c)
+	if err != nil {
+		return nil, err
+	}
+	to := time.Now().Unix()
+	if v := c.Query("to"); v != "" {
+		if to, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.Wrap(err, "invalid to")
+		}
+	}
+	from := to - int64(defaultHistoryRange/time.Second)
+	if v := c.Query("from"); v != "" {
+		if from, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.Wrap(err, "invalid from")
+		}
+	}
+	fields := defaultFields
+	if v := c.Query("fields"); v != "" {
+		fields = strings.Split(v, ",")
+	}
+	return &db.DeviceRecordHistoryQuery{
+		Imei:   c.Param("id"),
+		From:   from,
+		To:     to,
+		Fields: fields,
+		Offset: offset,
+		Limit:  limit,
+	}, nil
+}
+
+var (
+	allHistoryFields = []string{"snr", "vbat", "gasResistance", "temperature", "temperature2", "pressure",
+		"humidity", "light", "gyroscope", "accelerometer", "latitude", "longitude"}
+	allDownsampleFields = []string{"snr", "vbat", "gasResistance", "temperature", "temperature2", "pressure",
+		"humidity", "light"}
+)
+
+func (s *httpServer) deviceRecordHistory(c *gin.Context) {
+	q, err := parseHistoryQuery(c, allHistoryFields)
+	if err != nil {
+		slog.Error("failed to parse history query", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(err))
 		return
 	}
 
-	deviceAddr := common.HexToAddress(strings.TrimPrefix(req.DeviceID, "did:io:"))
-	sigStr := req.Signature
-	req.Signature = ""
+	rd, err := s.recordReader(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+	ds, err := rd.DeviceRecordHistory(q)
+	if err != nil {
+		slog.Error("failed to query device record history", "error", err, "device_id", q.Imei)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to query device record history")))
+		return
+	}
+	resp := &historyResp{
+		DeviceID: q.Imei,
+		Records:  make([]map[string]any, 0, len(ds)),
+		Offset:   q.Offset,
+		Limit:    q.Limit,
+	}
+	for _, d := range ds {
+		r := map[string]any{"timestamp": d.Timestamp, "verified": d.Verified}
+		for _, f := range q.Fields {
+			r[f] = d.Field(f)
+		}
+		resp.Records = append(resp.Records, r)
+	}
+	c.JSON(http.StatusOK, resp)
+}
 
-	ok, err := s.verifySignature(deviceAddr, sigStr, req)
+func (s *httpServer) deviceRecordDownsample(c *gin.Context) {
+	q, err := parseHistoryQuery(c, allDownsampleFields)
 	if err != nil {
-		slog.Error("failed to verify signature", "error", err)
-		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to verify signature")))
+		slog.Error("failed to parse downsample query", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(err))
 		return
 	}
-	if !ok {
-		slog.Error("signature mismatch")
-		c.JSON(http.StatusBadRequest, newErrResp(errors.New("signature mismatch")))
+	interval, err := strconv.ParseInt(c.DefaultQuery("interval", "3600"), 10, 64)
+	if err != nil || interval <= 0 {
+		slog.Error("failed to parse interval", "interval", c.Query("interval"))
+		c.JSON(http.StatusBadRequest, newErrResp(errors.New("invalid interval")))
 		return
 	}
 
-	d, err := s.db.Device(req.DeviceID)
+	rd, err := s.recordReader(c)
 	if err != nil {
-		slog.Error("failed to query device", "error", err, "device_id", req.DeviceID)
-		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to query device")))
+		c.JSON(http.StatusBadRequest, newErrResp(err))
 		return
 	}
-	if d == nil {
-		slog.Error("the device has not been registered", "device_id", req.DeviceID)
-		c.JSON(http.StatusBadRequest, newErrResp(errors.New("the device has not been registered")))
+	bs, err := rd.DownsampleDeviceRecord(q, interval)
+	if err != nil {
+		slog.Error("failed to downsample device record", "error", err, "device_id", q.Imei)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to downsample device record")))
+		return
+	}
+	resp := &downsampleResp{
+		DeviceID: q.Imei,
+		Interval: interval,
+		Buckets:  make([]*bucketResp, 0, len(bs)),
+		Offset:   q.Offset,
+		Limit:    q.Limit,
+	}
+	for _, b := range bs {
+		resp.Buckets = append(resp.Buckets, &bucketResp{
+			Timestamp: b.Start,
+			Count:     b.Count,
+			Verified:  b.Verified,
+			Fields:    b.Fields,
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *httpServer) receive(c *gin.Context) {
+	req := &receiveReq{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		slog.Error("failed to bind request", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid request payload")))
 		return
 	}
 
-	metrics.TrackDeviceCount(req.DeviceID)
 	metrics.TrackRequestCount("post")
 	now := time.Now()
 	defer func() {
 		metrics.TrackRequestDuration("post", time.Since(now))
 	}()
 
-	payload, err := base64.RawURLEncoding.DecodeString(req.Payload)
-	if err != nil {
-		slog.Error("failed to decode base64 data", "error", err)
-		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to decode base64 data")))
+	if err := s.receiveData(req); err != nil {
+		slog.Error("failed to receive device data", "error", err, "device_id", req.DeviceID)
+		c.JSON(http.StatusBadRequest, newErrResp(err))
 		return
 	}
-	pkg, data, err := s.unmarshalPayload(payload)
+	c.Status(http.StatusOK)
+}
+
+// receiveData authenticates the upload request, then decodes and persists the BinPackage it carries.
+// It is shared by the http and mqtt front-ends.
+func (s *httpServer) receiveData(req *receiveReq) error {
+	deviceAddr := common.HexToAddress(strings.TrimPrefix(req.DeviceID, "did:io:"))
+	sigStr := req.Signature
+	req.Signature = ""
+
+	ok, err := s.verifySignature(deviceAddr, sigStr, req)
 	if err != nil {
-		slog.Error("failed to unmarshal payload", "error", err)
-		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to unmarshal payload")))
-		return
+		return errors.Wrap(err, "failed to verify signature")
 	}
-	if err := s.handle(req.DeviceID, pkg, data); err != nil {
-		slog.Error("failed to handle payload data", "error", err)
-		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to handle payload data")))
-		return
+	if !ok {
+		return errors.New("signature mismatch")
 	}
-	c.Status(http.StatusOK)
-}
 
-func (s *httpServer) forwardWs(req *wsapi.CreateTaskReq) {
-	jsonData, err := json.Marshal(req)
+	d, err := s.db.Device(req.DeviceID)
 	if err != nil {
-		slog.Error("failed to marshal request when forward w3bstream", "error", err)
-		return
+		return errors.Wrap(err, "failed to query device")
+	}
+	if err := checkDevice(d); err != nil {
+		return err
 	}
-	targetURL := fmt.Sprintf("https://%s/v1/task", s.wsAddr)
-	resp, err := http.Post(targetURL, "application/json", bytes.NewBuffer(jsonData))
+
+	metrics.TrackDeviceCount(req.DeviceID)
+
+	payload, err := base64.RawURLEncoding.DecodeString(req.Payload)
 	if err != nil {
-		slog.Error("failed to send http request when forward w3bstream", "error", err)
-		return
+		return errors.Wrap(err, "failed to decode base64 data")
+	}
+	pkg, data, err := s.unmarshalPayload(payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to unmarshal payload")
 	}
-	defer resp.Body.Close()
+	if err := s.handle(d, pkg, data); err != nil {
+		return errors.Wrap(err, "failed to handle payload data")
+	}
+	return nil
 }
 
 func (s *httpServer) receiveV2(c *gin.Context) {
@@ -309,7 +630,6 @@ func (s *httpServer) receiveV2(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid request payload")))
 		return
 	}
-	s.forwardWs(req)
 	pid, ok := new(big.Int).SetString(req.ProjectID, 10)
 	if !ok {
 		slog.Error("failed to decode project id string", "project_id", req.ProjectID)
@@ -328,7 +648,14 @@ func (s *httpServer) receiveV2(c *gin.Context) {
 		return
 	}
 
-	recovered, _, _, err := recover(*req, &pebbleProject, sig)
+	cfg, ok := s.projects[pid.Uint64()]
+	if !ok {
+		slog.Error("project is not served", "project_id", pid.String())
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Errorf("project %s is not served", pid.String())))
+		return
+	}
+
+	recovered, _, _, err := recover(*req, cfg, sig)
 	if err != nil {
 		slog.Error("failed to recover public key", "error", err)
 		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid signature; could not recover public key")))
@@ -343,7 +670,7 @@ func (s *httpServer) receiveV2(c *gin.Context) {
 			c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to query device")))
 			return
 		}
-		if d != nil {
+		if d != nil && d.ProjectID == pid.Uint64() {
 			approved = true
 			device = d
 			break
@@ -354,6 +681,11 @@ func (s *httpServer) receiveV2(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, newErrResp(errors.New("device does not have permission")))
 		return
 	}
+	if err := checkDevice(device); err != nil {
+		slog.Error("device is not available", "error", err, "device_id", device.ID)
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
 
 	metrics.TrackDeviceCount(device.ID)
 	metrics.TrackRequestCount("post")
@@ -375,14 +707,216 @@ func (s *httpServer) receiveV2(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to unmarshal payload")))
 		return
 	}
-	if err := s.handle(device.ID, pkg, data); err != nil {
+	if err := s.handle(device, pkg, data); err != nil {
 		slog.Error("failed to handle payload data", "error", err)
 		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to handle payload data")))
 		return
 	}
+	if s.forwarder != nil {
+		if err := s.forwarder.enqueue(device.ID, req); err != nil {
+			slog.Error("failed to enqueue w3bstream task", "error", err, "device_id", device.ID)
+		}
+	}
 	c.Status(http.StatusOK)
 }
 
+type statusChangeResp struct {
+	BlockNumber uint64    `json:"blockNumber"`
+	TxHash      string    `json:"txHash"`
+	PrevStatus  int32     `json:"prevStatus"`
+	Status      int32     `json:"status"`
+	Reason      string    `json:"reason"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type statusHistoryResp struct {
+	DeviceID string              `json:"deviceID"`
+	Status   int32               `json:"status"`
+	Changes  []*statusChangeResp `json:"changes"`
+}
+
+func (s *httpServer) deviceStatusHistory(c *gin.Context) {
+	id := c.Param("id")
+	d, err := s.db.Device(id)
+	if err != nil {
+		slog.Error("failed to query device", "error", err, "device_id", id)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to query device")))
+		return
+	}
+	if d == nil {
+		c.JSON(http.StatusBadRequest, newErrResp(errors.New("the device has not been registered")))
+		return
+	}
+	ts, err := s.db.DeviceStatusChanges(d.ID)
+	if err != nil {
+		slog.Error("failed to query device status changes", "error", err, "device_id", id)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to query device status changes")))
+		return
+	}
+	resp := &statusHistoryResp{
+		DeviceID: d.ID,
+		Status:   d.Status,
+		Changes:  make([]*statusChangeResp, 0, len(ts)),
+	}
+	for _, t := range ts {
+		resp.Changes = append(resp.Changes, &statusChangeResp{
+			BlockNumber: t.BlockNumber,
+			TxHash:      t.TxHash,
+			PrevStatus:  t.PrevStatus,
+			Status:      t.Status,
+			Reason:      t.Reason,
+			CreatedAt:   t.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type projectResp struct {
+	ID        uint64            `json:"id"`
+	Name      string            `json:"name"`
+	Owner     string            `json:"owner"`
+	Operators []string          `json:"operators"`
+	Metadata  map[string]string `json:"metadata"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+type contractResp struct {
+	Address string `json:"address"`
+	Owner   string `json:"owner"`
+}
+
+type projectsResp struct {
+	Projects  []*projectResp  `json:"projects"`
+	Contracts []*contractResp `json:"contracts"`
+}
+
+func newProjectResp(p *db.Project) *projectResp {
+	resp := &projectResp{
+		ID:        p.ID,
+		Name:      p.Name,
+		Owner:     p.Owner,
+		Operators: p.Operators,
+		Metadata:  p.Metadata,
+		UpdatedAt: p.UpdatedAt,
+	}
+	if resp.Operators == nil {
+		resp.Operators = []string{}
+	}
+	if resp.Metadata == nil {
+		resp.Metadata = map[string]string{}
+	}
+	return resp
+}
+
+func (s *httpServer) queryProjects(c *gin.Context) {
+	ps, err := s.db.Projects()
+	if err != nil {
+		slog.Error("failed to query projects", "error", err)
+		c.JSON(http.StatusInternalServerError, newErrResp(errors.Wrap(err, "failed to query projects")))
+		return
+	}
+	cs, err := s.db.ProjectContracts()
+	if err != nil {
+		slog.Error("failed to query project contracts", "error", err)
+		c.JSON(http.StatusInternalServerError, newErrResp(errors.Wrap(err, "failed to query project contracts")))
+		return
+	}
+	resp := &projectsResp{
+		Projects:  make([]*projectResp, 0, len(ps)),
+		Contracts: make([]*contractResp, 0, len(cs)),
+	}
+	for _, p := range ps {
+		resp.Projects = append(resp.Projects, newProjectResp(p))
+	}
+	for _, t := range cs {
+		resp.Contracts = append(resp.Contracts, &contractResp{Address: t.Address, Owner: t.Owner})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *httpServer) queryProject(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid project id")))
+		return
+	}
+	p, err := s.db.Project(id)
+	if err != nil {
+		slog.Error("failed to query project", "error", err, "project_id", id)
+		c.JSON(http.StatusInternalServerError, newErrResp(errors.Wrap(err, "failed to query project")))
+		return
+	}
+	if p == nil {
+		c.JSON(http.StatusNotFound, newErrResp(errors.Errorf("project %d not found", id)))
+		return
+	}
+	c.JSON(http.StatusOK, newProjectResp(p))
+}
+
+type deadMessageResp struct {
+	ID             uint      `json:"id"`
+	MessageID      string    `json:"messageID"`
+	DeviceID       string    `json:"deviceID"`
+	ProjectID      uint64    `json:"projectID"`
+	ProjectVersion string    `json:"projectVersion"`
+	Attempts       int32     `json:"attempts"`
+	LastError      string    `json:"lastError"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+type deadMessagesResp struct {
+	Messages []*deadMessageResp `json:"messages"`
+	Offset   int                `json:"offset"`
+	Limit    int                `json:"limit"`
+}
+
+// adminAuth rejects the request unless it carries the admin bearer token
+func (s *httpServer) adminAuth(c *gin.Context) {
+	if s.adminToken == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, newErrResp(errors.New("admin endpoints are disabled")))
+		return
+	}
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, newErrResp(errors.New("invalid admin token")))
+		return
+	}
+	c.Next()
+}
+
+func (s *httpServer) deadMessages(c *gin.Context) {
+	offset, limit, err := parsePagination(c)
+	if err != nil {
+		slog.Error("failed to parse pagination", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+	ms, err := s.db.DeadMessages(offset, limit)
+	if err != nil {
+		slog.Error("failed to query dead messages", "error", err)
+		c.JSON(http.StatusInternalServerError, newErrResp(errors.Wrap(err, "failed to query dead messages")))
+		return
+	}
+	resp := &deadMessagesResp{
+		Messages: make([]*deadMessageResp, 0, len(ms)),
+		Offset:   offset,
+		Limit:    limit,
+	}
+	for _, m := range ms {
+		resp.Messages = append(resp.Messages, &deadMessageResp{
+			ID:             m.ID,
+			MessageID:      m.MessageID,
+			DeviceID:       m.ClientID,
+			ProjectID:      m.ProjectID,
+			ProjectVersion: m.ProjectVersion,
+			Attempts:       m.Attempts,
+			LastError:      m.LastError,
+			CreatedAt:      m.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
 func recover(req wsapi.CreateTaskReq, cfg *project.Config, sig []byte) (res []*struct {
 	addr common.Address
 	sig  []byte
@@ -476,6 +1010,50 @@ func (s *httpServer) recover(sig, h []byte) (common.Address, error) {
 	return crypto.PubkeyToAddress(*sigpk), nil
 }
 
+// packageDigest computes the digest signed by the device firmware over the inner BinPackage fields:
+// sha256(type(int32, big endian) || data || timestamp(uint32, big endian))
+func packageDigest(pkg *proto.BinPackage) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, int32(pkg.GetType())); err != nil {
+		return nil, errors.Wrap(err, "failed to write package type")
+	}
+	buf.Write(pkg.GetData())
+	if err := binary.Write(buf, binary.BigEndian, pkg.GetTimestamp()); err != nil {
+		return nil, errors.Wrap(err, "failed to write package timestamp")
+	}
+	h := sha256.Sum256(buf.Bytes())
+	return h[:], nil
+}
+
+// verifyPackage recovers the signer of the BinPackage and reports whether it is the device address.
+// The device signature is in 64 bytes r||s format, so both recover ids are tried.
+func (s *httpServer) verifyPackage(deviceAddr common.Address, pkg *proto.BinPackage) (bool, error) {
+	h, err := packageDigest(pkg)
+	if err != nil {
+		return false, err
+	}
+	return s.verifyDigest(deviceAddr, pkg.GetSignature(), h)
+}
+
+// verifyDigest reports whether the 64 bytes r||s signature of digest h is signed by the device address
+func (s *httpServer) verifyDigest(deviceAddr common.Address, sig, h []byte) (bool, error) {
+	if len(sig) != 64 {
+		return false, errors.Errorf("invalid package signature length %d", len(sig))
+	}
+	for _, id := range []uint8{0, 1} {
+		ns := append(append(make([]byte, 0, 65), sig...), id)
+		a, err := s.recover(ns, h)
+		if err != nil {
+			slog.Debug("failed to recover address from package signature", "error", err, "recover_id", id)
+			continue
+		}
+		if bytes.Equal(a.Bytes(), deviceAddr.Bytes()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (s *httpServer) unmarshalPayload(payload []byte) (*proto.BinPackage, goproto.Message, error) {
 	pkg := &proto.BinPackage{}
 	if err := goproto.Unmarshal(payload, pkg); err != nil {
@@ -498,20 +1076,65 @@ func (s *httpServer) unmarshalPayload(payload []byte) (*proto.BinPackage, goprot
 	return pkg, d, errors.Wrapf(err, "failed to unmarshal senser package")
 }
 
-func (s *httpServer) handle(id string, pkg *proto.BinPackage, data goproto.Message) (err error) {
-	switch data := data.(type) {
-	case *proto.SensorConfig:
-		err = s.handleConfig(id, data)
-	case *proto.SensorState:
-		err = s.handleState(id, data)
-	case *proto.SensorData:
-		err = s.handleSensor(id, pkg, data)
+// checkReplay rejects packages whose timestamp is too far in the future or not newer than
+// the last accepted package of the device, and records the timestamp as accepted otherwise.
+// It is called in the transaction of the package writes, so a package whose handling fails can be retried.
+func (s *httpServer) checkReplay(d *db.Device, timestamp uint32) error {
+	ts := int64(timestamp)
+	if limit := time.Now().Add(s.clockSkew).Unix(); ts > limit {
+		return errors.Errorf("package timestamp %d is ahead of server time beyond allowed clock skew %s", ts, s.clockSkew)
+	}
+	if ts <= d.LastTimestamp {
+		return errors.Errorf("stale package timestamp %d, last accepted timestamp %d", ts, d.LastTimestamp)
+	}
+	accepted, err := s.db.AdvanceLastTimestamp(d.ID, ts)
+	if err != nil {
+		return err
+	}
+	if !accepted {
+		return errors.Errorf("stale package timestamp %d", ts)
 	}
-	return errors.Wrapf(err, "failed to handle %T", data)
+	return nil
 }
 
-func (s *httpServer) handleConfig(id string, data *proto.SensorConfig) error {
-	err := s.db.UpdateByID(id, map[string]any{
+// transaction runs fn with a server whose db writes are committed together
+func (s *httpServer) transaction(fn func(s *httpServer) error) error {
+	return s.db.Transaction(func(tx *db.DB) error {
+		c := *s
+		c.db = tx
+		return fn(&c)
+	})
+}
+
+func (s *httpServer) handle(d *db.Device, pkg *proto.BinPackage, data goproto.Message) error {
+	err := s.transaction(func(s *httpServer) (err error) {
+		if err := s.checkReplay(d, pkg.GetTimestamp()); err != nil {
+			return errors.Wrap(err, "replayed package")
+		}
+		switch data := data.(type) {
+		case *proto.SensorConfig:
+			err = s.handleConfig(d, data)
+		case *proto.SensorState:
+			err = s.handleState(d.ID, data)
+		case *proto.SensorData:
+			err = s.handleSensor(d, pkg, data)
+		}
+		return errors.Wrapf(err, "failed to handle %T", data)
+	})
+	if err != nil {
+		return err
+	}
+	if data, ok := data.(*proto.SensorConfig); ok {
+		if err := s.trackRollout(d, data.GetFirmware()); err != nil {
+			slog.Error("failed to track firmware rollout", "error", err, "device_id", d.ID, "firmware", data.GetFirmware())
+		}
+	}
+	return nil
+}
+
+func (s *httpServer) handleConfig(d *db.Device, data *proto.SensorConfig) error {
+	id := d.ID
+	values := map[string]any{
 		"bulk_upload":               int32(data.GetBulkUpload()),
 		"data_channel":              int32(data.GetDataChannel()),
 		"upload_period":             int32(data.GetUploadPeriod()),
@@ -521,8 +1144,20 @@ func (s *httpServer) handleConfig(id string, data *proto.SensorConfig) error {
 		"real_firmware":             data.GetFirmware(),
 		"configurable":              data.GetDeviceConfigurable(),
 		"updated_at":                time.Now(),
-	})
-	return errors.Wrapf(err, "failed to update device config: %s", id)
+	}
+	// the device acknowledges the pending config by reporting the same values
+	pending, err := parsePendingConfig(d)
+	if err != nil {
+		slog.Error("failed to parse pending config, drop it", "error", err, "device_id", id)
+		values["config"] = ""
+	} else if pending != nil && pending.matches(data) {
+		slog.Info("device applied pending config", "device_id", id, "version", pending.Version)
+		values["config"] = ""
+	}
+	if err := s.db.UpdateByID(id, values); err != nil {
+		return errors.Wrapf(err, "failed to update device config: %s", id)
+	}
+	return nil
 }
 
 func (s *httpServer) handleState(id string, data *proto.SensorState) error {
@@ -533,7 +1168,15 @@ func (s *httpServer) handleState(id string, data *proto.SensorState) error {
 	return errors.Wrapf(err, "failed to update device state: %s %d", id, int32(data.GetState()))
 }
 
-func (s *httpServer) handleSensor(id string, pkg *proto.BinPackage, data *proto.SensorData) error {
+func (s *httpServer) handleSensor(d *db.Device, pkg *proto.BinPackage, data *proto.SensorData) error {
+	id := d.ID
+	verified, err := s.verifyPackage(common.HexToAddress(d.Address), pkg)
+	if err != nil {
+		slog.Error("failed to verify package signature", "error", err, "device_id", id, "timestamp", pkg.GetTimestamp())
+	} else if !verified {
+		slog.Warn("package signature mismatch", "device_id", id, "timestamp", pkg.GetTimestamp())
+	}
+
 	snr := float64(data.GetSnr())
 	if snr > 2700 {
 		snr = 100
@@ -566,6 +1209,7 @@ func (s *httpServer) handleSensor(id string, pkg *proto.BinPackage, data *proto.
 		Imei:           id,
 		Timestamp:      int64(pkg.GetTimestamp()),
 		Signature:      hex.EncodeToString(append(pkg.GetSignature(), 0)),
+		Verified:       verified,
 		Operator:       "",
 		Snr:            strconv.FormatFloat(snr, 'f', 1, 64),
 		Vbat:           strconv.FormatFloat(vbat, 'f', 1, 64),
@@ -587,12 +1231,42 @@ func (s *httpServer) handleSensor(id string, pkg *proto.BinPackage, data *proto.
 	return nil
 }
 
-func Run(db *db.DB, address, wsAddr string, client *ethclient.Client, prv *ecdsa.PrivateKey) error {
+// Config is the configuration of the api server
+type Config struct {
+	Address        string                     // listen address of the http server
+	W3bstreamAddr  string                     // w3bstream endpoint the device data is forwarded to, disabled if empty
+	PrivateKey     *ecdsa.PrivateKey          // signing key of the responses
+	ClockSkew      time.Duration              // max skew of the request timestamps
+	GeoRadius      float64                    // radius of the device record queries by location
+	Projects       map[uint64]*project.Config // signing config of the served projects
+	FirmwareMirror string                     // dir of the firmware mirror, firmware artifacts are not verified if empty
+	AdminToken     string                     // bearer token of the admin endpoints, which are disabled if empty
+	Mqtt           *MqttConfig                // broker of the mqtt front-end, which is disabled if nil
+}
+
+func Run(db *db.DB, cfg *Config) error {
 	s := &httpServer{
-		wsAddr: wsAddr,
-		engine: gin.Default(),
-		db:     db,
-		prv:    prv,
+		engine:     gin.Default(),
+		db:         db,
+		prv:        cfg.PrivateKey,
+		clockSkew:  cfg.ClockSkew,
+		geoRadius:  cfg.GeoRadius,
+		projects:   cfg.Projects,
+		mirror:     newFirmwareMirror(cfg.FirmwareMirror),
+		adminToken: cfg.AdminToken,
+	}
+
+	if cfg.W3bstreamAddr != "" {
+		s.forwarder = newForwarder(db, cfg.W3bstreamAddr)
+		go s.forwarder.run()
+	}
+	go s.checkRollouts(rolloutCheckInterval)
+
+	// the mqtt front-end shares the server, so its requests are forwarded and signed as the http ones
+	if cfg.Mqtt != nil {
+		if _, err := runMqtt(s, cfg.Mqtt); err != nil {
+			return errors.Wrap(err, "failed to run mqtt server")
+		}
 	}
 
 	s.engine.GET("/metrics", gin.WrapH(promhttp.Handler()))
@@ -600,9 +1274,24 @@ func Run(db *db.DB, address, wsAddr string, client *ethclient.Client, prv *ecdsa
 	s.engine.GET("/device", s.query)
 	s.engine.POST("/device", s.receive)
 	s.engine.GET("/v2/device_record", s.deviceRecord)
+	s.engine.GET("/v2/device_record/:id/history", s.deviceRecordHistory)
+	s.engine.GET("/v2/device_record/:id/downsample", s.deviceRecordDownsample)
 	s.engine.GET("/v2/device", s.query)
 	s.engine.POST("/v2/device", s.receiveV2)
+	s.engine.POST("/v2/device/confirm", s.confirm)
+	s.engine.POST("/v2/device/:id/proposal", s.proposeDevice)
+	s.engine.GET("/v2/device/:id/status_history", s.deviceStatusHistory)
+	s.engine.POST("/v2/device/:id/config", s.setConfig)
+	s.engine.POST("/v2/device/:id/profile", s.updateDevice)
+	s.engine.POST("/v2/owner/devices", s.listDevices)
+	s.engine.GET("/v2/w3bstream/dead_letter", s.adminAuth, s.deadMessages)
+	s.engine.GET("/v2/project", s.queryProjects)
+	s.engine.GET("/v2/project/:id", s.queryProject)
+	s.engine.GET("/v2/project/:id/rollouts", s.queryRollouts)
+	s.engine.GET("/v2/rollout/:id", s.queryRollout)
+	s.engine.POST("/v2/rollout", s.createRollout)
+	s.engine.POST("/v2/rollout/:id", s.updateRollout)
 
-	err := s.engine.Run(address)
+	err := s.engine.Run(cfg.Address)
 	return errors.Wrap(err, "failed to start http server")
 }
@@ -0,0 +1,498 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+	goproto "google.golang.org/protobuf/proto"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/iotexproject/pebble-server/db"
+	"github.com/iotexproject/pebble-server/proto"
+)
+
+// newTestServer returns a server backed by an in-memory sqlite database,
+// it only covers the handlers without postgres specific sql
+func newTestServer(t *testing.T) *httpServer {
+	t.Helper()
+	d, err := db.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), nil)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	prv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &httpServer{
+		db:        d,
+		prv:       prv,
+		clockSkew: 5 * time.Minute,
+	}
+}
+
+// testDevice is a device registered in the server db which signs its requests with key
+type testDevice struct {
+	id  string
+	key *ecdsa.PrivateKey
+}
+
+func newTestDevice(t *testing.T, s *httpServer) *testDevice {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+	d := &testDevice{id: "did:io:" + strings.ToLower(addr.Hex()), key: key}
+	if err := s.db.UpsertDevice(1, &db.Device{
+		ID:             d.id,
+		NFTID:          addr.Big().String(),
+		Name:           d.id,
+		Owner:          "0x0000000000000000000000000000000000000001",
+		Address:        addr.Hex(),
+		Status:         db.CONFIRM,
+		OperationTimes: db.NewOperationTimes(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// nftID returns the ioID token id the device is registered with
+func (d *testDevice) nftID() string {
+	return crypto.PubkeyToAddress(d.key.PublicKey).Big().String()
+}
+
+// sign returns the 64 bytes r||s signature of the sha256 digest of data
+func (d *testDevice) sign(t *testing.T, data []byte) []byte {
+	t.Helper()
+	h := sha256.Sum256(data)
+	sig, err := crypto.Sign(h[:], d.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig[:64]
+}
+
+// signJSON signs the json of v, whose signature field must be empty
+func (d *testDevice) signJSON(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hexutil.Encode(d.sign(t, data))
+}
+
+func (d *testDevice) queryReq(t *testing.T) *queryReq {
+	t.Helper()
+	req := &queryReq{DeviceID: d.id}
+	req.Signature = d.signJSON(t, req)
+	return req
+}
+
+// dataReq returns the upload request of a SensorData package with timestamp ts
+func (d *testDevice) dataReq(t *testing.T, ts uint32, data *proto.SensorData) *receiveReq {
+	t.Helper()
+	raw, err := goproto.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := &proto.BinPackage{
+		Type:      proto.BinPackage_DATA.Enum(),
+		Data:      raw,
+		Timestamp: goproto.Uint32(ts),
+	}
+	h, err := packageDigest(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := crypto.Sign(h, d.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg.Signature = sig[:64]
+	payload, err := goproto.Marshal(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &receiveReq{DeviceID: d.id, Payload: base64.RawURLEncoding.EncodeToString(payload)}
+	req.Signature = d.signJSON(t, req)
+	return req
+}
+
+func TestPackageDigest(t *testing.T) {
+	h, err := packageDigest(&proto.BinPackage{
+		Type:      proto.BinPackage_STATE.Enum(),
+		Data:      []byte{1, 2, 3},
+		Timestamp: goproto.Uint32(0x5f5e1000),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha256(0x00000002 || 0x010203 || 0x5f5e1000)
+	want := "34eeba0581d6e4548b03b694c73fa0fe4e5adcc1505777ef5262e3f530d5b97c"
+	if got := hex.EncodeToString(h); got != want {
+		t.Errorf("unexpected package digest %s, want %s", got, want)
+	}
+}
+
+func TestReceiveDataRecordsVerified(t *testing.T) {
+	s := newTestServer(t)
+	d := newTestDevice(t, s)
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &testDevice{id: d.id, key: key}
+
+	now := uint32(time.Now().Unix())
+	if err := s.receiveData(d.dataReq(t, now-1, &proto.SensorData{})); err != nil {
+		t.Fatal(err)
+	}
+	// the package signed by another key is stored unverified, the envelope is still signed by the device
+	req := other.dataReq(t, now, &proto.SensorData{})
+	req.Signature = ""
+	req.Signature = d.signJSON(t, req)
+	if err := s.receiveData(req); err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := s.db.DeviceRecordHistory(&db.DeviceRecordHistoryQuery{
+		Imei:   d.id,
+		From:   int64(now - 1),
+		To:     int64(now + 1),
+		Fields: []string{"snr"},
+		Limit:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 2 {
+		t.Fatalf("expected two device records, got %d", len(rs))
+	}
+	if !rs[0].Verified || rs[1].Verified {
+		t.Errorf("unexpected verified flags %t, %t", rs[0].Verified, rs[1].Verified)
+	}
+}
+
+func TestReceiveDataRejectsReplayedPackages(t *testing.T) {
+	s := newTestServer(t)
+	d := newTestDevice(t, s)
+	now := uint32(time.Now().Unix())
+
+	req := d.dataReq(t, now, &proto.SensorData{})
+	if err := s.receiveData(req); err != nil {
+		t.Fatal(err)
+	}
+	for name, req := range map[string]*receiveReq{
+		"replayed":     d.dataReq(t, now, &proto.SensorData{}),
+		"stale":        d.dataReq(t, now-1, &proto.SensorData{}),
+		"clock skewed": d.dataReq(t, now+uint32(s.clockSkew/time.Second)+60, &proto.SensorData{}),
+	} {
+		err := s.receiveData(req)
+		if err == nil || !strings.Contains(err.Error(), "replayed package") {
+			t.Errorf("%s: expected the package to be rejected as replayed, got %v", name, err)
+		}
+	}
+	// a package within the clock skew is accepted
+	if err := s.receiveData(d.dataReq(t, now+60, &proto.SensorData{})); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceiveDataRetriesFailedPackages(t *testing.T) {
+	s := newTestServer(t)
+	d := newTestDevice(t, s)
+	now := uint32(time.Now().Unix())
+
+	// a record with the id of the package makes its handling fail
+	conflict := &db.DeviceRecord{ID: fmt.Sprintf("%s-%d", d.id, now), Imei: d.id, OperationTimes: db.NewOperationTimes()}
+	if err := s.db.CreateDeviceRecord(conflict); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.receiveData(d.dataReq(t, now, &proto.SensorData{})); err == nil {
+		t.Fatal("expected the package to fail")
+	}
+	dev, err := s.db.Device(d.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.LastTimestamp != 0 {
+		t.Fatalf("the timestamp of the failed package is accepted: %d", dev.LastTimestamp)
+	}
+
+	raw, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := raw.Delete(conflict).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.receiveData(d.dataReq(t, now, &proto.SensorData{})); err != nil {
+		t.Fatalf("the retried package is rejected: %v", err)
+	}
+	if err := s.receiveData(d.dataReq(t, now, &proto.SensorData{})); err == nil || !strings.Contains(err.Error(), "replayed package") {
+		t.Fatalf("expected the accepted package to be rejected as replayed, got %v", err)
+	}
+}
+
+func TestDeactivatedDevicesAreRejected(t *testing.T) {
+	s := newTestServer(t)
+	now := uint32(time.Now().Unix())
+	deactivate := map[string]func(d *testDevice) error{
+		db.StatusReasonIoIDBurned: func(d *testDevice) error {
+			nft, _ := new(big.Int).SetString(d.nftID(), 10)
+			return s.db.DeactivateDeviceByNFT(2, common.Hash{0x01}, nft, db.StatusReasonIoIDBurned)
+		},
+		db.StatusReasonWalletRemoved: func(d *testDevice) error {
+			return s.db.DeactivateDevice(2, common.Hash{0x02}, d.id, db.StatusReasonWalletRemoved)
+		},
+	}
+	for reason, fn := range deactivate {
+		d := newTestDevice(t, s)
+		if err := s.receiveData(d.dataReq(t, now, &proto.SensorData{})); err != nil {
+			t.Fatalf("%s: %v", reason, err)
+		}
+		if err := fn(d); err != nil {
+			t.Fatalf("%s: %v", reason, err)
+		}
+
+		err := s.receiveData(d.dataReq(t, now+1, &proto.SensorData{}))
+		if err == nil || !strings.Contains(err.Error(), "deactivated") {
+			t.Errorf("%s: expected the upload of a deactivated device to be rejected, got %v", reason, err)
+		}
+		if _, err := s.queryDevice(d.queryReq(t)); err == nil || !strings.Contains(err.Error(), "deactivated") {
+			t.Errorf("%s: expected the query of a deactivated device to be rejected, got %v", reason, err)
+		}
+		cs, err := s.db.DeviceStatusChanges(d.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cs) != 1 || cs[0].Status != db.DEACTIVATED || cs[0].Reason != reason {
+			t.Errorf("%s: unexpected status changes %+v", reason, cs)
+		}
+	}
+}
+
+func TestDeviceRecordRejectsInvalidCoordinates(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := newTestServer(t)
+	s.engine = gin.New()
+	s.engine.GET("/v2/device_record", s.deviceRecord)
+
+	for _, query := range []string{
+		"lat=1;DROP TABLE device_record&lon=2",
+		"lat=NaN&lon=2",
+		"lat=91&lon=2",
+		"lat=1&lon=-181",
+		"mode=nearest&lat=1",
+		"mode=bbox&min_lat=10&min_lon=0&max_lat=5&max_lon=1",
+		"mode=bbox&min_lat=0&min_lon=0&max_lat=1&max_lon=181",
+		"mode=unknown&lat=1&lon=2",
+	} {
+		w := httptest.NewRecorder()
+		s.engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v2/device_record?"+url.PathEscape(query), nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// newTestRecordServer returns a test server serving the device record history and downsampling
+// with the records of imei at the given timestamps
+func newTestRecordServer(t *testing.T, imei string, records map[int64]string) *httpServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	s := newTestServer(t)
+	s.engine = gin.New()
+	s.engine.GET("/v2/device_record/:id/history", s.deviceRecordHistory)
+	s.engine.GET("/v2/device_record/:id/downsample", s.deviceRecordDownsample)
+	for ts, temperature := range records {
+		if err := s.db.CreateDeviceRecord(&db.DeviceRecord{
+			ID: fmt.Sprintf("%s-%d", imei, ts), Imei: imei, Operator: "op", Timestamp: ts,
+			Temperature: temperature, Verified: ts%2 == 0,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func getJSON(t *testing.T, s *httpServer, path string, resp any) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+func TestDeviceRecordHistoryEndpoint(t *testing.T) {
+	imei := "123456789012345"
+	s := newTestRecordServer(t, imei, map[int64]string{10: "20", 21: "21", 30: "22", 100: "23"})
+
+	resp := &historyResp{}
+	if code := getJSON(t, s, "/v2/device_record/"+imei+"/history?from=10&to=100&fields=temperature", resp); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if resp.DeviceID != imei || resp.Offset != 0 || resp.Limit != defaultRecordPageSize || len(resp.Records) != 3 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	for i, want := range []struct {
+		ts          float64
+		verified    bool
+		temperature string
+	}{{10, true, "20"}, {21, false, "21"}, {30, true, "22"}} {
+		r := resp.Records[i]
+		if r["timestamp"] != want.ts || r["verified"] != want.verified || r["temperature"] != want.temperature {
+			t.Errorf("record %d: unexpected %v", i, r)
+		}
+		if len(r) != 3 {
+			t.Errorf("record %d: only the requested fields are expected, got %v", i, r)
+		}
+	}
+
+	resp = &historyResp{}
+	if code := getJSON(t, s, "/v2/device_record/"+imei+"/history?from=0&to=200&fields=temperature&offset=3&limit=2", resp); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if len(resp.Records) != 1 || resp.Records[0]["timestamp"] != float64(100) {
+		t.Fatalf("unexpected paginated records %v", resp.Records)
+	}
+
+	for _, query := range []string{
+		"from=100&to=10",
+		"from=x",
+		"fields=unknown",
+		"limit=0",
+		"source=unknown",
+	} {
+		if code := getJSON(t, s, "/v2/device_record/"+imei+"/history?"+query, &historyResp{}); code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDeviceRecordDownsampleEndpoint(t *testing.T) {
+	imei := "123456789012345"
+	s := newTestRecordServer(t, imei, map[int64]string{0: "20", 31: "22", 58: "24", 130: "30", 240: "99"})
+
+	resp := &downsampleResp{}
+	if code := getJSON(t, s, "/v2/device_record/"+imei+"/downsample?from=0&to=180&interval=60&fields=temperature", resp); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if resp.DeviceID != imei || resp.Interval != 60 || len(resp.Buckets) != 2 {
+		t.Fatalf("expected 2 buckets without the empty one, got %+v", resp)
+	}
+	if b := resp.Buckets[0]; b.Timestamp != 0 || b.Count != 3 || b.Verified != 2 {
+		t.Errorf("unexpected first bucket %+v", b)
+	}
+	if fs := resp.Buckets[0].Fields["temperature"]; fs == nil || fs.Min != 20 || fs.Max != 24 || fs.Avg != 22 {
+		t.Errorf("unexpected temperature stats %+v", fs)
+	}
+	if b := resp.Buckets[1]; b.Timestamp != 120 || b.Count != 1 || b.Fields["temperature"].Avg != 30 {
+		t.Errorf("unexpected second bucket %+v", b)
+	}
+
+	// a range without records has no buckets
+	resp = &downsampleResp{}
+	if code := getJSON(t, s, "/v2/device_record/"+imei+"/downsample?from=300&to=400&interval=60", resp); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if resp.Buckets == nil || len(resp.Buckets) != 0 {
+		t.Fatalf("expected an empty bucket list, got %v", resp.Buckets)
+	}
+
+	for _, query := range []string{
+		"interval=0",
+		"interval=-60",
+		"interval=hour",
+		"from=100&to=100",
+		"fields=gyroscope",
+		"offset=-1",
+	} {
+		if code := getJSON(t, s, "/v2/device_record/"+imei+"/downsample?"+query, &downsampleResp{}); code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestQueryProjects(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := newTestServer(t)
+	s.engine = gin.New()
+	s.engine.GET("/v2/project", s.queryProjects)
+	s.engine.GET("/v2/project/:id", s.queryProject)
+
+	operator := common.HexToAddress("0x00000000000000000000000000000000000000e1")
+	if err := s.db.UpdateProject(10, 2, func(p *db.Project) {
+		p.Name = "pebble"
+		p.Owner = "0x0000000000000000000000000000000000000001"
+		p.AddOperator(operator)
+		p.Metadata["version"] = "0x01"
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.UpdateProject(10, 1, func(p *db.Project) { p.Name = "legacy" }); err != nil {
+		t.Fatal(err)
+	}
+	contract := common.HexToAddress("0x00000000000000000000000000000000000000a1")
+	admin := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	if err := s.db.UpdateProjectContractOwner(10, contract, admin); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := &projectsResp{}
+	if code := getJSON(t, s, "/v2/project", resp); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if len(resp.Projects) != 2 || resp.Projects[0].ID != 1 || resp.Projects[1].ID != 2 {
+		t.Fatalf("unexpected projects %+v", resp.Projects)
+	}
+	// the empty lists are returned as such
+	if p := resp.Projects[0]; p.Name != "legacy" || p.Operators == nil || len(p.Operators) != 0 || p.Metadata == nil {
+		t.Errorf("unexpected project %+v", p)
+	}
+	if len(resp.Contracts) != 1 || resp.Contracts[0].Address != contract.String() || resp.Contracts[0].Owner != admin.String() {
+		t.Errorf("unexpected contracts %+v", resp.Contracts)
+	}
+
+	p := &projectResp{}
+	if code := getJSON(t, s, "/v2/project/2", p); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if p.ID != 2 || p.Name != "pebble" || p.Owner != "0x0000000000000000000000000000000000000001" ||
+		len(p.Operators) != 1 || p.Operators[0] != operator.String() || p.Metadata["version"] != "0x01" {
+		t.Errorf("unexpected project %+v", p)
+	}
+
+	for path, want := range map[string]int{
+		"/v2/project/3":  http.StatusNotFound,
+		"/v2/project/x":  http.StatusBadRequest,
+		"/v2/project/-1": http.StatusBadRequest,
+	} {
+		if code := getJSON(t, s, path, &projectResp{}); code != want {
+			t.Errorf("%s: got status %d, want %d", path, code, want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+
+	"github.com/iotexproject/pebble-server/metrics"
+)
+
+const (
+	mqttQueryTopic   = "device/+/query"
+	mqttDataTopic    = "device/+/data"
+	mqttConfirmTopic = "device/+/confirm"
+	mqttQoS          = byte(1)
+	mqttTimeout      = 10 * time.Second
+)
+
+// Devices publish the same signed json requests as the http endpoints to
+// device/<device_id>/query, device/<device_id>/data and device/<device_id>/confirm. Signed query responses are
+// published back to backend/<device_id>/status and failures to backend/<device_id>/error.
+type mqttServer struct {
+	h      *httpServer
+	client mqtt.Client
+}
+
+func mqttStatusTopic(deviceID string) string {
+	return fmt.Sprintf("backend/%s/status", deviceID)
+}
+
+func mqttErrorTopic(deviceID string) string {
+	return fmt.Sprintf("backend/%s/error", deviceID)
+}
+
+// mqttDeviceID extracts the device id from a device/<device_id>/<action> topic
+func mqttDeviceID(topic string) (string, error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 3 || parts[0] != "device" || parts[1] == "" {
+		return "", errors.Errorf("invalid topic %s", topic)
+	}
+	return parts[1], nil
+}
+
+func (s *mqttServer) publish(topic string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("failed to marshal mqtt message", "error", err, "topic", topic)
+		return
+	}
+	token := s.client.Publish(topic, mqttQoS, false, data)
+	if !token.WaitTimeout(mqttTimeout) {
+		slog.Error("publish mqtt message timeout", "topic", topic)
+		return
+	}
+	if err := token.Error(); err != nil {
+		slog.Error("failed to publish mqtt message", "error", err, "topic", topic)
+	}
+}
+
+func (s *mqttServer) query(_ mqtt.Client, msg mqtt.Message) {
+	id, err := mqttDeviceID(msg.Topic())
+	if err != nil {
+		slog.Error("failed to parse mqtt topic", "error", err)
+		return
+	}
+
+	metrics.TrackRequestCount("mqtt_query")
+	now := time.Now()
+	defer func() {
+		metrics.TrackRequestDuration("mqtt_query", time.Since(now))
+	}()
+
+	req := &queryReq{}
+	if err := json.Unmarshal(msg.Payload(), req); err != nil {
+		slog.Error("failed to unmarshal mqtt request", "error", err, "device_id", id)
+		s.publish(mqttErrorTopic(id), newErrResp(errors.Wrap(err, "invalid request payload")))
+		return
+	}
+	if !strings.EqualFold(req.DeviceID, id) {
+		slog.Error("device id mismatch", "topic_device_id", id, "device_id", req.DeviceID)
+		s.publish(mqttErrorTopic(id), newErrResp(errors.New("device id mismatch")))
+		return
+	}
+	resp, err := s.h.queryDevice(req)
+	if err != nil {
+		slog.Error("failed to query device", "error", err, "device_id", id)
+		s.publish(mqttErrorTopic(id), newErrResp(err))
+		return
+	}
+	s.publish(mqttStatusTopic(id), resp)
+}
+
+func (s *mqttServer) receive(_ mqtt.Client, msg mqtt.Message) {
+	id, err := mqttDeviceID(msg.Topic())
+	if err != nil {
+		slog.Error("failed to parse mqtt topic", "error", err)
+		return
+	}
+
+	metrics.TrackRequestCount("mqtt_data")
+	now := time.Now()
+	defer func() {
+		metrics.TrackRequestDuration("mqtt_data", time.Since(now))
+	}()
+
+	req := &receiveReq{}
+	if err := json.Unmarshal(msg.Payload(), req); err != nil {
+		slog.Error("failed to unmarshal mqtt request", "error", err, "device_id", id)
+		s.publish(mqttErrorTopic(id), newErrResp(errors.Wrap(err, "invalid request payload")))
+		return
+	}
+	if !strings.EqualFold(req.DeviceID, id) {
+		slog.Error("device id mismatch", "topic_device_id", id, "device_id", req.DeviceID)
+		s.publish(mqttErrorTopic(id), newErrResp(errors.New("device id mismatch")))
+		return
+	}
+	if err := s.h.receiveData(req); err != nil {
+		slog.Error("failed to receive device data", "error", err, "device_id", id)
+		s.publish(mqttErrorTopic(id), newErrResp(err))
+	}
+}
+
+func (s *mqttServer) confirm(_ mqtt.Client, msg mqtt.Message) {
+	id, err := mqttDeviceID(msg.Topic())
+	if err != nil {
+		slog.Error("failed to parse mqtt topic", "error", err)
+		return
+	}
+
+	metrics.TrackRequestCount("mqtt_confirm")
+	now := time.Now()
+	defer func() {
+		metrics.TrackRequestDuration("mqtt_confirm", time.Since(now))
+	}()
+
+	req := &receiveReq{}
+	if err := json.Unmarshal(msg.Payload(), req); err != nil {
+		slog.Error("failed to unmarshal mqtt request", "error", err, "device_id", id)
+		s.publish(mqttErrorTopic(id), newErrResp(errors.Wrap(err, "invalid request payload")))
+		return
+	}
+	if !strings.EqualFold(req.DeviceID, id) {
+		slog.Error("device id mismatch", "topic_device_id", id, "device_id", req.DeviceID)
+		s.publish(mqttErrorTopic(id), newErrResp(errors.New("device id mismatch")))
+		return
+	}
+	if err := s.h.confirmDevice(req); err != nil {
+		slog.Error("failed to confirm device", "error", err, "device_id", id)
+		s.publish(mqttErrorTopic(id), newErrResp(err))
+	}
+}
+
+func (s *mqttServer) subscribe(c mqtt.Client) {
+	for topic, handler := range map[string]mqtt.MessageHandler{
+		mqttQueryTopic:   s.query,
+		mqttDataTopic:    s.receive,
+		mqttConfirmTopic: s.confirm,
+	} {
+		token := c.Subscribe(topic, mqttQoS, handler)
+		if !token.WaitTimeout(mqttTimeout) {
+			slog.Error("subscribe mqtt topic timeout", "topic", topic)
+			continue
+		}
+		if err := token.Error(); err != nil {
+			slog.Error("failed to subscribe mqtt topic", "error", err, "topic", topic)
+		}
+	}
+}
+
+// MqttConfig is the broker connection of the mqtt front-end
+type MqttConfig struct {
+	Broker   string
+	ClientID string
+}
+
+// runMqtt serves the device requests received from the broker with the handlers of the http server s
+func runMqtt(s *httpServer, cfg *MqttConfig) (*mqttServer, error) {
+	m := &mqttServer{h: s}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetAutoReconnect(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(m.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Error("mqtt connection lost", "error", err)
+		})
+	m.client = mqtt.NewClient(opts)
+
+	token := m.client.Connect()
+	if !token.WaitTimeout(mqttTimeout) {
+		return nil, errors.Errorf("connect mqtt broker timeout, broker %s", cfg.Broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, errors.Wrapf(err, "failed to connect mqtt broker, broker %s", cfg.Broker)
+	}
+	return m, nil
+}
@@ -0,0 +1,430 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	goproto "google.golang.org/protobuf/proto"
+
+	"github.com/iotexproject/pebble-server/db"
+	"github.com/iotexproject/pebble-server/proto"
+)
+
+type fakeToken struct{}
+
+func (fakeToken) Wait() bool                     { return true }
+func (fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (fakeToken) Done() <-chan struct{}          { c := make(chan struct{}); close(c); return c }
+func (fakeToken) Error() error                   { return nil }
+
+// fakeClient records the published messages by topic
+type fakeClient struct {
+	mqtt.Client
+	published map[string][][]byte
+}
+
+func (c *fakeClient) Publish(topic string, _ byte, _ bool, payload any) mqtt.Token {
+	c.published[topic] = append(c.published[topic], payload.([]byte))
+	return fakeToken{}
+}
+
+type fakeMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m *fakeMessage) Topic() string   { return m.topic }
+func (m *fakeMessage) Payload() []byte { return m.payload }
+
+func newTestMqttServer(t *testing.T) (*mqttServer, *fakeClient) {
+	t.Helper()
+	c := &fakeClient{published: map[string][][]byte{}}
+	return &mqttServer{h: newTestServer(t), client: c}, c
+}
+
+func newFakeMessage(t *testing.T, topic string, v any) *fakeMessage {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeMessage{topic: topic, payload: data}
+}
+
+func TestMqttQueryRoundTrip(t *testing.T) {
+	s, c := newTestMqttServer(t)
+	d := newTestDevice(t, s.h)
+
+	s.query(c, newFakeMessage(t, "device/"+d.id+"/query", d.queryReq(t)))
+	if errs := c.published[mqttErrorTopic(d.id)]; len(errs) > 0 {
+		t.Fatalf("unexpected error response %s", errs[0])
+	}
+	msgs := c.published[mqttStatusTopic(d.id)]
+	if len(msgs) != 1 {
+		t.Fatalf("expected one status response, got %d", len(msgs))
+	}
+	resp := &queryResp{}
+	if err := json.Unmarshal(msgs[0], resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != db.CONFIRM || resp.Owner != "0x0000000000000000000000000000000000000001" {
+		t.Fatalf("unexpected status response %+v", resp)
+	}
+
+	// the response is signed by the server key over the response without signature
+	sig, err := hexutil.Decode(resp.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Signature = ""
+	data, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(data)
+	pub, err := crypto.SigToPub(h[:], sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crypto.PubkeyToAddress(*pub) != crypto.PubkeyToAddress(s.h.prv.PublicKey) {
+		t.Fatal("status response is not signed by the server")
+	}
+
+	// a request published on the topic of another device is rejected
+	other := newTestDevice(t, s.h)
+	s.query(c, newFakeMessage(t, "device/"+other.id+"/query", d.queryReq(t)))
+	if len(c.published[mqttErrorTopic(other.id)]) != 1 {
+		t.Fatal("expected the mismatched device id to be rejected")
+	}
+}
+
+func TestMqttDataRoundTrip(t *testing.T) {
+	s, c := newTestMqttServer(t)
+	d := newTestDevice(t, s.h)
+
+	ts := uint32(time.Now().Unix())
+	req := d.dataReq(t, ts, &proto.SensorData{Temperature: goproto.Int32(2150)})
+	s.receive(c, newFakeMessage(t, "device/"+d.id+"/data", req))
+	if errs := c.published[mqttErrorTopic(d.id)]; len(errs) > 0 {
+		t.Fatalf("unexpected error response %s", errs[0])
+	}
+
+	rs, err := s.h.db.DeviceRecordHistory(&db.DeviceRecordHistoryQuery{
+		Imei:   d.id,
+		From:   int64(ts),
+		To:     int64(ts) + 1,
+		Fields: []string{"temperature"},
+		Limit:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 {
+		t.Fatalf("expected one device record, got %d", len(rs))
+	}
+	if v, err := strconv.ParseFloat(rs[0].Temperature, 64); err != nil || v != 21.5 {
+		t.Fatalf("unexpected temperature %s", rs[0].Temperature)
+	}
+
+	// an invalid payload is reported on the error topic
+	s.receive(c, &fakeMessage{topic: "device/" + d.id + "/data", payload: []byte("{")})
+	if len(c.published[mqttErrorTopic(d.id)]) != 1 {
+		t.Fatal("expected the invalid payload to be rejected")
+	}
+}
+
+// testBroker is a minimal mqtt 3.1.1 broker, which delivers the published messages to the matching
+// subscriptions with qos 0 and keeps no sessions
+type testBroker struct {
+	ln         net.Listener
+	mu         sync.Mutex
+	subs       map[*brokerConn][]string
+	subscribed chan string // the topic filters subscribed by the clients
+}
+
+type brokerConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (c *brokerConn) write(p packets.ControlPacket) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return p.Write(c)
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{ln: ln, subs: map[*brokerConn][]string{}, subscribed: make(chan string, 16)}
+	t.Cleanup(func() {
+		ln.Close()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for c := range b.subs {
+			c.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c := &brokerConn{Conn: conn}
+			b.mu.Lock()
+			b.subs[c] = nil
+			b.mu.Unlock()
+			go b.serve(c)
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+// topicMatches reports whether topic matches filter with the + and # wildcards
+func topicMatches(filter, topic string) bool {
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || (f != "+" && f != ts[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+func (b *testBroker) serve(c *brokerConn) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.subs, c)
+		b.mu.Unlock()
+		c.Close()
+	}()
+	for {
+		p, err := packets.ReadPacket(c)
+		if err != nil {
+			return
+		}
+		switch p := p.(type) {
+		case *packets.ConnectPacket:
+			err = c.write(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			b.mu.Lock()
+			b.subs[c] = append(b.subs[c], p.Topics...)
+			b.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = make([]byte, len(p.Topics))
+			if err = c.write(ack); err == nil {
+				for _, topic := range p.Topics {
+					b.subscribed <- topic
+				}
+			}
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				if err = c.write(ack); err != nil {
+					return
+				}
+			}
+			b.deliver(p.TopicName, p.Payload)
+		case *packets.PingreqPacket:
+			err = c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (b *testBroker) deliver(topic string, payload []byte) {
+	b.mu.Lock()
+	var to []*brokerConn
+	for c, filters := range b.subs {
+		for _, f := range filters {
+			if topicMatches(f, topic) {
+				to = append(to, c)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+	for _, c := range to {
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName, p.Payload = topic, payload
+		_ = c.write(p)
+	}
+}
+
+// waitSubscribed returns the next n topic filters subscribed at the broker
+func (b *testBroker) waitSubscribed(t *testing.T, n int) []string {
+	t.Helper()
+	var topics []string
+	for range n {
+		select {
+		case topic := <-b.subscribed:
+			topics = append(topics, topic)
+		case <-time.After(mqttTimeout):
+			t.Fatalf("got %d subscriptions, want %d", len(topics), n)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// newTestMqttClient connects a client to the broker, which receives the messages of the backend topics
+func newTestMqttClient(t *testing.T, b *testBroker) (mqtt.Client, <-chan mqtt.Message) {
+	t.Helper()
+	received := make(chan mqtt.Message, 16)
+	c := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(b.url()).SetClientID("device"))
+	if token := c.Connect(); !token.WaitTimeout(mqttTimeout) || token.Error() != nil {
+		t.Fatalf("failed to connect the device client: %v", token.Error())
+	}
+	t.Cleanup(func() { c.Disconnect(0) })
+	if token := c.Subscribe("backend/#", mqttQoS, func(_ mqtt.Client, msg mqtt.Message) {
+		received <- msg
+	}); !token.WaitTimeout(mqttTimeout) || token.Error() != nil {
+		t.Fatalf("failed to subscribe the backend topics: %v", token.Error())
+	}
+	b.waitSubscribed(t, 1)
+	return c, received
+}
+
+func TestMqttServerOverBroker(t *testing.T) {
+	b := newTestBroker(t)
+	s := newTestServer(t)
+	m, err := runMqtt(s, &MqttConfig{Broker: b.url(), ClientID: "pebble-server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.client.Disconnect(0) })
+
+	want := []string{mqttConfirmTopic, mqttDataTopic, mqttQueryTopic}
+	sort.Strings(want)
+	if got := b.waitSubscribed(t, 3); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("subscribed %v, want %v", got, want)
+	}
+
+	c, received := newTestMqttClient(t, b)
+	d := newTestDevice(t, s)
+	other := newTestDevice(t, s)
+	publish := func(topic string, v any) {
+		t.Helper()
+		payload, ok := v.([]byte)
+		if !ok {
+			var err error
+			if payload, err = json.Marshal(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if token := c.Publish(topic, mqttQoS, false, payload); !token.WaitTimeout(mqttTimeout) || token.Error() != nil {
+			t.Fatalf("failed to publish to %s: %v", topic, token.Error())
+		}
+	}
+	reply := func() mqtt.Message {
+		t.Helper()
+		select {
+		case msg := <-received:
+			return msg
+		case <-time.After(mqttTimeout):
+			t.Fatal("no reply is published")
+			return nil
+		}
+	}
+
+	// the signed status is replied on the status topic of the device
+	publish("device/"+d.id+"/query", d.queryReq(t))
+	msg := reply()
+	if msg.Topic() != mqttStatusTopic(d.id) {
+		t.Fatalf("the query is replied on %s: %s", msg.Topic(), msg.Payload())
+	}
+	resp := &queryResp{}
+	if err := json.Unmarshal(msg.Payload(), resp); err != nil {
+		t.Fatal(err)
+	}
+	verifyQueryResp(t, s, resp)
+
+	// the failures are replied on the error topic of the device of the request topic
+	for _, r := range []struct {
+		topic   string
+		payload any
+	}{
+		{"device/" + other.id + "/query", d.queryReq(t)},
+		{"device/" + other.id + "/data", []byte("{")},
+		{"device/" + other.id + "/confirm", []byte("{")},
+	} {
+		publish(r.topic, r.payload)
+		if msg := reply(); msg.Topic() != mqttErrorTopic(other.id) {
+			t.Errorf("%s: the failure is replied on %s", r.topic, msg.Topic())
+		}
+	}
+
+	// the data is stored without a reply
+	ts := uint32(time.Now().Unix())
+	publish("device/"+d.id+"/data", d.dataReq(t, ts, &proto.SensorData{Temperature: goproto.Int32(2150)}))
+	deadline := time.Now().Add(mqttTimeout)
+	for {
+		rs, err := s.db.DeviceRecordHistory(&db.DeviceRecordHistoryQuery{
+			Imei: d.id, From: int64(ts), To: int64(ts) + 1, Fields: []string{"temperature"}, Limit: 10,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the published data is not stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected reply on %s: %s", msg.Topic(), msg.Payload())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRunFailsIfTheBrokerIsUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := newTestServer(t)
+	err = Run(s.db, &Config{
+		Address:    "127.0.0.1:0",
+		PrivateKey: s.prv,
+		ClockSkew:  s.clockSkew,
+		Mqtt:       &MqttConfig{Broker: "tcp://" + addr, ClientID: "pebble-server"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "failed to run mqtt server") || !strings.Contains(err.Error(), addr) {
+		t.Fatalf("expected the unreachable broker to fail the server, got %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/iotexproject/pebble-server/db"
+)
+
+const (
+	signatureEIP191 = "eip191"
+	signatureEIP712 = "eip712"
+)
+
+// ownerAuth is embedded in the requests signed by device owners. The signed payload is the json of
+// the request with an empty signature. It is signed together with the action, the target the action
+// applies to and the nonce, with personal_sign (EIP-191) by default, or as an OwnerRequest typed data
+// (EIP-712). A nonce can only be used once by a signer. GET requests carry the fields as query parameters.
+type ownerAuth struct {
+	Timestamp     int64  `json:"timestamp"                  form:"timestamp"     binding:"required"`
+	Nonce         string `json:"nonce"                      form:"nonce"         binding:"required,max=64"`
+	SignatureType string `json:"signatureType,omitempty"    form:"signatureType"`
+	Signature     string `json:"signature,omitempty"        form:"signature"     binding:"required"`
+}
+
+var ownerRequestTypes = apitypes.Types{
+	"EIP712Domain": {
+		{Name: "name", Type: "string"},
+		{Name: "version", Type: "string"},
+	},
+	"OwnerRequest": {
+		{Name: "action", Type: "string"},
+		{Name: "target", Type: "string"},
+		{Name: "nonce", Type: "string"},
+		{Name: "payload", Type: "string"},
+		{Name: "timestamp", Type: "uint64"},
+	},
+}
+
+var ownerRequestDomain = apitypes.TypedDataDomain{
+	Name:    "pebble-server",
+	Version: "1",
+}
+
+// ownerRequestText returns the message signed with personal_sign:
+// "<domain>\naction: <action>\ntarget: <target>\nnonce: <nonce>\ntimestamp: <timestamp>\npayload: <payload>"
+func ownerRequestText(action, target string, auth *ownerAuth, payload []byte) []byte {
+	return []byte(fmt.Sprintf("%s\naction: %s\ntarget: %s\nnonce: %s\ntimestamp: %d\npayload: %s",
+		ownerRequestDomain.Name, action, target, auth.Nonce, auth.Timestamp, payload))
+}
+
+// ownerRequestHash returns the digest signed by the owner for action on target
+func ownerRequestHash(action, target string, auth *ownerAuth, payload []byte) ([]byte, error) {
+	switch auth.SignatureType {
+	case "", signatureEIP191:
+		return accounts.TextHash(ownerRequestText(action, target, auth, payload)), nil
+	case signatureEIP712:
+		h, _, err := apitypes.TypedDataAndHash(apitypes.TypedData{
+			Types:       ownerRequestTypes,
+			PrimaryType: "OwnerRequest",
+			Domain:      ownerRequestDomain,
+			Message: apitypes.TypedDataMessage{
+				"action":    action,
+				"target":    target,
+				"nonce":     auth.Nonce,
+				"payload":   string(payload),
+				"timestamp": strconv.FormatInt(auth.Timestamp, 10),
+			},
+		})
+		return h, errors.Wrap(err, "failed to hash typed data")
+	default:
+		return nil, errors.Errorf("unsupported signature type %s", auth.SignatureType)
+	}
+}
+
+// verifyOwner checks that req, which embeds auth, is signed by owner for action on target,
+// its timestamp is within the clock skew and its nonce has not been used
+func (s *httpServer) verifyOwner(owner common.Address, action, target string, auth *ownerAuth, req any) error {
+	signer, err := s.recoverSigner(action, target, auth, req)
+	if err != nil {
+		return err
+	}
+	if signer != owner {
+		return errors.Errorf("request is not signed by the owner, signer %s", signer)
+	}
+	return nil
+}
+
+// recoverSigner returns the signer of req, which embeds auth, signed for action on target,
+// the timestamp of auth must be within the clock skew and the nonce is consumed for the signer
+func (s *httpServer) recoverSigner(action, target string, auth *ownerAuth, req any) (common.Address, error) {
+	if diff := time.Since(time.Unix(auth.Timestamp, 0)); diff > s.clockSkew || diff < -s.clockSkew {
+		return common.Address{}, errors.Errorf("request timestamp %d is beyond allowed clock skew %s", auth.Timestamp, s.clockSkew)
+	}
+	sigStr := auth.Signature
+	auth.Signature = ""
+	payload, err := json.Marshal(req)
+	auth.Signature = sigStr
+	if err != nil {
+		return common.Address{}, errors.Wrap(err, "failed to marshal request into json format")
+	}
+	h, err := ownerRequestHash(action, target, auth, payload)
+	if err != nil {
+		return common.Address{}, err
+	}
+	sig, err := hexutil.Decode(sigStr)
+	if err != nil {
+		return common.Address{}, errors.Wrapf(err, "failed to decode signature from hex format, signature %s", sigStr)
+	}
+	if len(sig) != crypto.SignatureLength {
+		return common.Address{}, errors.Errorf("invalid signature length %d", len(sig))
+	}
+	// wallets produce the recovery id as 27 or 28
+	sig = append([]byte{}, sig...)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	signer, err := s.recover(sig, h)
+	if err != nil {
+		return common.Address{}, err
+	}
+	// requests beyond the clock skew are rejected, so their nonces can be pruned
+	ok, err := s.db.UseOwnerNonce(signer, auth.Nonce, time.Now().Add(-2*s.clockSkew))
+	if err != nil {
+		return common.Address{}, err
+	}
+	if !ok {
+		return common.Address{}, errors.Errorf("nonce %s has been used", auth.Nonce)
+	}
+	return signer, nil
+}
+
+type updateDeviceReq struct {
+	Name         *string `json:"name,omitempty"`
+	Avatar       *string `json:"avatar,omitempty"`
+	Configurable *bool   `json:"configurable,omitempty"`
+	ownerAuth
+}
+
+type listDevicesReq struct {
+	Owner string `json:"owner"                      binding:"required"`
+	ownerAuth
+}
+
+type deviceResp struct {
+	ID           string    `json:"id"`
+	ProjectID    uint64    `json:"projectID"`
+	Name         string    `json:"name"`
+	Avatar       string    `json:"avatar"`
+	Owner        string    `json:"owner"`
+	Proposer     string    `json:"proposer,omitempty"`
+	Status       int32     `json:"status"`
+	Firmware     string    `json:"firmware"`
+	Configurable bool      `json:"configurable"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+type listDevicesResp struct {
+	Devices []*deviceResp `json:"devices"`
+}
+
+func newDeviceResp(d *db.Device) *deviceResp {
+	return &deviceResp{
+		ID:           d.ID,
+		ProjectID:    d.ProjectID,
+		Name:         d.Name,
+		Avatar:       d.Avatar,
+		Owner:        d.Owner,
+		Proposer:     d.Proposer,
+		Status:       d.Status,
+		Firmware:     d.RealFirmware,
+		Configurable: d.Configurable && !d.ConfigDisabled,
+		UpdatedAt:    d.UpdatedAt,
+	}
+}
+
+const maxDeviceNameLength = 64
+
+func (s *httpServer) updateDevice(c *gin.Context) {
+	req := &updateDeviceReq{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		slog.Error("failed to bind request", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid request payload")))
+		return
+	}
+	id := c.Param("id")
+	d, err := s.db.Device(id)
+	if err != nil {
+		slog.Error("failed to query device", "error", err, "device_id", id)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to query device")))
+		return
+	}
+	if err := checkDevice(d); err != nil {
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+	if err := s.verifyOwner(common.HexToAddress(d.Owner), "update_device", d.ID, &req.ownerAuth, req); err != nil {
+		slog.Error("failed to verify owner signature", "error", err, "device_id", id)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to verify owner signature")))
+		return
+	}
+
+	values := map[string]any{"updated_at": time.Now()}
+	if req.Name != nil {
+		if *req.Name == "" || len(*req.Name) > maxDeviceNameLength {
+			c.JSON(http.StatusBadRequest, newErrResp(errors.Errorf("invalid name, should be 1 to %d bytes", maxDeviceNameLength)))
+			return
+		}
+		values["name"] = *req.Name
+		d.Name = *req.Name
+	}
+	if req.Avatar != nil {
+		values["avatar"] = *req.Avatar
+		d.Avatar = *req.Avatar
+	}
+	if req.Configurable != nil {
+		values["config_disabled"] = !*req.Configurable
+		d.ConfigDisabled = !*req.Configurable
+		// a pending config is dropped once the owner disables config downlink
+		if d.ConfigDisabled {
+			values["config"] = ""
+		}
+	}
+	if err := s.db.UpdateByID(d.ID, values); err != nil {
+		slog.Error("failed to update device", "error", err, "device_id", id)
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+	c.JSON(http.StatusOK, newDeviceResp(d))
+}
+
+func (s *httpServer) listDevices(c *gin.Context) {
+	req := &listDevicesReq{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		slog.Error("failed to bind request", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid request payload")))
+		return
+	}
+	if !common.IsHexAddress(req.Owner) {
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Errorf("invalid owner address %s", req.Owner)))
+		return
+	}
+	owner := common.HexToAddress(req.Owner)
+	if err := s.verifyOwner(owner, "list_devices", owner.String(), &req.ownerAuth, req); err != nil {
+		slog.Error("failed to verify owner signature", "error", err, "owner", req.Owner)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to verify owner signature")))
+		return
+	}
+
+	ds, err := s.db.DevicesOfOwner(owner)
+	if err != nil {
+		slog.Error("failed to query devices of owner", "error", err, "owner", req.Owner)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to query devices")))
+		return
+	}
+	resp := &listDevicesResp{Devices: make([]*deviceResp, 0, len(ds))}
+	for _, d := range ds {
+		resp.Devices = append(resp.Devices, newDeviceResp(d))
+	}
+	c.JSON(http.StatusOK, resp)
+}
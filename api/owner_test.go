@@ -0,0 +1,70 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var testNonce int
+
+// signOwner signs req, which embeds auth, with key for action on target with a new nonce
+func signOwner(t *testing.T, key *ecdsa.PrivateKey, action, target string, auth *ownerAuth, req any) {
+	t.Helper()
+	testNonce++
+	auth.Timestamp = time.Now().Unix()
+	auth.Nonce = fmt.Sprintf("nonce-%d", testNonce)
+	auth.Signature = ""
+	payload, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ownerRequestHash(action, target, auth, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := crypto.Sign(h, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Signature = hexutil.Encode(sig)
+}
+
+func TestOwnerRequestText(t *testing.T) {
+	auth := &ownerAuth{Timestamp: 1700000000, Nonce: "n1"}
+	got := string(ownerRequestText("update_device", "did:io:0xabc", auth, []byte(`{"name":"kitchen"}`)))
+	want := "pebble-server\naction: update_device\ntarget: did:io:0xabc\nnonce: n1\ntimestamp: 1700000000\n" +
+		`payload: {"name":"kitchen"}`
+	if got != want {
+		t.Errorf("unexpected owner request text\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestOwnerRequestHashBindsActionTargetAndNonce(t *testing.T) {
+	payload := []byte(`{"name":"kitchen"}`)
+	for _, typ := range []string{signatureEIP191, signatureEIP712} {
+		hash := func(action, target, nonce string) []byte {
+			h, err := ownerRequestHash(action, target, &ownerAuth{Timestamp: 1700000000, Nonce: nonce, SignatureType: typ}, payload)
+			if err != nil {
+				t.Fatalf("%s: %v", typ, err)
+			}
+			return h
+		}
+		h := hash("update_device", "did:io:0xabc", "n1")
+		for name, other := range map[string][]byte{
+			"action": hash("set_config", "did:io:0xabc", "n1"),
+			"target": hash("update_device", "did:io:0xdef", "n1"),
+			"nonce":  hash("update_device", "did:io:0xabc", "n2"),
+		} {
+			if bytes.Equal(h, other) {
+				t.Errorf("%s: the signed digest does not cover the %s", typ, name)
+			}
+		}
+	}
+}
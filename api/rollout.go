@@ -0,0 +1,501 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/iotexproject/pebble-server/db"
+)
+
+const (
+	defaultRolloutMaxFailureRate    = 0.2
+	defaultRolloutMaxRegressionRate = 0.1
+	defaultRolloutMinSamples        = 10
+	defaultRolloutGracePeriod       = int64(time.Hour / time.Second)
+	rolloutCheckInterval            = time.Minute
+)
+
+// Rollouts are managed by the owner or an operator of the project, the requests are signed the same way as
+// the device owner requests.
+
+type createRolloutReq struct {
+	ProjectID         uint64   `json:"projectID"                  binding:"required"`
+	Firmware          string   `json:"firmware"                   binding:"required"`
+	Version           string   `json:"version,omitempty"`
+	URI               string   `json:"uri,omitempty"`
+	Hash              string   `json:"hash,omitempty"`
+	Size              uint64   `json:"size,omitempty"`
+	MinVersion        string   `json:"minVersion,omitempty"`
+	BaseVersion       string   `json:"baseVersion,omitempty"`
+	BaseURI           string   `json:"baseUri,omitempty"`
+	BaseHash          string   `json:"baseHash,omitempty"`
+	BaseSize          uint64   `json:"baseSize,omitempty"`
+	Percentage        uint32   `json:"percentage"`
+	AllowList         []string `json:"allowList,omitempty"`
+	MaxFailureRate    float64  `json:"maxFailureRate,omitempty"`
+	MaxRegressionRate float64  `json:"maxRegressionRate,omitempty"`
+	MinSamples        uint32   `json:"minSamples,omitempty"`
+	GracePeriod       int64    `json:"gracePeriod,omitempty"`
+	ownerAuth
+}
+
+type listRolloutsReq struct {
+	ownerAuth
+}
+
+type updateRolloutReq struct {
+	Percentage *uint32  `json:"percentage,omitempty"`
+	AllowList  []string `json:"allowList,omitempty"`
+	Status     string   `json:"status,omitempty"`
+	ownerAuth
+}
+
+type rolloutResp struct {
+	ID                uint64           `json:"id"`
+	ProjectID         uint64           `json:"projectID"`
+	Firmware          string           `json:"firmware"`
+	Version           string           `json:"version"`
+	URI               string           `json:"uri"`
+	Hash              string           `json:"hash"`
+	Size              uint64           `json:"size"`
+	MinVersion        string           `json:"minVersion"`
+	BaseVersion       string           `json:"baseVersion"`
+	BaseURI           string           `json:"baseUri"`
+	BaseHash          string           `json:"baseHash"`
+	BaseSize          uint64           `json:"baseSize"`
+	Percentage        uint32           `json:"percentage"`
+	AllowList         []string         `json:"allowList"`
+	Status            string           `json:"status"`
+	PauseReason       string           `json:"pauseReason,omitempty"`
+	MaxFailureRate    float64          `json:"maxFailureRate"`
+	MaxRegressionRate float64          `json:"maxRegressionRate"`
+	MinSamples        uint32           `json:"minSamples"`
+	GracePeriod       int64            `json:"gracePeriod"`
+	Devices           map[string]int64 `json:"devices,omitempty"`
+	CreatedAt         time.Time        `json:"createdAt"`
+	UpdatedAt         time.Time        `json:"updatedAt"`
+}
+
+type rolloutsResp struct {
+	Rollouts []*rolloutResp `json:"rollouts"`
+	Offset   int            `json:"offset"`
+	Limit    int            `json:"limit"`
+}
+
+func newRolloutResp(r *db.Rollout) *rolloutResp {
+	resp := &rolloutResp{
+		ID:                r.ID,
+		ProjectID:         r.ProjectID,
+		Firmware:          r.Firmware,
+		Version:           r.Version,
+		URI:               r.Uri,
+		Hash:              r.Hash,
+		Size:              r.Size,
+		MinVersion:        r.MinVersion,
+		BaseVersion:       r.BaseVersion,
+		BaseURI:           r.BaseUri,
+		BaseHash:          r.BaseHash,
+		BaseSize:          r.BaseSize,
+		Percentage:        r.Percentage,
+		AllowList:         r.AllowList,
+		Status:            r.Status,
+		PauseReason:       r.PauseReason,
+		MaxFailureRate:    r.MaxFailureRate,
+		MaxRegressionRate: r.MaxRegressionRate,
+		MinSamples:        r.MinSamples,
+		GracePeriod:       r.GracePeriod,
+		CreatedAt:         r.CreatedAt,
+		UpdatedAt:         r.UpdatedAt,
+	}
+	if resp.AllowList == nil {
+		resp.AllowList = []string{}
+	}
+	return resp
+}
+
+func normalizeAllowList(ids []string) []string {
+	res := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id = strings.ToLower(id); !slices.Contains(res, id) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// verifyProjectAdmin checks that req, which embeds auth, is signed for action on target by the owner or
+// an operator of the project
+func (s *httpServer) verifyProjectAdmin(projectID uint64, action, target string, auth *ownerAuth, req any) error {
+	signer, err := s.recoverSigner(action, target, auth, req)
+	if err != nil {
+		return err
+	}
+	p, err := s.db.Project(projectID)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return errors.Errorf("project %d has not been indexed", projectID)
+	}
+	if signer != common.HexToAddress(p.Owner) && !slices.Contains(p.Operators, signer.String()) {
+		return errors.Errorf("request is not signed by the owner or an operator of project %d, signer %s", projectID, signer)
+	}
+	return nil
+}
+
+func (s *httpServer) createRollout(c *gin.Context) {
+	req := &createRolloutReq{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		slog.Error("failed to bind request", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid request payload")))
+		return
+	}
+	if req.Percentage > 100 {
+		c.JSON(http.StatusBadRequest, newErrResp(errors.New("invalid percentage, should be in range [0, 100]")))
+		return
+	}
+	hash, err := db.NormalizeFirmwareHash(req.Hash)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+	baseHash, err := db.NormalizeFirmwareHash(req.BaseHash)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+	if err := s.verifyProjectAdmin(req.ProjectID, "create_rollout", strconv.FormatUint(req.ProjectID, 10), &req.ownerAuth, req); err != nil {
+		slog.Error("failed to verify project admin signature", "error", err, "project_id", req.ProjectID)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to verify project admin signature")))
+		return
+	}
+
+	r := &db.Rollout{
+		ProjectID:         req.ProjectID,
+		Firmware:          req.Firmware,
+		Version:           req.Version,
+		Uri:               req.URI,
+		Hash:              hash,
+		Size:              req.Size,
+		MinVersion:        req.MinVersion,
+		BaseVersion:       req.BaseVersion,
+		BaseUri:           req.BaseURI,
+		BaseHash:          baseHash,
+		BaseSize:          req.BaseSize,
+		Percentage:        req.Percentage,
+		AllowList:         normalizeAllowList(req.AllowList),
+		Status:            db.RolloutActive,
+		MaxFailureRate:    req.MaxFailureRate,
+		MaxRegressionRate: req.MaxRegressionRate,
+		MinSamples:        req.MinSamples,
+		GracePeriod:       req.GracePeriod,
+		OperationTimes:    db.NewOperationTimes(),
+	}
+	// the firmware published in the project metadata is rolled out by default
+	app, err := s.db.App(req.ProjectID, req.Firmware)
+	if err != nil {
+		slog.Error("failed to query app", "error", err, "project_id", req.ProjectID, "app_id", req.Firmware)
+		c.JSON(http.StatusInternalServerError, newErrResp(errors.Wrap(err, "failed to query app")))
+		return
+	}
+	if r.Version == "" {
+		if app == nil {
+			c.JSON(http.StatusBadRequest, newErrResp(errors.Errorf("firmware %s has not been published", req.Firmware)))
+			return
+		}
+		r.Version, r.Uri = app.Version, app.Uri
+	}
+	if app != nil && r.Version == app.Version && r.Uri == app.Uri && r.Hash == "" {
+		r.Hash, r.Size, r.MinVersion = app.Hash, app.Size, app.MinVersion
+	}
+	if r.MaxFailureRate == 0 {
+		r.MaxFailureRate = defaultRolloutMaxFailureRate
+	}
+	if r.MaxRegressionRate == 0 {
+		r.MaxRegressionRate = defaultRolloutMaxRegressionRate
+	}
+	if r.MinSamples == 0 {
+		r.MinSamples = defaultRolloutMinSamples
+	}
+	if r.GracePeriod == 0 {
+		r.GracePeriod = defaultRolloutGracePeriod
+	}
+
+	if err := s.db.CreateRollout(r); err != nil {
+		slog.Error("failed to create rollout", "error", err, "project_id", req.ProjectID, "firmware", req.Firmware)
+		var conflictErr *db.RolloutConflictError
+		if errors.As(err, &conflictErr) {
+			c.JSON(http.StatusBadRequest, newErrResp(err))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, newErrResp(err))
+		return
+	}
+	c.JSON(http.StatusOK, newRolloutResp(r))
+}
+
+func (s *httpServer) updateRollout(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid rollout id")))
+		return
+	}
+	req := &updateRolloutReq{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		slog.Error("failed to bind request", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid request payload")))
+		return
+	}
+	if req.Percentage != nil && *req.Percentage > 100 {
+		c.JSON(http.StatusBadRequest, newErrResp(errors.New("invalid percentage, should be in range [0, 100]")))
+		return
+	}
+	switch req.Status {
+	case "", db.RolloutActive, db.RolloutPaused, db.RolloutCompleted, db.RolloutAborted:
+	default:
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Errorf("invalid status %s", req.Status)))
+		return
+	}
+
+	r, err := s.db.Rollout(id)
+	if err != nil {
+		slog.Error("failed to query rollout", "error", err, "rollout_id", id)
+		c.JSON(http.StatusInternalServerError, newErrResp(errors.Wrap(err, "failed to query rollout")))
+		return
+	}
+	if r == nil {
+		c.JSON(http.StatusNotFound, newErrResp(errors.Errorf("rollout %d not found", id)))
+		return
+	}
+	if err := s.verifyProjectAdmin(r.ProjectID, "update_rollout", strconv.FormatUint(id, 10), &req.ownerAuth, req); err != nil {
+		slog.Error("failed to verify project admin signature", "error", err, "rollout_id", id)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to verify project admin signature")))
+		return
+	}
+
+	var closedErr error
+	r, err = s.db.UpdateRollout(id, func(r *db.Rollout) error {
+		if !r.Open() {
+			closedErr = errors.Errorf("rollout %d has been %s", r.ID, r.Status)
+			return closedErr
+		}
+		if req.Percentage != nil {
+			r.Percentage = *req.Percentage
+		}
+		if req.AllowList != nil {
+			r.AllowList = normalizeAllowList(req.AllowList)
+		}
+		if req.Status != "" && req.Status != r.Status {
+			r.Status = req.Status
+			// a resumed rollout is paused again only by new failures
+			if req.Status == db.RolloutActive {
+				r.PauseReason = ""
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed to update rollout", "error", err, "rollout_id", id)
+		if closedErr != nil {
+			c.JSON(http.StatusBadRequest, newErrResp(closedErr))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, newErrResp(err))
+		return
+	}
+	c.JSON(http.StatusOK, newRolloutResp(r))
+}
+
+// queryRollouts lists the rollouts of the project to its owner and operators, the owner auth is given
+// as query parameters
+func (s *httpServer) queryRollouts(c *gin.Context) {
+	projectID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid project id")))
+		return
+	}
+	offset, limit, err := parsePagination(c)
+	if err != nil {
+		slog.Error("failed to parse pagination", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(err))
+		return
+	}
+	req := &listRolloutsReq{}
+	if err := c.ShouldBindQuery(req); err != nil {
+		slog.Error("failed to bind request", "error", err)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid request payload")))
+		return
+	}
+	target := strconv.FormatUint(projectID, 10)
+	if err := s.verifyProjectAdmin(projectID, "list_rollouts", target, &req.ownerAuth, req); err != nil {
+		slog.Error("failed to verify project admin signature", "error", err, "project_id", projectID)
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "failed to verify project admin signature")))
+		return
+	}
+
+	rs, err := s.db.Rollouts(projectID, offset, limit)
+	if err != nil {
+		slog.Error("failed to query rollouts", "error", err, "project_id", projectID)
+		c.JSON(http.StatusInternalServerError, newErrResp(errors.Wrap(err, "failed to query rollouts")))
+		return
+	}
+	resp := &rolloutsResp{
+		Rollouts: make([]*rolloutResp, 0, len(rs)),
+		Offset:   offset,
+		Limit:    limit,
+	}
+	for _, r := range rs {
+		resp.Rollouts = append(resp.Rollouts, newRolloutResp(r))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *httpServer) queryRollout(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, newErrResp(errors.Wrap(err, "invalid rollout id")))
+		return
+	}
+	r, err := s.db.Rollout(id)
+	if err != nil {
+		slog.Error("failed to query rollout", "error", err, "rollout_id", id)
+		c.JSON(http.StatusInternalServerError, newErrResp(errors.Wrap(err, "failed to query rollout")))
+		return
+	}
+	if r == nil {
+		c.JSON(http.StatusNotFound, newErrResp(errors.Errorf("rollout %d not found", id)))
+		return
+	}
+	stats, err := s.db.RolloutStats(r)
+	if err != nil {
+		slog.Error("failed to query rollout stats", "error", err, "rollout_id", id)
+		c.JSON(http.StatusInternalServerError, newErrResp(err))
+		return
+	}
+	resp := newRolloutResp(r)
+	resp.Devices = stats
+	c.JSON(http.StatusOK, resp)
+}
+
+// parseFirmware splits the firmware reported by the device into the app id and version
+func parseFirmware(realFirmware string) (id, version string, ok bool) {
+	parts := strings.Split(realFirmware, " ")
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// resolveFirmware returns the firmware served to the device, or nil if there is none. An open rollout of the
+// device firmware serves its version to the devices of the cohort and the base version to the others. If the
+// firmware has no open rollout, the version of its last completed rollout is served until the project app is
+// published again, otherwise the project app is served.
+func (s *httpServer) resolveFirmware(d *db.Device) (*firmwareManifest, error) {
+	id, current, ok := parseFirmware(d.RealFirmware)
+	if !ok {
+		return nil, nil
+	}
+	r, err := s.db.OpenRollout(d.ProjectID, id)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		app, err := s.db.App(d.ProjectID, id)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to query app, app_id %s", id)
+		}
+		completed, err := s.db.CompletedRollout(d.ProjectID, id)
+		if err != nil {
+			return nil, err
+		}
+		if completed != nil && (app == nil || completed.UpdatedAt.After(app.UpdatedAt)) {
+			return &firmwareManifest{
+				Firmware:   completed.Firmware,
+				URI:        completed.Uri,
+				Version:    completed.Version,
+				Hash:       completed.Hash,
+				Size:       completed.Size,
+				MinVersion: completed.MinVersion,
+			}, nil
+		}
+		if app == nil {
+			return nil, nil
+		}
+		return &firmwareManifest{
+			Firmware:   app.ID,
+			URI:        app.Uri,
+			Version:    app.Version,
+			Hash:       app.Hash,
+			Size:       app.Size,
+			MinVersion: app.MinVersion,
+		}, nil
+	}
+
+	target := &firmwareManifest{
+		Firmware:   r.Firmware,
+		URI:        r.Uri,
+		Version:    r.Version,
+		Hash:       r.Hash,
+		Size:       r.Size,
+		MinVersion: r.MinVersion,
+	}
+	switch {
+	case r.Status == db.RolloutActive && r.InCohort(d.ID):
+		target.rollout = r
+		return target, nil
+	case current == r.Version:
+		// devices already updated are not rolled back when the rollout pauses or shrinks
+		return target, nil
+	case r.BaseVersion != "":
+		return &firmwareManifest{
+			Firmware: r.Firmware,
+			URI:      r.BaseUri,
+			Version:  r.BaseVersion,
+			Hash:     r.BaseHash,
+			Size:     r.BaseSize,
+		}, nil
+	}
+	return nil, nil
+}
+
+// serveRollout records the device has been served the firmware of the rollout of its cohort
+func (s *httpServer) serveRollout(d *db.Device, m *firmwareManifest) error {
+	if m.rollout == nil {
+		return nil
+	}
+	_, current, _ := parseFirmware(d.RealFirmware)
+	return s.db.ServeRollout(m.rollout.ID, d.ID, current)
+}
+
+// checkRollouts periodically pauses the active rollouts whose devices failed to report the rollout version
+func (s *httpServer) checkRollouts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.db.PauseUnhealthyRollouts(); err != nil {
+			slog.Error("failed to check rollouts", "error", err)
+		}
+	}
+}
+
+// trackRollout records the firmware version reported by the device for the open rollout of its firmware
+func (s *httpServer) trackRollout(d *db.Device, realFirmware string) error {
+	id, version, ok := parseFirmware(realFirmware)
+	if !ok {
+		return nil
+	}
+	r, err := s.db.OpenRollout(d.ProjectID, id)
+	if err != nil || r == nil {
+		return err
+	}
+	return s.db.ReportRolloutVersion(r, d.ID, version)
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gin-gonic/gin"
+
+	"github.com/iotexproject/pebble-server/db"
+)
+
+// listRolloutsQuery returns the query parameters of a rollout listing of the project signed by key
+func listRolloutsQuery(t *testing.T, key *ecdsa.PrivateKey, projectID string) url.Values {
+	t.Helper()
+	req := &listRolloutsReq{}
+	signOwner(t, key, "list_rollouts", projectID, &req.ownerAuth, req)
+	return url.Values{
+		"timestamp": {strconv.FormatInt(req.Timestamp, 10)},
+		"nonce":     {req.Nonce},
+		"signature": {req.Signature},
+		"limit":     {"10"},
+	}
+}
+
+func TestQueryRolloutsAuthenticatesQueryParameters(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := newTestServer(t)
+	s.engine = gin.New()
+	s.engine.GET("/v2/project/:id/rollouts", s.queryRollouts)
+
+	owner, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.UpdateProject(10, 1, func(p *db.Project) {
+		p.Owner = crypto.PubkeyToAddress(owner.PublicKey).Hex()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, firmware := range []string{"pebble", "riverrock"} {
+		if err := s.db.CreateRollout(&db.Rollout{ProjectID: 1, Firmware: firmware, Version: "2.0",
+			Status: db.RolloutActive, OperationTimes: db.NewOperationTimes()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(q url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v2/project/1/rollouts?"+q.Encode(), nil))
+		return w
+	}
+
+	w := get(listRolloutsQuery(t, owner, "1"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	resp := &rolloutsResp{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rollouts) != 2 || resp.Rollouts[0].Firmware != "riverrock" || resp.Limit != 10 {
+		t.Fatalf("unexpected rollouts %+v", resp)
+	}
+
+	replayed := listRolloutsQuery(t, owner, "1")
+	get(replayed)
+	missing := listRolloutsQuery(t, owner, "1")
+	missing.Del("signature")
+	for name, q := range map[string]url.Values{
+		"another signer":    listRolloutsQuery(t, other, "1"),
+		"another project":   listRolloutsQuery(t, owner, "2"),
+		"replayed nonce":    replayed,
+		"missing signature": missing,
+	} {
+		if w := get(q); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/iotexproject/pebble-server/cmd/server/config"
+	"github.com/iotexproject/pebble-server/db"
+)
+
+// migrate copies the legacy device records from OLD_DATABASE_DSN into DATABASE_DSN and verifies the copy.
+// It is safe to rerun, an interrupted migration resumes from its last committed batch.
+func main() {
+	batchSize := flag.Int("batch-size", 1000, "number of rows copied in one transaction")
+	verifyOnly := flag.Bool("verify-only", false, "only verify the migrated rows without copying")
+	flag.Parse()
+
+	cfg, err := config.Get()
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "failed to get config"))
+	}
+	cfg.Print()
+
+	db, err := db.New(cfg.DatabaseDSN, cfg.OldDatabaseDSN)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "failed to new db"))
+	}
+
+	if !*verifyOnly {
+		if err := db.MigrateLegacyDeviceRecords(*batchSize); err != nil {
+			log.Fatal(errors.Wrap(err, "failed to migrate legacy device records"))
+		}
+	}
+
+	reports, err := db.VerifyLegacyMigration(*batchSize)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "failed to verify legacy migration"))
+	}
+	ok := true
+	for _, r := range reports {
+		fmt.Printf("%s: legacy %d, migrated %d, missing %d, mismatched %d\n",
+			r.Table, r.LegacyRows, r.MigratedRows, r.MissingRows, r.MismatchedRows)
+		ok = ok && r.OK()
+	}
+	if !ok {
+		fmt.Println("legacy migration verification failed")
+		os.Exit(1)
+	}
+	fmt.Println("legacy migration verified, device records are no longer read from OLD_DATABASE_DSN")
+}
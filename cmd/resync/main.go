@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/pkg/errors"
+
+	"github.com/iotexproject/pebble-server/cmd/server/config"
+	"github.com/iotexproject/pebble-server/contract/ioid"
+	"github.com/iotexproject/pebble-server/db"
+	"github.com/iotexproject/pebble-server/monitor"
+)
+
+var errDryRun = errors.New("dry run")
+
+// resync processes the contract events of a block range again and prints what changed in the db.
+// It reads the same environment as the server and can run while the server is running.
+func main() {
+	from := flag.Uint64("from", 0, "first block to resync")
+	to := flag.Uint64("to", 0, "last block to resync, defaults to the scanned block number")
+	rebuildOwners := flag.Bool("rebuild-owners", false, "rebuild device owners from the ioID contract after resync")
+	dryRun := flag.Bool("dry-run", false, "print the changes without committing them")
+	flag.Parse()
+
+	cfg, err := config.Get()
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "failed to get config"))
+	}
+	projects, err := cfg.Projects()
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "failed to parse project configs"))
+	}
+
+	d, err := db.New(cfg.DatabaseDSN, cfg.OldDatabaseDSN)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "failed to new db"))
+	}
+	projectIDs := make([]uint64, 0, len(projects))
+	for _, p := range projects {
+		projectIDs = append(projectIDs, p.ID)
+		d.RegisterMetadataDecoder(p.ID, crypto.Keccak256Hash([]byte(p.FirmwareKey)), db.FirmwareDecoder)
+		d.RegisterMetadataDecoder(p.ID, crypto.Keccak256Hash([]byte(p.AppKey)), db.AppV2Decoder)
+	}
+	if *to == 0 {
+		if *to, err = d.ScannedBlockNumber(); err != nil {
+			log.Fatal(errors.Wrap(err, "failed to query scanned block number"))
+		}
+	}
+	if *from == 0 || *from > *to {
+		log.Fatalf("invalid block range [%d, %d]", *from, *to)
+	}
+
+	client, err := ethclient.Dial(cfg.ChainEndpoint)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "failed to dial chain endpoint"))
+	}
+	if err := resync(os.Stdout, d, client, &options{
+		from:           *from,
+		to:             *to,
+		rebuildOwners:  *rebuildOwners,
+		dryRun:         *dryRun,
+		defaultProject: cfg.IoIDProjectID,
+		projectIDs:     projectIDs,
+		addr: &monitor.ContractAddr{
+			Project:      common.HexToAddress(cfg.ProjectContractAddr),
+			IoID:         common.HexToAddress(cfg.IoIDContractAddr),
+			IoIDRegistry: common.HexToAddress(cfg.IoIDRegistryContractAddr),
+		},
+	}); err != nil {
+		log.Fatal(errors.Wrap(err, "failed to resync"))
+	}
+}
+
+type options struct {
+	from, to       uint64
+	rebuildOwners  bool
+	dryRun         bool
+	defaultProject uint64 // the project of the rows indexed before rows were scoped by project
+	projectIDs     []uint64
+	addr           *monitor.ContractAddr
+}
+
+// resync processes the contract events of blocks [o.from, o.to] again and writes the rows it changed to w,
+// nothing is committed with a dry run
+func resync(w io.Writer, d *db.DB, client *ethclient.Client, o *options) error {
+	before, err := d.IndexSnapshot()
+	if err != nil {
+		return errors.Wrap(err, "failed to snapshot db")
+	}
+
+	var after *db.IndexSnapshot
+	run := func(d *db.DB) error {
+		if err := d.AssignDefaultProject(o.defaultProject); err != nil {
+			return err
+		}
+		if err := monitor.Resync(monitor.NewHandler(d), o.addr, o.projectIDs, client, o.from, o.to); err != nil {
+			return err
+		}
+		if o.rebuildOwners {
+			if err := rebuild(d, client, o.addr.IoID, o.projectIDs, o.to); err != nil {
+				return err
+			}
+		}
+		after, err = d.IndexSnapshot()
+		return err
+	}
+	if o.dryRun {
+		err = d.Transaction(func(tx *db.DB) error {
+			if err := run(tx); err != nil {
+				return err
+			}
+			return errDryRun
+		})
+		if err == errDryRun {
+			err = nil
+		}
+	} else {
+		err = run(d)
+	}
+	if err != nil {
+		return err
+	}
+
+	n := diff(w, "device", before.Devices, after.Devices) +
+		diff(w, "app", before.Apps, after.Apps) +
+		diff(w, "app_v2", before.AppsV2, after.AppsV2) +
+		diff(w, "project", before.Projects, after.Projects)
+	fmt.Fprintf(w, "resynced blocks [%d, %d], %d rows changed", o.from, o.to, n)
+	if o.dryRun {
+		fmt.Fprint(w, ", dry run, nothing committed")
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+// rebuild sets the owner of every device of the projects to the current owner of its ioID nft,
+// the changes are journaled at block
+func rebuild(d *db.DB, client *ethclient.Client, ioidAddr common.Address, projectIDs []uint64, block uint64) error {
+	instance, err := ioid.NewIoid(ioidAddr, client)
+	if err != nil {
+		return errors.Wrap(err, "failed to new ioid contract instance")
+	}
+	devices, err := d.DevicesOfProjects(projectIDs)
+	if err != nil {
+		return err
+	}
+	for _, t := range devices {
+		nftID, ok := new(big.Int).SetString(t.NFTID, 10)
+		if !ok {
+			slog.Warn("invalid device nft id", "device_id", t.ID, "nft_id", t.NFTID)
+			continue
+		}
+		owner, err := instance.OwnerOf(nil, nftID)
+		if err != nil {
+			// burned nfts revert
+			slog.Warn("failed to query ioid owner", "device_id", t.ID, "nft_id", t.NFTID, "error", err)
+			continue
+		}
+		if owner.String() == t.Owner {
+			continue
+		}
+		if err := d.UpdateOwner(block, nftID, owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diff writes the added, removed and changed rows to w, and returns the number of them
+func diff[T any](w io.Writer, kind string, before, after map[string]*T) int {
+	keys := make([]string, 0, len(before)+len(after))
+	for k := range before {
+		keys = append(keys, k)
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	n := 0
+	for _, k := range keys {
+		b, a := fields(before[k]), fields(after[k])
+		switch {
+		case b == nil:
+			fmt.Fprintf(w, "+ %s %s\n", kind, k)
+		case a == nil:
+			fmt.Fprintf(w, "- %s %s\n", kind, k)
+		case reflect.DeepEqual(a, b):
+			continue
+		default:
+			fmt.Fprintf(w, "~ %s %s\n", kind, k)
+			names := make([]string, 0, len(a))
+			for name := range a {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if !reflect.DeepEqual(a[name], b[name]) {
+					fmt.Fprintf(w, "    %s: %v -> %v\n", name, b[name], a[name])
+				}
+			}
+		}
+		n++
+	}
+	return n
+}
+
+// fields returns the columns of a row without its timestamps
+func fields[T any](t *T) map[string]any {
+	if t == nil {
+		return nil
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return nil
+	}
+	m := map[string]any{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	delete(m, "CreatedAt")
+	delete(m, "UpdatedAt")
+	return m
+}
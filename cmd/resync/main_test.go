@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pkg/errors"
+	"gorm.io/driver/sqlite"
+
+	"github.com/iotexproject/pebble-server/contract/ioid"
+	"github.com/iotexproject/pebble-server/contract/project"
+	"github.com/iotexproject/pebble-server/db"
+	"github.com/iotexproject/pebble-server/monitor"
+)
+
+var (
+	testAddr = &monitor.ContractAddr{
+		Project: common.HexToAddress("0x00000000000000000000000000000000000000a1"),
+		IoID:    common.HexToAddress("0x00000000000000000000000000000000000000a2"),
+	}
+	alice = common.HexToAddress("0x0000000000000000000000000000000000000001")
+	bob   = common.HexToAddress("0x0000000000000000000000000000000000000002")
+	carol = common.HexToAddress("0x0000000000000000000000000000000000000003")
+)
+
+func mustABI(m *bind.MetaData) *abi.ABI {
+	a, err := m.GetAbi()
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+var (
+	ioidABI    = mustABI(ioid.IoidMetaData)
+	projectABI = mustABI(project.ProjectMetaData)
+)
+
+// fakeEth serves the logs of a fake chain and the ioID owners over rpc
+type fakeEth struct {
+	logs   []types.Log
+	owners map[uint64]common.Address // the owners of the ioID nfts, the others are burned
+}
+
+func (e *fakeEth) GetLogs(q map[string]any) ([]types.Log, error) {
+	from, err := hexutil.DecodeUint64(q["fromBlock"].(string))
+	if err != nil {
+		return nil, err
+	}
+	to, err := hexutil.DecodeUint64(q["toBlock"].(string))
+	if err != nil {
+		return nil, err
+	}
+	logs := []types.Log{}
+	for _, l := range e.logs {
+		if l.BlockNumber >= from && l.BlockNumber <= to {
+			logs = append(logs, l)
+		}
+	}
+	return logs, nil
+}
+
+// Call serves ioID ownerOf calls
+func (e *fakeEth) Call(args map[string]any, _ string) (hexutil.Bytes, error) {
+	input, err := hexutil.Decode(args["input"].(string))
+	if err != nil {
+		return nil, err
+	}
+	m, err := ioidABI.MethodById(input)
+	if err != nil || m.Name != "ownerOf" {
+		return nil, errors.Errorf("unexpected call %x", input)
+	}
+	in, err := m.Inputs.Unpack(input[4:])
+	if err != nil {
+		return nil, err
+	}
+	owner, ok := e.owners[in[0].(*big.Int).Uint64()]
+	if !ok {
+		return nil, errors.New("execution reverted: ERC721: invalid token ID")
+	}
+	return m.Outputs.Pack(owner)
+}
+
+// emit appends the log of the event emitted by address in block
+func (e *fakeEth) emit(t *testing.T, a *abi.ABI, event string, address common.Address, block uint64, topics []common.Hash, args ...any) {
+	t.Helper()
+	data, err := a.Events[event].Inputs.NonIndexed().Pack(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.logs = append(e.logs, types.Log{
+		Address:     address,
+		Topics:      append([]common.Hash{a.Events[event].ID}, topics...),
+		Data:        data,
+		BlockNumber: block,
+		TxHash:      common.BytesToHash([]byte{byte(block), byte(len(e.logs))}),
+	})
+}
+
+func newFakeClient(t *testing.T, eth *fakeEth) *ethclient.Client {
+	t.Helper()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("eth", eth); err != nil {
+		t.Fatal(err)
+	}
+	c := ethclient.NewClient(rpc.DialInProc(srv))
+	t.Cleanup(func() {
+		c.Close()
+		srv.Stop()
+	})
+	return c
+}
+
+// newTestIndex returns a db with the devices of nft 1 and 2 owned by alice and project 1 named v1, and a chain
+// which transfers nft 1 to bob and renames the project in blocks [10, 11] and renames it again in block 12
+func newTestIndex(t *testing.T) (*db.DB, *fakeEth) {
+	t.Helper()
+	d, err := db.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nft := range []uint64{1, 2} {
+		if err := d.UpsertDevice(1, &db.Device{ID: fmt.Sprintf("did:io:%d", nft), NFTID: fmt.Sprint(nft),
+			ProjectID: 1, Owner: alice.String(), OperationTimes: db.NewOperationTimes()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.UpdateProject(1, 1, func(p *db.Project) { p.Name = "v1" }); err != nil {
+		t.Fatal(err)
+	}
+
+	eth := &fakeEth{owners: map[uint64]common.Address{}}
+	eth.emit(t, ioidABI, "Transfer", testAddr.IoID, 10, []common.Hash{
+		common.BytesToHash(alice.Bytes()), common.BytesToHash(bob.Bytes()), common.BigToHash(big.NewInt(1))})
+	eth.emit(t, projectABI, "SetName", testAddr.Project, 11, []common.Hash{common.BigToHash(big.NewInt(1))}, "v2")
+	eth.emit(t, projectABI, "SetName", testAddr.Project, 12, []common.Hash{common.BigToHash(big.NewInt(1))}, "v3")
+	return d, eth
+}
+
+func testOptions() *options {
+	return &options{from: 10, to: 11, defaultProject: 1, projectIDs: []uint64{1}, addr: testAddr}
+}
+
+func mustDevice(t *testing.T, d *db.DB, id string) *db.Device {
+	t.Helper()
+	dev, err := d.Device(id)
+	if err != nil || dev == nil {
+		t.Fatalf("device %s: %v", id, err)
+	}
+	return dev
+}
+
+func TestResyncRange(t *testing.T) {
+	d, eth := newTestIndex(t)
+	client := newFakeClient(t, eth)
+
+	out := &bytes.Buffer{}
+	if err := resync(out, d, client, testOptions()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"~ device did:io:1\n",
+		fmt.Sprintf("    Owner: %s -> %s\n", alice, bob),
+		"~ project 1\n",
+		"    Name: v1 -> v2\n",
+		"resynced blocks [10, 11], 2 rows changed\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in the output:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out.String(), "did:io:2") || strings.Contains(out.String(), "v3") {
+		t.Errorf("unexpected changes out of the range:\n%s", out)
+	}
+	if dev := mustDevice(t, d, "did:io:1"); dev.Owner != bob.String() {
+		t.Errorf("the transfer is not applied, owner %s", dev.Owner)
+	}
+
+	// the range is idempotent
+	out.Reset()
+	if err := resync(out, d, client, testOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "resynced blocks [10, 11], 0 rows changed\n" {
+		t.Errorf("unexpected output of the second resync:\n%s", out)
+	}
+}
+
+func TestResyncRebuildsOwners(t *testing.T) {
+	d, eth := newTestIndex(t)
+	// nft 1 is burned after the transfer, nft 2 is transferred by an event which is not indexed
+	eth.owners[2] = carol
+	o := testOptions()
+	o.rebuildOwners = true
+
+	out := &bytes.Buffer{}
+	if err := resync(out, d, newFakeClient(t, eth), o); err != nil {
+		t.Fatal(err)
+	}
+	if dev := mustDevice(t, d, "did:io:2"); dev.Owner != carol.String() {
+		t.Errorf("the owner of nft 2 is not rebuilt, got %s", dev.Owner)
+	}
+	if dev := mustDevice(t, d, "did:io:1"); dev.Owner != bob.String() {
+		t.Errorf("the owner of the burned nft is changed to %s", dev.Owner)
+	}
+	if want := fmt.Sprintf("    Owner: %s -> %s\n", alice, carol); !strings.Contains(out.String(), want) {
+		t.Errorf("expected %q in the output:\n%s", want, out)
+	}
+}
+
+func TestResyncDryRun(t *testing.T) {
+	d, eth := newTestIndex(t)
+	eth.owners[2] = carol
+	before, err := d.IndexSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := testOptions()
+	o.rebuildOwners, o.dryRun = true, true
+
+	out := &bytes.Buffer{}
+	if err := resync(out, d, newFakeClient(t, eth), o); err != nil {
+		t.Fatal(err)
+	}
+	if want := "resynced blocks [10, 11], 3 rows changed, dry run, nothing committed\n"; !strings.HasSuffix(out.String(), want) {
+		t.Errorf("expected the changes to be reported, got:\n%s", out)
+	}
+
+	after, err := d.IndexSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := &bytes.Buffer{}
+	if n := diff(check, "device", before.Devices, after.Devices) +
+		diff(check, "project", before.Projects, after.Projects); n != 0 {
+		t.Fatalf("the dry run changes the db:\n%s", check)
+	}
+}
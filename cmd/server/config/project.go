@@ -0,0 +1,67 @@
+package config
+
+import (
+	"encoding/json"
+
+	"github.com/iotexproject/w3bstream/project"
+	"github.com/pkg/errors"
+)
+
+// ProjectConfig is the settings of an ioID project served by the sequencer. The firmware and app
+// metadata keys are decoded into apps, and the signing config is used to verify the tasks uploaded by its devices.
+type ProjectConfig struct {
+	ID          uint64 `json:"id"`
+	FirmwareKey string `json:"firmwareKey"`
+	AppKey      string `json:"appKey"`
+	project.Config
+}
+
+var defaultProjectConfig = ProjectConfig{
+	FirmwareKey: "pebble_firmware",
+	AppKey:      "pebble_app",
+	Config: project.Config{
+		SignedKeys:         []project.SignedKey{{Name: "timestamp", Type: "uint64"}},
+		SignatureAlgorithm: "ecdsa",
+		HashAlgorithm:      "sha256",
+	},
+}
+
+// Projects parses PROJECT_CONFIGS, a json array of ProjectConfig. Missing settings take the pebble
+// defaults, and the IOID_PROJECT_ID project is served alone if PROJECT_CONFIGS is empty.
+func (c *Config) Projects() ([]*ProjectConfig, error) {
+	if c.ProjectConfigs == "" {
+		p := defaultProjectConfig
+		p.ID = c.IoIDProjectID
+		return []*ProjectConfig{&p}, nil
+	}
+	ps := []*ProjectConfig{}
+	if err := json.Unmarshal([]byte(c.ProjectConfigs), &ps); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal project configs")
+	}
+	if len(ps) == 0 {
+		return nil, errors.New("empty project configs")
+	}
+	seen := map[uint64]bool{}
+	for _, p := range ps {
+		if seen[p.ID] {
+			return nil, errors.Errorf("duplicate project config, project_id %d", p.ID)
+		}
+		seen[p.ID] = true
+		if p.FirmwareKey == "" {
+			p.FirmwareKey = defaultProjectConfig.FirmwareKey
+		}
+		if p.AppKey == "" {
+			p.AppKey = defaultProjectConfig.AppKey
+		}
+		if len(p.SignedKeys) == 0 {
+			p.SignedKeys = defaultProjectConfig.SignedKeys
+		}
+		if p.SignatureAlgorithm == "" {
+			p.SignatureAlgorithm = defaultProjectConfig.SignatureAlgorithm
+		}
+		if p.HashAlgorithm == "" {
+			p.HashAlgorithm = defaultProjectConfig.HashAlgorithm
+		}
+	}
+	return ps, nil
+}
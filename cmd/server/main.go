@@ -6,10 +6,12 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/iotexproject/w3bstream/project"
 	"github.com/pkg/errors"
 
 	"github.com/iotexproject/pebble-server/api"
@@ -31,37 +33,69 @@ func main() {
 		log.Fatal(errors.Wrap(err, "failed to parse private key"))
 	}
 
-	db, err := db.New(cfg.DatabaseDSN, cfg.OldDatabaseDSN)
+	d, err := db.New(cfg.DatabaseDSN, cfg.OldDatabaseDSN)
 	if err != nil {
 		log.Fatal(errors.Wrap(err, "failed to new db"))
 	}
 
+	projects, err := cfg.Projects()
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "failed to parse project configs"))
+	}
+	projectIDs := make([]uint64, 0, len(projects))
+	signingConfigs := make(map[uint64]*project.Config, len(projects))
+	for _, p := range projects {
+		projectIDs = append(projectIDs, p.ID)
+		signingConfigs[p.ID] = &p.Config
+		d.RegisterMetadataDecoder(p.ID, crypto.Keccak256Hash([]byte(p.FirmwareKey)), db.FirmwareDecoder)
+		d.RegisterMetadataDecoder(p.ID, crypto.Keccak256Hash([]byte(p.AppKey)), db.AppV2Decoder)
+	}
+	if err := d.AssignDefaultProject(cfg.IoIDProjectID); err != nil {
+		log.Fatal(errors.Wrap(err, "failed to assign default project"))
+	}
+	// devices are bound to the holder of their ioID nft, as the deployed firmware and apps expect,
+	// unless the binding handshake is required
+	if cfg.BindingHandshake {
+		d.RequireBindingHandshake()
+	}
+
 	client, err := ethclient.Dial(cfg.ChainEndpoint)
 	if err != nil {
 		log.Fatal(errors.Wrap(err, "failed to dial chain endpoint"))
 	}
 
 	if err := monitor.Run(
-		&monitor.Handler{
-			ScannedBlockNumber:       db.ScannedBlockNumber,
-			UpsertScannedBlockNumber: db.UpsertScannedBlockNumber,
-			UpsertProjectMetadata:    db.UpsertApp,
-			UpsertDevice:             db.UpsertDevice,
-			UpdateDeviceOwner:        db.UpdateOwner,
-		},
+		monitor.NewHandler(d),
 		&monitor.ContractAddr{
-			Project: common.HexToAddress(cfg.ProjectContractAddr),
-			IoID:    common.HexToAddress(cfg.IoIDContractAddr),
+			Project:      common.HexToAddress(cfg.ProjectContractAddr),
+			IoID:         common.HexToAddress(cfg.IoIDContractAddr),
+			IoIDRegistry: common.HexToAddress(cfg.IoIDRegistryContractAddr),
 		},
 		cfg.BeginningBlockNumber,
-		cfg.IoIDProjectID,
+		projectIDs,
+		cfg.ChainConfirmations,
 		client,
 	); err != nil {
 		log.Fatal(errors.Wrap(err, "failed to run contract monitor"))
 	}
 
+	var mqttCfg *api.MqttConfig
+	if cfg.MqttBrokerEndpoint != "" {
+		mqttCfg = &api.MqttConfig{Broker: cfg.MqttBrokerEndpoint, ClientID: cfg.MqttClientID}
+	}
+	clockSkew := time.Duration(cfg.MaxClockSkew) * time.Second
 	go func() {
-		if err := api.Run(db, cfg.ServiceEndpoint, cfg.W3bstreamServiceEndpoint, client, prv); err != nil {
+		if err := api.Run(d, &api.Config{
+			Address:        cfg.ServiceEndpoint,
+			W3bstreamAddr:  cfg.W3bstreamServiceEndpoint,
+			PrivateKey:     prv,
+			ClockSkew:      clockSkew,
+			GeoRadius:      float64(cfg.DeviceRecordQueryRadius),
+			Projects:       signingConfigs,
+			FirmwareMirror: cfg.FirmwareMirrorDir,
+			AdminToken:     cfg.AdminToken,
+			Mqtt:           mqttCfg,
+		}); err != nil {
 			log.Fatal(err)
 		}
 	}()
@@ -1,22 +1,28 @@
 package db
 
 import (
-	"bytes"
+	"crypto/sha256"
 	"encoding/json"
-	"log/slog"
+	"fmt"
+	"strconv"
+	"strings"
 
-	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/pkg/errors"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
 type App struct {
-	ID      string `gorm:"primary_key"`
-	Version string `gorm:"not null;default:''"`
-	Uri     string `gorm:"not null;default:''"`
-	Avatar  string `gorm:"not null;default:''"`
-	Content string `gorm:"not null;default:''"`
+	ID         string `gorm:"primary_key"`
+	ProjectID  uint64 `gorm:"primary_key;autoIncrement:false;not null;default:0"`
+	Version    string `gorm:"not null;default:''"`
+	Uri        string `gorm:"not null;default:''"`
+	Avatar     string `gorm:"not null;default:''"`
+	Content    string `gorm:"not null;default:''"`
+	Hash       string `gorm:"not null;default:''"` // hex encoded sha256 of the firmware binary
+	Size       uint64 `gorm:"not null;default:0"`
+	MinVersion string `gorm:"not null;default:''"` // the minimum version which can update to this version
 
 	OperationTimes
 }
@@ -24,45 +30,131 @@ type App struct {
 func (*App) TableName() string { return "app" }
 
 type firmwareData struct {
-	Name    string `json:"name"`
-	Version string `json:"version"`
-	URL     string `json:"url"`
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	URL        string `json:"url"`
+	Hash       string `json:"hash"`
+	Size       uint64 `json:"size"`
+	MinVersion string `json:"minVersion"`
 }
 
-var pebbleFirmwareKey = crypto.Keccak256Hash([]byte("pebble_firmware"))
+// NormalizeFirmwareHash returns the 0x prefixed lower case hex of a sha256 firmware hash, an empty hash is kept
+func NormalizeFirmwareHash(h string) (string, error) {
+	if h == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(h, "0x") && !strings.HasPrefix(h, "0X") {
+		h = "0x" + h
+	}
+	b, err := hexutil.Decode(strings.ToLower(h))
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid firmware hash %s", h)
+	}
+	if len(b) != sha256.Size {
+		return "", errors.Errorf("invalid firmware hash length %d", len(b))
+	}
+	return hexutil.Encode(b), nil
+}
+
+// FirmwareDecoder derives the firmware app of the project from its firmware metadata
+var FirmwareDecoder = &MetadataDecoder{
+	Name: "firmware",
+	Decode: func(tx *gorm.DB, block uint64, m *ProjectMetadata) error {
+		firmware := &firmwareData{}
+		if err := json.Unmarshal(m.Value, firmware); err != nil {
+			return &MalformedMetadataError{Reason: "failed to unmarshal firmware data: " + err.Error()}
+		}
+		if firmware.Name == "" {
+			return &MalformedMetadataError{Reason: "empty firmware name"}
+		}
+		hash, err := NormalizeFirmwareHash(firmware.Hash)
+		if err != nil {
+			return &MalformedMetadataError{Reason: err.Error()}
+		}
+		return upsertApp(tx, block, &App{
+			ID:             firmware.Name,
+			ProjectID:      m.ProjectID,
+			Version:        firmware.Version,
+			Uri:            firmware.URL,
+			Hash:           hash,
+			Size:           firmware.Size,
+			MinVersion:     firmware.MinVersion,
+			OperationTimes: NewOperationTimes(),
+		})
+	},
+}
 
-func (d *DB) UpsertApp(projectID uint64, key [32]byte, value []byte) error {
-	if !bytes.Equal(key[:], pebbleFirmwareKey.Bytes()) {
-		slog.Error("failed to match pebble firmware key")
-		return nil
+func upsertApp(tx *gorm.DB, block uint64, t *App) error {
+	prev := &App{}
+	if err := tx.Where("project_id = ? AND id = ?", t.ProjectID, t.ID).First(prev).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			return errors.Wrap(err, "failed to query app")
+		}
+		prev = nil
+	}
+	if err := journal(tx, block, journalApp, appJournalKey(t.ProjectID, t.ID), prev); err != nil {
+		return err
 	}
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "project_id"}, {Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"version", "uri", "hash", "size", "min_version", "updated_at"}),
+	}).Create(t).Error
+	return errors.Wrap(err, "failed to upsert app")
+}
+
+func appJournalKey(projectID uint64, id string) string {
+	return fmt.Sprintf("%d/%s", projectID, id)
+}
 
-	firmware := &firmwareData{}
-	if err := json.Unmarshal(value, firmware); err != nil {
-		slog.Error("failed to unmarshal firmware data", "data", string(value), "error", err)
-		return nil
+// appJournalQuery returns the query matching the journaled app,
+// the keys journaled before apps had a project only have the app id
+func appJournalQuery(key string) (string, []any, error) {
+	pid, id, ok := strings.Cut(key, "/")
+	if !ok {
+		return "id = ?", []any{key}, nil
+	}
+	projectID, err := strconv.ParseUint(pid, 10, 64)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "invalid app journal key %s", key)
 	}
+	return "project_id = ? AND id = ?", []any{projectID, id}, nil
+}
 
-	t := App{
-		ID:             firmware.Name,
-		Version:        firmware.Version,
-		Uri:            firmware.URL,
-		OperationTimes: NewOperationTimes(),
+// migrateAppPrimaryKey scopes the app and app v2 primary keys created before apps had a project
+func migrateAppPrimaryKey(db *gorm.DB) error {
+	for _, table := range []string{"app", "app_v2"} {
+		var n int64
+		if err := db.Raw(`SELECT count(*) FROM information_schema.key_column_usage
+			WHERE table_name = ? AND constraint_name = ?`, table, table+"_pkey").Scan(&n).Error; err != nil {
+			return errors.Wrapf(err, "failed to query %s primary key", table)
+		}
+		if n != 1 {
+			continue
+		}
+		err := db.Exec(fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s_pkey, ADD PRIMARY KEY (project_id, id)", table, table)).Error
+		if err != nil {
+			return errors.Wrapf(err, "failed to migrate %s primary key", table)
+		}
 	}
-	err := d.db.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"version", "uri", "updated_at"}),
-	}).Create(&t).Error
-	return errors.Wrap(err, "failed to upsert app")
+	return nil
 }
 
-func (d *DB) App(id string) (*App, error) {
-	t := App{}
-	if err := d.db.Where("id = ?", id).First(&t).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
+func (d *DB) App(projectID uint64, id string) (*App, error) {
+	return readFirst(d.readers(), func(db *gorm.DB) (*App, error) {
+		t := App{}
+		q := db.Where("id = ?", id)
+		if db != d.oldDB {
+			q = q.Where("project_id = ?", projectID)
+		} else if projectID != d.defaultProject {
+			// apps of the legacy db have no project, they are the apps of the default project
 			return nil, nil
 		}
-		return nil, errors.Wrap(err, "failed to query app")
-	}
-	return &t, nil
+		if err := q.First(&t).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, nil
+			}
+			return nil, errors.Wrap(err, "failed to query app")
+		}
+		return &t, nil
+	})
 }
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestAppsAreScopedByProject(t *testing.T) {
+	d := newTestDB(t)
+	d.oldDB = openTestDB(t, "legacy")
+	d.defaultProject = 1
+
+	key := common.HexToHash("0x01")
+	for i, projectID := range []uint64{1, 2} {
+		d.RegisterMetadataDecoder(projectID, key, AppV2Decoder)
+		l := &types.Log{BlockNumber: 10, TxHash: common.HexToHash("0x02"), Index: uint(i)}
+		if err := d.UpsertProjectMetadata(l, projectID, "app", key, []byte(`{"id":"wallet","slug":"wallet"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var apps int64
+	if err := d.db.Model(&AppV2{}).Where("id = ?", "wallet").Count(&apps).Error; err != nil {
+		t.Fatal(err)
+	}
+	if apps != 2 {
+		t.Fatalf("expected an app v2 of each project, got %d", apps)
+	}
+
+	if err := d.oldDB.Create(&App{ID: "firmware", Version: "1.0.0", OperationTimes: NewOperationTimes()}).Error; err != nil {
+		t.Fatal(err)
+	}
+	app, err := d.App(1, "firmware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app == nil || app.Version != "1.0.0" {
+		t.Fatalf("expected the legacy app of the default project, got %+v", app)
+	}
+	if app, err = d.App(2, "firmware"); err != nil {
+		t.Fatal(err)
+	}
+	if app != nil {
+		t.Fatalf("expected no app of another project, got %+v", app)
+	}
+}
+
+func TestAssignDefaultProject(t *testing.T) {
+	d := newTestDB(t)
+	apps := []any{
+		&App{ID: "firmware", Version: "1.0.0"},
+		&AppV2{ID: "wallet", Slug: "unscoped"},
+		&AppV2{ID: "explorer", Slug: "unscoped"},
+		// indexed after the apps were scoped by project, so it replaces the unscoped app
+		&AppV2{ID: "explorer", ProjectID: 7, Slug: "scoped"},
+		&Device{ID: "0xabc", NFTID: "1"},
+	}
+	for _, app := range apps {
+		if err := d.db.Create(app).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.AssignDefaultProject(7); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []any{&App{}, &AppV2{}, &Device{}} {
+		var unscoped int64
+		if err := d.db.Model(m).Where("project_id = 0").Count(&unscoped).Error; err != nil {
+			t.Fatal(err)
+		}
+		if unscoped != 0 {
+			t.Errorf("%T has %d rows without a project", m, unscoped)
+		}
+	}
+	for id, slug := range map[string]string{"wallet": "unscoped", "explorer": "scoped"} {
+		app := &AppV2{}
+		if err := d.db.Where("project_id = ? AND id = ?", 7, id).First(app).Error; err != nil {
+			t.Fatalf("app v2 %s of the default project: %v", id, err)
+		}
+		if app.Slug != slug {
+			t.Errorf("unexpected app v2 %s of the default project: %+v", id, app)
+		}
+	}
+}
@@ -1,7 +1,17 @@
 package db
 
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
 type AppV2 struct {
 	ID         string `gorm:"primary_key"`
+	ProjectID  uint64 `gorm:"primary_key;autoIncrement:false;not null;default:0"`
 	Slug       string `gorm:"not null;default:''"`
 	Logo       string `gorm:"not null;default:''"`
 	Author     string `gorm:"not null;default:''"`
@@ -22,3 +32,82 @@ type AppV2 struct {
 }
 
 func (*AppV2) TableName() string { return "app_v2" }
+
+type appV2Data struct {
+	ID         string          `json:"id"`
+	Slug       string          `json:"slug"`
+	Logo       string          `json:"logo"`
+	Author     string          `json:"author"`
+	Status     string          `json:"status"`
+	Content    string          `json:"content"`
+	Data       json.RawMessage `json:"data"`
+	Previews   json.RawMessage `json:"previews"`
+	Date       string          `json:"date"`
+	URI        string          `json:"uri"`
+	Category   int32           `json:"category"`
+	DirectLink string          `json:"directLink"`
+	Order      int32           `json:"order"`
+	Firmware   string          `json:"firmware"`
+}
+
+// AppV2Decoder derives the app store entry published in the app metadata of the project
+var AppV2Decoder = &MetadataDecoder{
+	Name: "app_v2",
+	Decode: func(tx *gorm.DB, block uint64, m *ProjectMetadata) error {
+		app := &appV2Data{}
+		if err := json.Unmarshal(m.Value, app); err != nil {
+			return &MalformedMetadataError{Reason: "failed to unmarshal app data: " + err.Error()}
+		}
+		if app.ID == "" {
+			return &MalformedMetadataError{Reason: "empty app id"}
+		}
+		t := &AppV2{
+			ID:         app.ID,
+			ProjectID:  m.ProjectID,
+			Slug:       app.Slug,
+			Logo:       app.Logo,
+			Author:     app.Author,
+			Status:     app.Status,
+			Content:    app.Content,
+			Data:       "{}",
+			Previews:   "[]",
+			Date:       app.Date,
+			URI:        app.URI,
+			Category:   app.Category,
+			DirectLink: app.DirectLink,
+			Order:      app.Order,
+			Firmware:   app.Firmware,
+		}
+		if len(app.Data) > 0 {
+			t.Data = string(app.Data)
+		}
+		if len(app.Previews) > 0 {
+			t.Previews = string(app.Previews)
+		}
+		// the string time columns shadow the ones of OperationTimes
+		now := time.Now().Format(time.RFC3339)
+		t.CreatedAt, t.UpdatedAt = now, now
+		return upsertAppV2(tx, block, t)
+	},
+}
+
+func upsertAppV2(tx *gorm.DB, block uint64, t *AppV2) error {
+	prev := &AppV2{}
+	if err := tx.Where("project_id = ? AND id = ?", t.ProjectID, t.ID).First(prev).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			return errors.Wrap(err, "failed to query app v2")
+		}
+		prev = nil
+	}
+	if err := journal(tx, block, journalAppV2, appJournalKey(t.ProjectID, t.ID), prev); err != nil {
+		return err
+	}
+	err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "project_id"}, {Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"slug", "logo", "author", "status", "content", "data", "previews", "date", "updated_at", "uri",
+			"category", "direct_link", "order", "firmware",
+		}),
+	}).Create(t).Error
+	return errors.Wrap(err, "failed to upsert app v2")
+}
@@ -1,16 +1,31 @@
 package db
 
 import (
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/pkg/errors"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
+// reorgRetainBlocks is how far behind the scanned height block hashes and chain journals are kept,
+// reorgs deeper than it can not be rolled back
+const reorgRetainBlocks = 5000
+
 type scannedBlockNumber struct {
 	gorm.Model
 	Number uint64 `gorm:"not null"`
 }
 
+// ScannedBlock is the hash of a scanned block, used to detect reorgs
+type ScannedBlock struct {
+	Number uint64 `gorm:"primary_key;autoIncrement:false"`
+	Hash   string `gorm:"not null"`
+
+	OperationTimes
+}
+
+func (*ScannedBlock) TableName() string { return "scanned_block" }
+
 func (d *DB) ScannedBlockNumber() (uint64, error) {
 	t := scannedBlockNumber{}
 	if err := d.db.Where("id = ?", 1).First(&t).Error; err != nil {
@@ -22,16 +37,108 @@ func (d *DB) ScannedBlockNumber() (uint64, error) {
 	return t.Number, nil
 }
 
-func (d *DB) UpsertScannedBlockNumber(number uint64) error {
+func upsertScannedBlockNumber(tx *gorm.DB, number uint64) error {
 	t := scannedBlockNumber{
 		Model: gorm.Model{
 			ID: 1,
 		},
 		Number: number,
 	}
-	err := d.db.Clauses(clause.OnConflict{
+	err := tx.Clauses(clause.OnConflict{
 		Columns:   []clause.Column{{Name: "id"}},
 		DoUpdates: clause.AssignmentColumns([]string{"number"}),
 	}).Create(&t).Error
 	return errors.Wrap(err, "failed to upsert scanned block number")
 }
+
+func (d *DB) UpsertScannedBlockNumber(number uint64) error {
+	return upsertScannedBlockNumber(d.db, number)
+}
+
+// UpsertScannedBlock records the block as the scanned height together with its hash,
+// and prunes the hashes and chain journals out of the reorg window
+func (d *DB) UpsertScannedBlock(number uint64, hash common.Hash) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		if err := upsertScannedBlockNumber(tx, number); err != nil {
+			return err
+		}
+		t := ScannedBlock{
+			Number:         number,
+			Hash:           hash.Hex(),
+			OperationTimes: NewOperationTimes(),
+		}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "number"}},
+			DoUpdates: clause.AssignmentColumns([]string{"hash", "updated_at"}),
+		}).Create(&t).Error; err != nil {
+			return errors.Wrap(err, "failed to upsert scanned block")
+		}
+		if number <= reorgRetainBlocks {
+			return nil
+		}
+		if err := tx.Where("number < ?", number-reorgRetainBlocks).Delete(&ScannedBlock{}).Error; err != nil {
+			return errors.Wrap(err, "failed to prune scanned blocks")
+		}
+		if err := tx.Where("block_number < ?", number-reorgRetainBlocks).Delete(&chainJournal{}).Error; err != nil {
+			return errors.Wrap(err, "failed to prune chain journals")
+		}
+		return nil
+	})
+}
+
+// ScannedBlockHash returns the recorded hash of the block, zero hash if it is not recorded
+func (d *DB) ScannedBlockHash(number uint64) (common.Hash, error) {
+	t := ScannedBlock{}
+	if err := d.db.Where("number = ?", number).First(&t).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return common.Hash{}, nil
+		}
+		return common.Hash{}, errors.Wrap(err, "failed to query scanned block")
+	}
+	return common.HexToHash(t.Hash), nil
+}
+
+// ScannedBlocks returns the recorded block hashes, highest first
+func (d *DB) ScannedBlocks() ([]*ScannedBlock, error) {
+	ts := []*ScannedBlock{}
+	err := d.db.Order("number DESC").Find(&ts).Error
+	return ts, errors.Wrap(err, "failed to query scanned blocks")
+}
+
+// RollbackBlocks reverts the device and app changes made by the blocks after ancestor
+// and resets the scanned height to ancestor
+func (d *DB) RollbackBlocks(ancestor uint64) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		if err := rollbackJournals(tx, ancestor); err != nil {
+			return err
+		}
+		if err := rollbackProjectMetadata(tx, ancestor); err != nil {
+			return err
+		}
+		if err := rollbackDeviceStatus(tx, ancestor); err != nil {
+			return err
+		}
+		if err := tx.Where("number > ?", ancestor).Delete(&ScannedBlock{}).Error; err != nil {
+			return errors.Wrap(err, "failed to delete rolled back scanned blocks")
+		}
+		return upsertScannedBlockNumber(tx, ancestor)
+	})
+}
+
+// backfillChainBlock sets the chain block of the rows indexed before they recorded it to the scanned height,
+// so resyncing the scanned blocks does not revert them
+func backfillChainBlock(db *gorm.DB) error {
+	t := scannedBlockNumber{}
+	if err := db.Where("id = ?", 1).First(&t).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return errors.Wrap(err, "failed to query scanned block number")
+	}
+	for _, m := range []any{&Device{}, &Project{}, &ProjectContract{}} {
+		if err := db.Model(m).Where("chain_block = 0").UpdateColumn("chain_block", t.Number).Error; err != nil {
+			return errors.Wrap(err, "failed to backfill chain block")
+		}
+	}
+	return nil
+}
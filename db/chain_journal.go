@@ -0,0 +1,115 @@
+package db
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	journalDevice          = "device"
+	journalApp             = "app"
+	journalAppV2           = "app_v2"
+	journalProject         = "project"
+	journalProjectContract = "project_contract"
+)
+
+// chainJournal keeps the state of a row before it was changed by a chain event,
+// so the change can be reverted if the block is reorged out
+type chainJournal struct {
+	ID          uint64 `gorm:"primary_key"`
+	BlockNumber uint64 `gorm:"index:chain_journal_block_number;not null"`
+	Kind        string `gorm:"not null"`
+	Key         string `gorm:"not null"`
+	Previous    []byte // json of the previous row, empty if the row did not exist
+}
+
+func (*chainJournal) TableName() string { return "chain_journal" }
+
+func journal(tx *gorm.DB, block uint64, kind, key string, previous any) error {
+	t := chainJournal{
+		BlockNumber: block,
+		Kind:        kind,
+		Key:         key,
+	}
+	data, err := json.Marshal(previous)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal previous %s %s", kind, key)
+	}
+	// a nil row pointer is marshaled to null, which means the row did not exist
+	if string(data) != "null" {
+		t.Previous = data
+	}
+	err = tx.Create(&t).Error
+	return errors.Wrapf(err, "failed to create chain journal, %s %s", kind, key)
+}
+
+// restore saves the journaled row, or deletes the row matched by query if it did not exist.
+// If columns is not empty, only these columns of an existing row are restored, so the columns written
+// off-chain after the journaled change are kept.
+func restore[T any](tx *gorm.DB, j *chainJournal, columns []string, query string, args ...any) error {
+	var t T
+	if len(j.Previous) == 0 {
+		err := tx.Where(query, args...).Delete(&t).Error
+		return errors.Wrapf(err, "failed to delete %s %s", j.Kind, j.Key)
+	}
+	if err := json.Unmarshal(j.Previous, &t); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal previous %s %s", j.Kind, j.Key)
+	}
+	if len(columns) == 0 {
+		err := tx.Save(&t).Error
+		return errors.Wrapf(err, "failed to restore %s %s", j.Kind, j.Key)
+	}
+	var m T
+	res := tx.Model(&m).Where(query, args...).Select(columns).Updates(&t)
+	if res.Error != nil {
+		return errors.Wrapf(res.Error, "failed to restore %s %s", j.Kind, j.Key)
+	}
+	if res.RowsAffected == 0 {
+		err := tx.Create(&t).Error
+		return errors.Wrapf(err, "failed to restore %s %s", j.Kind, j.Key)
+	}
+	return nil
+}
+
+// rollbackJournals reverts the journaled changes of the blocks after ancestor, newest first
+func rollbackJournals(tx *gorm.DB, ancestor uint64) error {
+	js := []*chainJournal{}
+	if err := tx.Where("block_number > ?", ancestor).Order("id DESC").Find(&js).Error; err != nil {
+		return errors.Wrap(err, "failed to query chain journals")
+	}
+	for _, j := range js {
+		var err error
+		switch j.Kind {
+		case journalDevice:
+			err = restore[Device](tx, j, deviceChainColumns, "id = ?", j.Key)
+		case journalApp, journalAppV2:
+			query, args, qerr := appJournalQuery(j.Key)
+			if qerr != nil {
+				return qerr
+			}
+			if j.Kind == journalApp {
+				err = restore[App](tx, j, nil, query, args...)
+			} else {
+				err = restore[AppV2](tx, j, nil, query, args...)
+			}
+		case journalProject:
+			id, perr := strconv.ParseUint(j.Key, 10, 64)
+			if perr != nil {
+				return errors.Wrapf(perr, "invalid project journal key %s", j.Key)
+			}
+			err = restore[Project](tx, j, nil, "id = ?", id)
+		case journalProjectContract:
+			err = restore[ProjectContract](tx, j, nil, "address = ?", j.Key)
+		default:
+			err = errors.Errorf("unknown chain journal kind %s", j.Kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err := tx.Where("block_number > ?", ancestor).Delete(&chainJournal{}).Error
+	return errors.Wrap(err, "failed to delete rolled back chain journals")
+}
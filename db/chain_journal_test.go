@@ -0,0 +1,159 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestRollbackKeepsOffChainColumns(t *testing.T) {
+	d := newTestDB(t)
+	owner := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	newOwner := common.HexToAddress("0x0000000000000000000000000000000000000002")
+
+	if err := d.UpsertDevice(10, &Device{
+		ID:             "0xabc",
+		NFTID:          "1",
+		Name:           "did:io:0xabc",
+		Owner:          owner.String(),
+		Status:         CONFIRM,
+		OperationTimes: NewOperationTimes(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdateOwner(20, common.Big1, newOwner); err != nil {
+		t.Fatal(err)
+	}
+	// off-chain writes after the journaled chain event
+	if err := d.UpdateByID("0xabc", map[string]any{"name": "kitchen", "config": "cfg", "real_firmware": "2.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.AdvanceLastTimestamp("0xabc", 100); err != nil || !ok {
+		t.Fatalf("failed to advance last timestamp: %v %v", ok, err)
+	}
+
+	if err := d.RollbackBlocks(15); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.Device("0xabc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil {
+		t.Fatal("device rolled back to the block it was created in is missing")
+	}
+	if got.Owner != owner.String() {
+		t.Errorf("owner is not rolled back, got %s, want %s", got.Owner, owner)
+	}
+	if got.Name != "kitchen" || got.Config != "cfg" || got.RealFirmware != "2.0" || got.LastTimestamp != 100 {
+		t.Errorf("off-chain columns are reverted: name %q, config %q, real firmware %q, last timestamp %d",
+			got.Name, got.Config, got.RealFirmware, got.LastTimestamp)
+	}
+
+	if err := d.RollbackBlocks(5); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.Device("0xabc"); err != nil || got != nil {
+		t.Fatalf("device created after the ancestor is not deleted: %v %v", got, err)
+	}
+}
+
+func TestRollbackKeepsOffChainBinding(t *testing.T) {
+	d := newTestDB(t)
+	d.RequireBindingHandshake()
+	owner := common.HexToAddress("0x0000000000000000000000000000000000000001")
+
+	if err := d.UpsertDevice(10, &Device{
+		ID:             "0xabc",
+		NFTID:          "1",
+		Owner:          owner.String(),
+		Status:         CREATED,
+		OperationTimes: NewOperationTimes(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdateDeviceDocument(20, "0xabc", "ipfs://doc", [32]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	// the binding handshake is completed off-chain after the journaled chain event
+	if ok, err := d.ProposeDevice("0xabc", owner); err != nil || !ok {
+		t.Fatalf("failed to propose device: %v %v", ok, err)
+	}
+	if ok, err := d.ConfirmDevice("0xabc", owner, 1); err != nil || !ok {
+		t.Fatalf("failed to confirm device: %v %v", ok, err)
+	}
+
+	if err := d.RollbackBlocks(15); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.Device("0xabc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DocumentURI != "" {
+		t.Errorf("document is not rolled back, got %s", got.DocumentURI)
+	}
+	if got.Status != CONFIRM || got.Proposer != owner.String() {
+		t.Errorf("the off-chain binding is reverted: status %d, proposer %s", got.Status, got.Proposer)
+	}
+}
+
+func TestRollbackRevertsChainStatusChanges(t *testing.T) {
+	d := newTestDB(t)
+	d.RequireBindingHandshake()
+	owner := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	newOwner := common.HexToAddress("0x0000000000000000000000000000000000000002")
+
+	if err := d.UpsertDevice(10, &Device{
+		ID:             "0xabc",
+		NFTID:          "1",
+		Owner:          owner.String(),
+		Status:         CREATED,
+		OperationTimes: NewOperationTimes(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.ProposeDevice("0xabc", owner); err != nil || !ok {
+		t.Fatalf("failed to propose device: %v %v", ok, err)
+	}
+	if ok, err := d.ConfirmDevice("0xabc", owner, 1); err != nil || !ok {
+		t.Fatalf("failed to confirm device: %v %v", ok, err)
+	}
+	// the transfer resets the binding, the burn deactivates the device
+	if err := d.UpdateOwner(20, common.Big1, newOwner); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeactivateDeviceByNFT(30, common.Hash{}, common.Big1, StatusReasonIoIDBurned); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.RollbackBlocks(25); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.Device("0xabc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != CREATED || got.Owner != newOwner.String() {
+		t.Fatalf("the burn is not reverted: status %d, owner %s", got.Status, got.Owner)
+	}
+
+	if err := d.RollbackBlocks(15); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = d.Device("0xabc"); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != CONFIRM || got.Owner != owner.String() || got.Proposer != owner.String() {
+		t.Fatalf("the binding reset is not reverted: status %d, owner %s, proposer %s", got.Status, got.Owner, got.Proposer)
+	}
+	cs, err := d.DeviceStatusChanges("0xabc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cs {
+		if c.BlockNumber > 15 {
+			t.Errorf("status change of rolled back block %d is kept", c.BlockNumber)
+		}
+	}
+}
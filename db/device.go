@@ -1,10 +1,12 @@
 package db
 
 import (
+	"fmt"
 	"math/big"
 	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/pkg/errors"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -14,11 +16,14 @@ const (
 	CREATED int32 = iota
 	PROPOSAL
 	CONFIRM
+	REMOVED     // removed from the ioID registry
+	DEACTIVATED // ioID burned or did wallet removed
 )
 
 type Device struct {
 	ID                     string `gorm:"primary_key"`
 	NFTID                  string `gorm:"uniqueIndex:device_nft_id,not null"`
+	ProjectID              uint64 `gorm:"index:device_project_id;not null;default:0"`
 	Name                   string `gorm:"not null;default:''"`
 	Owner                  string `gorm:"not null;default:''"`
 	Address                string `gorm:"not null;default:''"`
@@ -38,16 +43,159 @@ type Device struct {
 	State                  int32  `gorm:"not null;default:0"`
 	Type                   int32  `gorm:"not null;default:0"`
 	Configurable           bool   `gorm:"not null;default:0;default:true"`
+	ConfigDisabled         bool   `gorm:"not null;default:false"` // config downlink disabled by the owner
+	LastTimestamp          int64  `gorm:"not null;default:0"`
+	DocumentURI            string `gorm:"not null;default:''"`
+	DocumentHash           string `gorm:"not null;default:''"`
+	ChainBlock             uint64 `gorm:"not null;default:0"` // block of the last chain event applied to the device
 
 	OperationTimes
 }
 
 func (*Device) TableName() string { return "device" }
 
+// deviceChainColumns are the device columns derived from chain events, only these are journaled and
+// restored on reorgs, the columns written by the devices and owners are kept. The status and proposer are
+// also changed by the binding handshake, so they are reverted from the status changes of the rolled back
+// blocks instead, see rollbackDeviceStatus.
+var deviceChainColumns = []string{
+	"nft_id", "project_id", "owner", "address", "document_uri", "document_hash", "chain_block",
+}
+
+// chainState returns a copy of the device keeping only the columns set by chain events
+func (t *Device) chainState() *Device {
+	if t == nil {
+		return nil
+	}
+	return &Device{
+		ID:             t.ID,
+		NFTID:          t.NFTID,
+		ProjectID:      t.ProjectID,
+		Name:           t.Name,
+		Owner:          t.Owner,
+		Address:        t.Address,
+		Status:         t.Status,
+		Proposer:       t.Proposer,
+		DocumentURI:    t.DocumentURI,
+		DocumentHash:   t.DocumentHash,
+		ChainBlock:     t.ChainBlock,
+		OperationTimes: t.OperationTimes,
+	}
+}
+
 func (d *DB) Device(id string) (*Device, error) {
 	id = strings.ToLower(id)
+	return readFirst(d.readers(), func(db *gorm.DB) (*Device, error) {
+		t := Device{}
+		if err := db.Where("id = ?", id).First(&t).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, nil
+			}
+			return nil, errors.Wrap(err, "failed to query device")
+		}
+		if t.ProjectID == 0 {
+			t.ProjectID = d.defaultProject
+		}
+		return &t, nil
+	})
+}
+
+// UpsertDevice journals and upserts the device created by a chain event of block, it does nothing if
+// the device has been changed by an event of a later block. The binding state of an existing device is kept
+// unless its ioID nft or owner changed, then the device is bound to the owner, or left CREATED for the
+// binding handshake if it is required. The name is only set when the device is created.
+func (d *DB) UpsertDevice(block uint64, t *Device) error {
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		prev, err := findDevice(tx, "id = ?", t.ID)
+		if err != nil || prev.appliedAfter(block) {
+			return err
+		}
+		if err := journal(tx, block, journalDevice, t.ID, prev.chainState()); err != nil {
+			return err
+		}
+		switch {
+		case prev != nil && prev.NFTID == t.NFTID && prev.Owner == t.Owner:
+			t.Status, t.Proposer = prev.Status, prev.Proposer
+		case d.bindingHandshake:
+			t.Status, t.Proposer = CREATED, ""
+		default:
+			t.Status, t.Proposer = CONFIRM, t.Owner
+		}
+		t.ChainBlock = block
+		if err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "id"}},
+			DoUpdates: clause.AssignmentColumns([]string{
+				"nft_id", "project_id", "owner", "address", "status", "proposer", "document_uri", "document_hash",
+				"chain_block", "updated_at",
+			}),
+		}).Create(t).Error; err != nil {
+			return err
+		}
+		if prev == nil || prev.Status == t.Status {
+			return nil
+		}
+		return createStatusChange(tx, prev, block, common.Hash{}, t.Status, StatusReasonOwnerChanged)
+	})
+	return errors.Wrap(err, "failed to upsert device")
+}
+
+// UpdateOwner records the new holder of the ioID nft as the device owner. If the binding handshake is
+// required, a pending or confirmed binding is reset and the new owner has to propose again.
+func (d *DB) UpdateOwner(block uint64, nftID *big.Int, owner common.Address) error {
+	err := d.updateDevice(block, func(prev *Device) map[string]any {
+		values := map[string]any{"owner": owner.String()}
+		if d.bindingHandshake && prev.Owner != owner.String() && (prev.Status == PROPOSAL || prev.Status == CONFIRM) {
+			values["status"] = CREATED
+			values["proposer"] = ""
+		}
+		return values
+	}, "nft_id = ?", nftID.String())
+	return errors.Wrap(err, "failed to update device owner")
+}
+
+// UpdateDeviceDocument records the did document of the device registered in the ioID registry
+func (d *DB) UpdateDeviceDocument(block uint64, id string, uri string, hash [32]byte) error {
+	err := d.updateDevice(block, func(*Device) map[string]any {
+		return map[string]any{
+			"document_uri":  uri,
+			"document_hash": hexutil.Encode(hash[:]),
+		}
+	}, "id = ?", strings.ToLower(id))
+	return errors.Wrap(err, "failed to update device document")
+}
+
+// updateDevice journals and updates the device found by query with the values derived from it, it does
+// nothing if the device does not exist or has been changed by an event of a later block
+func (d *DB) updateDevice(block uint64, update func(prev *Device) map[string]any, query string, args ...any) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		prev, err := findDevice(tx, query, args...)
+		if err != nil || prev == nil || prev.appliedAfter(block) {
+			return err
+		}
+		if err := journal(tx, block, journalDevice, prev.ID, prev.chainState()); err != nil {
+			return err
+		}
+		values := update(prev)
+		values["chain_block"] = block
+		if err := tx.Model(&Device{}).Where("id = ?", prev.ID).Updates(values).Error; err != nil {
+			return err
+		}
+		if status, ok := values["status"].(int32); ok && status != prev.Status {
+			return createStatusChange(tx, prev, block, common.Hash{}, status, StatusReasonOwnerChanged)
+		}
+		return nil
+	})
+}
+
+// appliedAfter reports whether the device has been changed by a chain event of a block after block,
+// so replayed events of older blocks do not revert it
+func (t *Device) appliedAfter(block uint64) bool {
+	return t != nil && t.ChainBlock > block
+}
+
+func findDevice(tx *gorm.DB, query string, args ...any) (*Device, error) {
 	t := Device{}
-	if err := d.db.Where("id = ?", id).First(&t).Error; err != nil {
+	if err := tx.Where(query, args...).First(&t).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, nil
 		}
@@ -56,21 +204,113 @@ func (d *DB) Device(id string) (*Device, error) {
 	return &t, nil
 }
 
-func (d *DB) UpsertDevice(t *Device) error {
-	err := d.db.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "id"}},
-		DoUpdates: clause.AssignmentColumns([]string{"name", "nft_id", "owner", "address", "status", "proposer", "updated_at"}),
-	}).Create(t).Error
-	return errors.Wrap(err, "failed to upsert device")
+// UpdateByID updates the device in the primary db, a device only in the legacy db is copied first,
+// it returns an error if the device does not exist
+func (d *DB) UpdateByID(id string, values map[string]any) error {
+	if err := d.copyLegacyDevice(id); err != nil {
+		return err
+	}
+	res := d.db.Model(&Device{}).Where("id = ?", id).Updates(values)
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "failed to update device")
+	}
+	if res.RowsAffected == 0 {
+		return errors.Errorf("device %s not found", id)
+	}
+	return nil
 }
 
-func (d *DB) UpdateOwner(nftID *big.Int, owner common.Address) error {
-	values := map[string]any{"owner": owner.String()}
-	err := d.db.Model(&Device{}).Where("nft_id = ?", nftID.String()).Updates(values).Error
-	return errors.Wrap(err, "failed to update device owner")
+// copyLegacyDevice copies the device to the primary db if it is only in the legacy db, so the writes to it
+// are kept in the primary db, whose rows take precedence in reads
+func (d *DB) copyLegacyDevice(id string) error {
+	if d.oldDB == nil {
+		return nil
+	}
+	prev, err := findDevice(d.db, "id = ?", id)
+	if err != nil || prev != nil {
+		return err
+	}
+	t, err := findDevice(d.oldDB, "id = ?", id)
+	if err != nil || t == nil {
+		return err
+	}
+	if t.ProjectID == 0 {
+		t.ProjectID = d.defaultProject
+	}
+	err = d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(t).Error
+	return errors.Wrapf(err, "failed to copy legacy device %s", id)
 }
 
-func (d *DB) UpdateByID(id string, values map[string]any) error {
-	err := d.db.Model(&Device{}).Where("id = ?", id).Updates(values).Error
-	return errors.Wrap(err, "failed to update device")
+// DevicesOfOwner returns the devices owned by owner from all readers
+func (d *DB) DevicesOfOwner(owner common.Address) ([]*Device, error) {
+	return readMerged(d.readers(), func(t *Device) string { return t.ID }, func(db *gorm.DB) ([]*Device, error) {
+		ts := []*Device{}
+		if err := db.Where("owner = ?", owner.String()).Order("id ASC").Find(&ts).Error; err != nil {
+			return nil, errors.Wrap(err, "failed to query devices of owner")
+		}
+		for _, t := range ts {
+			if t.ProjectID == 0 {
+				t.ProjectID = d.defaultProject
+			}
+		}
+		return ts, nil
+	})
+}
+
+// RequireBindingHandshake makes the devices created or transferred afterwards wait for the binding handshake,
+// instead of being bound to the holder of their ioID nft. The devices already bound are kept.
+func (d *DB) RequireBindingHandshake() {
+	d.bindingHandshake = true
+}
+
+// AssignDefaultProject scopes the devices and apps created before rows had a project to the given project,
+// devices read from the legacy db are scoped to it as well
+func (d *DB) AssignDefaultProject(projectID uint64) error {
+	d.defaultProject = projectID
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Device{}).Where("project_id = 0").Update("project_id", projectID).Error; err != nil {
+			return err
+		}
+		if err := assignAppProject(tx, &App{}, projectID); err != nil {
+			return err
+		}
+		return assignAppProject(tx, &AppV2{}, projectID)
+	})
+	return errors.Wrap(err, "failed to assign default project")
+}
+
+// assignAppProject scopes the apps without a project to projectID. The project is part of the app primary
+// key, so an unscoped app is dropped if the project already has an app with its id, which is newer.
+func assignAppProject(tx *gorm.DB, model interface{ TableName() string }, projectID uint64) error {
+	name := model.TableName()
+	if err := tx.Where(fmt.Sprintf("project_id = 0 AND id IN (SELECT id FROM %s WHERE project_id = ?)", name), projectID).
+		Delete(model).Error; err != nil {
+		return errors.Wrapf(err, "failed to delete the replaced unscoped apps of %s", name)
+	}
+	err := tx.Model(model).Where("project_id = 0").Update("project_id", projectID).Error
+	return errors.Wrapf(err, "failed to assign the default project to %s", name)
+}
+
+// AdvanceLastTimestamp records ts as the last accepted package timestamp of the device, a device only in the
+// legacy db is copied to the primary db first. It reports false if a package with the same or a newer timestamp
+// has already been accepted, and returns an error if the device does not exist.
+func (d *DB) AdvanceLastTimestamp(id string, ts int64) (bool, error) {
+	if err := d.copyLegacyDevice(id); err != nil {
+		return false, err
+	}
+	res := d.db.Model(&Device{}).Where("id = ? AND last_timestamp < ?", id, ts).Update("last_timestamp", ts)
+	if res.Error != nil {
+		return false, errors.Wrap(res.Error, "failed to update device last timestamp")
+	}
+	if res.RowsAffected == 1 {
+		return true, nil
+	}
+	t, err := findDevice(d.db, "id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	if t == nil {
+		return false, errors.Errorf("device %s not found", id)
+	}
+	return false, nil
 }
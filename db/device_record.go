@@ -2,7 +2,10 @@ package db
 
 import (
 	"fmt"
-	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 	"gorm.io/gorm"
@@ -25,6 +28,7 @@ type DeviceRecord struct {
 	Latitude      string `gorm:"not null;default:0"`
 	Longitude     string `gorm:"not null;default:0"`
 	Signature     string `gorm:"not null;default:''"`
+	Verified      bool   `gorm:"not null;default:false"`
 	Timestamp     int64  `gorm:"index:device_record_timestamp;not null;default:0"`
 
 	OperationTimes
@@ -32,46 +36,428 @@ type DeviceRecord struct {
 
 func (*DeviceRecord) TableName() string { return "device_record" }
 
-func (d *DB) QueryDeviceRecord(latitude, longitude string) (*DeviceRecord, error) {
-	sql := `SELECT device_record_id FROM device_record_geo_locations 
-              WHERE ST_DWithin(
-              geom,
-              ST_MakePoint(%s, %s)::geography,
-              5000
-            );`
+// InvalidCoordinateError is returned when a geo query is made with a coordinate out of range
+type InvalidCoordinateError struct {
+	Latitude  float64
+	Longitude float64
+}
+
+func (e *InvalidCoordinateError) Error() string {
+	return fmt.Sprintf("invalid coordinate, latitude %v, longitude %v", e.Latitude, e.Longitude)
+}
+
+func validateCoordinate(latitude, longitude float64) error {
+	if math.IsNaN(latitude) || math.IsNaN(longitude) ||
+		latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return &InvalidCoordinateError{Latitude: latitude, Longitude: longitude}
+	}
+	return nil
+}
+
+const queryDeviceRecordGeoSQL = `SELECT device_record_id FROM device_record_geo_locations
+	WHERE ST_DWithin(
+		geom,
+		ST_MakePoint(?, ?)::geography,
+		?
+	);`
 
+func queryDeviceRecord(db *gorm.DB, latitude, longitude, radius float64) (*DeviceRecord, error) {
 	ids := []string{}
-	if err := d.db.Raw(fmt.Sprintf(sql, longitude, latitude)).Scan(&ids).Error; err != nil {
+	if err := db.Raw(queryDeviceRecordGeoSQL, longitude, latitude, radius).Scan(&ids).Error; err != nil {
 		return nil, errors.Wrap(err, "failed to query device record geo data")
 	}
-	if len(ids) != 0 {
-		t := &DeviceRecord{}
-		if err := d.db.Where("id IN ?", ids).Order("timestamp DESC").First(&t).Error; err != nil {
-			if err == gorm.ErrRecordNotFound {
-				return nil, nil
-			}
-			return nil, errors.Wrap(err, "failed to query device record")
-		}
-		return t, nil
-	}
-	oldIDs := []string{}
-	if err := d.oldDB.Raw(fmt.Sprintf(sql, longitude, latitude)).Scan(&oldIDs).Error; err != nil {
-		return nil, errors.Wrap(err, "failed to query device record geo data from old db")
-	}
-	slog.Info("old ids", "oldIDs", oldIDs)
-	if len(oldIDs) == 0 {
+	if len(ids) == 0 {
 		return nil, nil
 	}
 	t := &DeviceRecord{}
-	if err := d.oldDB.Where("id IN ?", oldIDs).Order("timestamp DESC").First(&t).Error; err != nil {
+	if err := db.Where("id IN ?", ids).Order("timestamp DESC").First(&t).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, nil
 		}
-		return nil, errors.Wrap(err, "failed to query device record from old db")
+		return nil, errors.Wrap(err, "failed to query device record")
 	}
 	return t, nil
 }
 
+// QueryDeviceRecord returns the newest device record within radius meters of the coordinate
+func (d *DB) QueryDeviceRecord(latitude, longitude, radius float64) (*DeviceRecord, error) {
+	if err := validateCoordinate(latitude, longitude); err != nil {
+		return nil, err
+	}
+	if math.IsNaN(radius) || radius <= 0 {
+		return nil, errors.Errorf("invalid query radius %v", radius)
+	}
+
+	ts, err := readMerged(d.recordReaders(), func(t *DeviceRecord) string { return t.ID }, func(db *gorm.DB) ([]*DeviceRecord, error) {
+		t, err := queryDeviceRecord(db, latitude, longitude, radius)
+		if err != nil || t == nil {
+			return nil, err
+		}
+		return []*DeviceRecord{t}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var newest *DeviceRecord
+	for _, t := range ts {
+		if newest == nil || t.Timestamp > newest.Timestamp {
+			newest = t
+		}
+	}
+	return newest, nil
+}
+
+type GeoQueryMode string
+
+const (
+	GeoQueryRadius  GeoQueryMode = "radius"
+	GeoQueryNearest GeoQueryMode = "nearest"
+	GeoQueryBBox    GeoQueryMode = "bbox"
+)
+
+// DeviceRecordQuery queries the latest record of each device around a coordinate or inside a bounding box.
+// Latitude and Longitude are the reference point of GeoQueryNearest, and distances of GeoQueryBBox
+// results are measured from the center of the box. Only devices with a record since the unix timestamp
+// Since are returned, which bounds the scan of the latest records.
+type DeviceRecordQuery struct {
+	Mode         GeoQueryMode
+	Since        int64
+	Latitude     float64
+	Longitude    float64
+	MinLatitude  float64
+	MinLongitude float64
+	MaxLatitude  float64
+	MaxLongitude float64
+	Offset       int
+	Limit        int
+}
+
+// DeviceRecordWithDistance is a device record with its distance in meters to the query point
+type DeviceRecordWithDistance struct {
+	DeviceRecord
+	Distance float64 `gorm:"column:distance"`
+}
+
+const queryNearestDeviceRecordsSQL = `SELECT r.*, ST_Distance(g.geom::geography, ST_MakePoint(?, ?)::geography) AS distance
+	FROM (SELECT DISTINCT ON (imei) * FROM device_record WHERE timestamp >= ? ORDER BY imei, timestamp DESC) r
+	JOIN device_record_geo_locations g ON g.device_record_id = r.id
+	ORDER BY distance ASC, r.imei ASC
+	OFFSET ? LIMIT ?;`
+
+const queryBBoxDeviceRecordsSQL = `SELECT r.*, ST_Distance(g.geom::geography, ST_MakePoint(?, ?)::geography) AS distance
+	FROM (SELECT DISTINCT ON (imei) * FROM device_record WHERE timestamp >= ? ORDER BY imei, timestamp DESC) r
+	JOIN device_record_geo_locations g ON g.device_record_id = r.id
+	WHERE ST_Intersects(g.geom::geometry, ST_MakeEnvelope(?, ?, ?, ?, 4326))
+	ORDER BY distance ASC, r.imei ASC
+	OFFSET ? LIMIT ?;`
+
+func (d *DB) QueryDeviceRecords(q *DeviceRecordQuery) ([]*DeviceRecordWithDistance, error) {
+	if q.Limit <= 0 || q.Offset < 0 {
+		return nil, errors.Errorf("invalid pagination, offset %d, limit %d", q.Offset, q.Limit)
+	}
+	if q.Since <= 0 {
+		return nil, errors.Errorf("invalid since %d", q.Since)
+	}
+
+	var (
+		sql  string
+		args []any
+	)
+	switch q.Mode {
+	case GeoQueryNearest:
+		if err := validateCoordinate(q.Latitude, q.Longitude); err != nil {
+			return nil, err
+		}
+		sql = queryNearestDeviceRecordsSQL
+		args = []any{q.Longitude, q.Latitude, q.Since}
+	case GeoQueryBBox:
+		if err := validateCoordinate(q.MinLatitude, q.MinLongitude); err != nil {
+			return nil, err
+		}
+		if err := validateCoordinate(q.MaxLatitude, q.MaxLongitude); err != nil {
+			return nil, err
+		}
+		if q.MinLatitude > q.MaxLatitude || q.MinLongitude > q.MaxLongitude {
+			return nil, &InvalidCoordinateError{Latitude: q.MinLatitude, Longitude: q.MinLongitude}
+		}
+		centerLat := (q.MinLatitude + q.MaxLatitude) / 2
+		centerLon := (q.MinLongitude + q.MaxLongitude) / 2
+		sql = queryBBoxDeviceRecordsSQL
+		args = []any{centerLon, centerLat, q.Since, q.MinLongitude, q.MinLatitude, q.MaxLongitude, q.MaxLatitude}
+	default:
+		return nil, errors.Errorf("unsupported geo query mode %s", q.Mode)
+	}
+	// every source returns its first offset+limit rows, the page is cut after merging
+	args = append(args, 0, q.Offset+q.Limit)
+
+	ts, err := readMerged(d.recordReaders(), func(t *DeviceRecordWithDistance) string { return t.Imei }, func(db *gorm.DB) ([]*DeviceRecordWithDistance, error) {
+		ts := []*DeviceRecordWithDistance{}
+		err := db.Raw(sql, args...).Scan(&ts).Error
+		return ts, errors.Wrapf(err, "failed to query device records, mode %s", q.Mode)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ts, func(i, j int) bool {
+		if ts[i].Distance != ts[j].Distance {
+			return ts[i].Distance < ts[j].Distance
+		}
+		return ts[i].Imei < ts[j].Imei
+	})
+	return paginate(ts, q.Offset, q.Limit), nil
+}
+
+// DeviceRecordFields maps the selectable reading fields to device_record columns
+var DeviceRecordFields = map[string]string{
+	"snr":           "snr",
+	"vbat":          "vbat",
+	"gasResistance": "gas_resistance",
+	"temperature":   "temperature",
+	"temperature2":  "temperature2",
+	"pressure":      "pressure",
+	"humidity":      "humidity",
+	"light":         "light",
+	"gyroscope":     "gyroscope",
+	"accelerometer": "accelerometer",
+	"latitude":      "latitude",
+	"longitude":     "longitude",
+}
+
+// Field returns the reading of the given DeviceRecordFields field
+func (d *DeviceRecord) Field(field string) string {
+	switch field {
+	case "snr":
+		return d.Snr
+	case "vbat":
+		return d.Vbat
+	case "gasResistance":
+		return d.GasResistance
+	case "temperature":
+		return d.Temperature
+	case "temperature2":
+		return d.Temperature2
+	case "pressure":
+		return d.Pressure
+	case "humidity":
+		return d.Humidity
+	case "light":
+		return d.Light
+	case "gyroscope":
+		return d.Gyroscope
+	case "accelerometer":
+		return d.Accelerometer
+	case "latitude":
+		return d.Latitude
+	case "longitude":
+		return d.Longitude
+	}
+	return ""
+}
+
+// aggregatableFields are the numeric reading fields which can be downsampled
+var aggregatableFields = map[string]bool{
+	"snr":           true,
+	"vbat":          true,
+	"gasResistance": true,
+	"temperature":   true,
+	"temperature2":  true,
+	"pressure":      true,
+	"humidity":      true,
+	"light":         true,
+}
+
+// DeviceRecordHistoryQuery queries the records of a device with timestamp in [From, To)
+type DeviceRecordHistoryQuery struct {
+	Imei   string
+	From   int64
+	To     int64
+	Fields []string
+	Offset int
+	Limit  int
+}
+
+func (q *DeviceRecordHistoryQuery) validate() error {
+	if q.Imei == "" {
+		return errors.New("empty device id")
+	}
+	if q.From >= q.To {
+		return errors.Errorf("invalid time range, from %d, to %d", q.From, q.To)
+	}
+	if q.Limit <= 0 || q.Offset < 0 {
+		return errors.Errorf("invalid pagination, offset %d, limit %d", q.Offset, q.Limit)
+	}
+	if len(q.Fields) == 0 {
+		return errors.New("empty fields")
+	}
+	for _, f := range q.Fields {
+		if _, ok := DeviceRecordFields[f]; !ok {
+			return errors.Errorf("unsupported field %s", f)
+		}
+	}
+	return nil
+}
+
+// DeviceRecordHistory returns the device records ordered by timestamp, only timestamp, verified and the selected
+// fields are filled
+func (d *DB) DeviceRecordHistory(q *DeviceRecordHistoryQuery) ([]*DeviceRecord, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	columns := []string{"timestamp", "verified"}
+	for _, f := range q.Fields {
+		columns = append(columns, DeviceRecordFields[f])
+	}
+
+	ts, err := readMerged(d.recordReaders(), func(t *DeviceRecord) string { return strconv.FormatInt(t.Timestamp, 10) }, func(db *gorm.DB) ([]*DeviceRecord, error) {
+		ts := []*DeviceRecord{}
+		err := db.Select(columns).
+			Where("imei = ? AND timestamp >= ? AND timestamp < ?", strings.ToLower(q.Imei), q.From, q.To).
+			Order("timestamp ASC").Limit(q.Offset + q.Limit).
+			Find(&ts).Error
+		return ts, errors.Wrap(err, "failed to query device record history")
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ts, func(i, j int) bool { return ts[i].Timestamp < ts[j].Timestamp })
+	return paginate(ts, q.Offset, q.Limit), nil
+}
+
+type FieldStats struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+}
+
+// DeviceRecordBucket is the aggregation of the device records with timestamp in [Start, Start+interval),
+// Verified is the number of records with a verified package signature
+type DeviceRecordBucket struct {
+	Start    int64
+	Count    int64
+	Verified int64
+	Fields   map[string]*FieldStats
+}
+
+// DownsampleDeviceRecord aggregates the device records into buckets of interval seconds ordered by bucket start
+func (d *DB) DownsampleDeviceRecord(q *DeviceRecordHistoryQuery, interval int64) ([]*DeviceRecordBucket, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, errors.Errorf("invalid downsample interval %d", interval)
+	}
+
+	for _, f := range q.Fields {
+		if !aggregatableFields[f] {
+			return nil, errors.Errorf("field %s can not be downsampled", f)
+		}
+	}
+
+	rs := d.recordReaders()
+	if len(rs) == 1 {
+		bs, err := downsampleDeviceRecord(rs[0].db, q, interval)
+		return bs, errors.Wrapf(err, "failed to downsample device record from %s db", rs[0].name)
+	}
+
+	// a record migrated to the primary db is also in the legacy db, so the records of all dbs are
+	// de-duplicated by id before they are aggregated
+	columns := []string{"id", "timestamp", "verified"}
+	for _, f := range q.Fields {
+		columns = append(columns, DeviceRecordFields[f])
+	}
+	ts, err := readMerged(rs, func(t *DeviceRecord) string { return t.ID }, func(db *gorm.DB) ([]*DeviceRecord, error) {
+		ts := []*DeviceRecord{}
+		err := db.Select(columns).
+			Where("imei = ? AND timestamp >= ? AND timestamp < ?", strings.ToLower(q.Imei), q.From, q.To).
+			Find(&ts).Error
+		return ts, errors.Wrap(err, "failed to query device records")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := map[int64]*DeviceRecordBucket{}
+	sums := map[int64]map[string]float64{}
+	for _, t := range ts {
+		start := t.Timestamp / interval * interval
+		b, ok := buckets[start]
+		if !ok {
+			b = &DeviceRecordBucket{Start: start, Fields: make(map[string]*FieldStats, len(q.Fields))}
+			buckets[start] = b
+			sums[start] = make(map[string]float64, len(q.Fields))
+		}
+		b.Count++
+		if t.Verified {
+			b.Verified++
+		}
+		for _, f := range q.Fields {
+			v, err := strconv.ParseFloat(t.Field(f), 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid %s of device record %s", f, t.ID)
+			}
+			if fs, ok := b.Fields[f]; ok {
+				fs.Min, fs.Max = math.Min(fs.Min, v), math.Max(fs.Max, v)
+			} else {
+				b.Fields[f] = &FieldStats{Min: v, Max: v}
+			}
+			sums[start][f] += v
+		}
+	}
+
+	bs := make([]*DeviceRecordBucket, 0, len(buckets))
+	for start, b := range buckets {
+		for f, fs := range b.Fields {
+			fs.Avg = sums[start][f] / float64(b.Count)
+		}
+		bs = append(bs, b)
+	}
+	sort.Slice(bs, func(i, j int) bool { return bs[i].Start < bs[j].Start })
+	return paginate(bs, q.Offset, q.Limit), nil
+}
+
+// downsampleDeviceRecord aggregates the device records of a single db in sql
+func downsampleDeviceRecord(db *gorm.DB, q *DeviceRecordHistoryQuery, interval int64) ([]*DeviceRecordBucket, error) {
+	selects := []string{"(timestamp / ?) * ? AS bucket", "COUNT(*) AS count",
+		"SUM(CASE WHEN verified THEN 1 ELSE 0 END) AS verified"}
+	for _, f := range q.Fields {
+		c := DeviceRecordFields[f]
+		selects = append(selects,
+			fmt.Sprintf("CAST(MIN(%s) AS DOUBLE PRECISION) AS %s_min", c, c),
+			fmt.Sprintf("CAST(MAX(%s) AS DOUBLE PRECISION) AS %s_max", c, c),
+			fmt.Sprintf("CAST(AVG(%s) AS DOUBLE PRECISION) AS %s_avg", c, c),
+		)
+	}
+	sql := fmt.Sprintf(`SELECT %s FROM device_record
+	WHERE imei = ? AND timestamp >= ? AND timestamp < ?
+	GROUP BY bucket ORDER BY bucket ASC
+	LIMIT ? OFFSET ?;`, strings.Join(selects, ", "))
+
+	rows := []map[string]any{}
+	if err := db.Raw(sql, interval, interval, strings.ToLower(q.Imei), q.From, q.To, q.Limit, q.Offset).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	bs := make([]*DeviceRecordBucket, 0, len(rows))
+	for _, r := range rows {
+		b := &DeviceRecordBucket{
+			Start:    toInt64(r["bucket"]),
+			Count:    toInt64(r["count"]),
+			Verified: toInt64(r["verified"]),
+			Fields:   make(map[string]*FieldStats, len(q.Fields)),
+		}
+		for _, f := range q.Fields {
+			c := DeviceRecordFields[f]
+			b.Fields[f] = &FieldStats{
+				Min: toFloat64(r[c+"_min"]),
+				Max: toFloat64(r[c+"_max"]),
+				Avg: toFloat64(r[c+"_avg"]),
+			}
+		}
+		bs = append(bs, b)
+	}
+	return bs, nil
+}
+
 func (d *DB) CreateDeviceRecord(t *DeviceRecord) error {
 	err := d.db.Create(t).Error
 	return errors.Wrap(err, "failed to create device record")
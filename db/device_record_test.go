@@ -0,0 +1,190 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func newTestRecordDB(t *testing.T, legacy bool) *DB {
+	d := newTestDB(t)
+	dbs := []*gorm.DB{d.db}
+	if legacy {
+		d.oldDB = openTestDB(t, "legacy")
+		dbs = append(dbs, d.oldDB)
+	}
+	for _, db := range dbs {
+		if err := db.AutoMigrate(&DeviceRecord{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d
+}
+
+func createTestRecord(t *testing.T, db *gorm.DB, id string, ts int64, temperature string, verified bool) {
+	if err := db.Create(&DeviceRecord{
+		ID: id, Imei: "imei", Operator: "op", Timestamp: ts, Temperature: temperature, Verified: verified,
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownsampleDeduplicatesMigratedRecords(t *testing.T) {
+	d := newTestRecordDB(t, true)
+
+	// r1 is migrated, so it is in both dbs
+	createTestRecord(t, d.db, "r1", 10, "20", true)
+	createTestRecord(t, d.oldDB, "r1", 10, "20", true)
+	createTestRecord(t, d.oldDB, "r2", 20, "30", false)
+	createTestRecord(t, d.db, "r3", 70, "40", true)
+
+	bs, err := d.DownsampleDeviceRecord(&DeviceRecordHistoryQuery{
+		Imei: "imei", From: 0, To: 120, Fields: []string{"temperature"}, Limit: 10,
+	}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(bs))
+	}
+	if b := bs[0]; b.Start != 0 || b.Count != 2 || b.Verified != 1 {
+		t.Fatalf("the migrated record is counted twice: %+v", b)
+	}
+	if fs := bs[0].Fields["temperature"]; fs.Min != 20 || fs.Max != 30 || fs.Avg != 25 {
+		t.Fatalf("unexpected temperature stats %+v", fs)
+	}
+	if b := bs[1]; b.Start != 60 || b.Count != 1 || b.Fields["temperature"].Avg != 40 {
+		t.Fatalf("unexpected second bucket %+v", b)
+	}
+}
+
+func TestDownsampleDeviceRecord(t *testing.T) {
+	for _, split := range []bool{false, true} {
+		t.Run(fmt.Sprintf("split=%t", split), func(t *testing.T) {
+			testDownsampleDeviceRecord(t, split)
+		})
+	}
+}
+
+func testDownsampleDeviceRecord(t *testing.T, split bool) {
+	{
+		d := newTestRecordDB(t, split)
+		for i, r := range []struct {
+			ts          int64
+			temperature string
+			verified    bool
+		}{
+			{0, "20", true}, {30, "22", false}, {59, "24", true},
+			// no records in [60, 120)
+			{130, "30", true},
+			// out of the queried range
+			{240, "99", true},
+		} {
+			// the records are split between the dbs, so both the sql and the merged aggregation are covered
+			db := d.db
+			if split && i%2 == 1 {
+				db = d.oldDB
+			}
+			createTestRecord(t, db, fmt.Sprintf("r%d", i), r.ts, r.temperature, r.verified)
+		}
+		q := &DeviceRecordHistoryQuery{Imei: "imei", From: 0, To: 180, Fields: []string{"temperature"}, Limit: 10}
+
+		bs, err := d.DownsampleDeviceRecord(q, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bs) != 2 {
+			t.Fatalf("split %t: expected the empty bucket to be omitted, got %d buckets", split, len(bs))
+		}
+		if b := bs[0]; b.Start != 0 || b.Count != 3 || b.Verified != 2 {
+			t.Errorf("split %t: unexpected first bucket %+v", split, b)
+		}
+		if fs := bs[0].Fields["temperature"]; fs.Min != 20 || fs.Max != 24 || fs.Avg != 22 {
+			t.Errorf("split %t: unexpected temperature stats %+v", split, fs)
+		}
+		if b := bs[1]; b.Start != 120 || b.Count != 1 || b.Fields["temperature"].Max != 30 {
+			t.Errorf("split %t: unexpected second bucket %+v", split, b)
+		}
+
+		q.Offset, q.Limit = 1, 1
+		if bs, err = d.DownsampleDeviceRecord(q, 60); err != nil {
+			t.Fatal(err)
+		}
+		if len(bs) != 1 || bs[0].Start != 120 {
+			t.Errorf("split %t: unexpected paginated buckets %+v", split, bs)
+		}
+
+		q.From, q.To, q.Offset, q.Limit = 300, 400, 0, 10
+		if bs, err = d.DownsampleDeviceRecord(q, 60); err != nil || len(bs) != 0 {
+			t.Errorf("split %t: expected no buckets of an empty range, got %v %v", split, bs, err)
+		}
+	}
+}
+
+func TestDownsampleDeviceRecordValidation(t *testing.T) {
+	d := newTestRecordDB(t, false)
+	valid := func() *DeviceRecordHistoryQuery {
+		return &DeviceRecordHistoryQuery{Imei: "imei", From: 0, To: 100, Fields: []string{"temperature"}, Limit: 10}
+	}
+	cases := map[string]struct {
+		modify   func(q *DeviceRecordHistoryQuery)
+		interval int64
+	}{
+		"zero interval":     {func(*DeviceRecordHistoryQuery) {}, 0},
+		"negative interval": {func(*DeviceRecordHistoryQuery) {}, -60},
+		"empty range":       {func(q *DeviceRecordHistoryQuery) { q.From = q.To }, 60},
+		"text field":        {func(q *DeviceRecordHistoryQuery) { q.Fields = []string{"gyroscope"} }, 60},
+		"unknown field":     {func(q *DeviceRecordHistoryQuery) { q.Fields = []string{"imei"} }, 60},
+		"no limit":          {func(q *DeviceRecordHistoryQuery) { q.Limit = 0 }, 60},
+	}
+	for name, c := range cases {
+		q := valid()
+		c.modify(q)
+		if _, err := d.DownsampleDeviceRecord(q, c.interval); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestDeviceRecordHistory(t *testing.T) {
+	d := newTestRecordDB(t, true)
+	createTestRecord(t, d.db, "r1", 10, "20", true)
+	createTestRecord(t, d.oldDB, "r2", 20, "21", false)
+	// the migrated record is read once
+	createTestRecord(t, d.db, "r3", 30, "22", true)
+	createTestRecord(t, d.oldDB, "r3", 30, "22", true)
+	createTestRecord(t, d.db, "r4", 100, "23", true)
+
+	rs, err := d.DeviceRecordHistory(&DeviceRecordHistoryQuery{
+		Imei: "imei", From: 10, To: 100, Fields: []string{"temperature"}, Limit: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 3 {
+		t.Fatalf("expected 3 records in [10, 100), got %d", len(rs))
+	}
+	for i, want := range []struct {
+		ts       int64
+		verified bool
+	}{{10, true}, {20, false}, {30, true}} {
+		r := rs[i]
+		if r.Timestamp != want.ts || r.Verified != want.verified {
+			t.Errorf("record %d: got timestamp %d verified %t, want %d %t", i, r.Timestamp, r.Verified, want.ts, want.verified)
+		}
+		if r.Temperature == "" || r.ID != "" || r.Imei != "" {
+			t.Errorf("record %d: only the selected columns are expected, got %+v", i, r)
+		}
+	}
+
+	rs, err = d.DeviceRecordHistory(&DeviceRecordHistoryQuery{
+		Imei: "imei", From: 0, To: 200, Fields: []string{"temperature"}, Offset: 2, Limit: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || rs[0].Timestamp != 30 {
+		t.Fatalf("unexpected paginated records %+v", rs)
+	}
+}
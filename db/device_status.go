@@ -0,0 +1,167 @@
+package db
+
+import (
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	StatusReasonRegistryRemoved = "registry_removed"
+	StatusReasonIoIDBurned      = "ioid_burned"
+	StatusReasonWalletRemoved   = "did_wallet_removed"
+	StatusReasonProposed        = "binding_proposed"
+	StatusReasonConfirmed       = "binding_confirmed"
+	StatusReasonOwnerChanged    = "owner_changed"
+)
+
+// DeviceStatusChange is the audit trail of the device status changes caused by chain events
+type DeviceStatusChange struct {
+	ID          uint64 `gorm:"primary_key"`
+	DeviceID    string `gorm:"index:device_status_change_device_id;not null"`
+	BlockNumber uint64 `gorm:"index:device_status_change_block_number;not null"`
+	TxHash      string `gorm:"not null;default:''"`
+	PrevStatus  int32  `gorm:"not null;default:0"`
+	Status      int32  `gorm:"not null;default:0"`
+	Reason      string `gorm:"not null;default:''"`
+
+	OperationTimes
+}
+
+func (*DeviceStatusChange) TableName() string { return "device_status_change" }
+
+// RemoveDevice marks the device removed from the ioID registry, the row is kept for its records
+func (d *DB) RemoveDevice(block uint64, txHash common.Hash, id string) error {
+	err := d.changeDeviceStatus(block, txHash, REMOVED, StatusReasonRegistryRemoved, "id = ?", strings.ToLower(id))
+	return errors.Wrap(err, "failed to remove device")
+}
+
+// DeactivateDevice deactivates the device whose did wallet has been removed
+func (d *DB) DeactivateDevice(block uint64, txHash common.Hash, id string, reason string) error {
+	err := d.changeDeviceStatus(block, txHash, DEACTIVATED, reason, "id = ?", strings.ToLower(id))
+	return errors.Wrap(err, "failed to deactivate device")
+}
+
+// DeactivateDeviceByNFT deactivates the device whose ioID nft has been burned
+func (d *DB) DeactivateDeviceByNFT(block uint64, txHash common.Hash, nftID *big.Int, reason string) error {
+	err := d.changeDeviceStatus(block, txHash, DEACTIVATED, reason, "nft_id = ?", nftID.String())
+	return errors.Wrap(err, "failed to deactivate device")
+}
+
+// changeDeviceStatus journals the device, updates its status and records the change, it does nothing if
+// the device does not exist, already has the status or has been changed by an event of a later block
+func (d *DB) changeDeviceStatus(block uint64, txHash common.Hash, status int32, reason string, query string, args ...any) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		prev, err := findDevice(tx, query, args...)
+		if err != nil || prev == nil || prev.Status == status || prev.appliedAfter(block) {
+			return err
+		}
+		if err := journal(tx, block, journalDevice, prev.ID, prev.chainState()); err != nil {
+			return err
+		}
+		if err := tx.Model(&Device{}).Where("id = ?", prev.ID).Updates(map[string]any{
+			"status":      status,
+			"chain_block": block,
+		}).Error; err != nil {
+			return err
+		}
+		return createStatusChange(tx, prev, block, txHash, status, reason)
+	})
+}
+
+// createStatusChange records the status change of the device caused by a chain event of block
+func createStatusChange(tx *gorm.DB, prev *Device, block uint64, txHash common.Hash, status int32, reason string) error {
+	err := tx.Create(&DeviceStatusChange{
+		DeviceID:       prev.ID,
+		BlockNumber:    block,
+		TxHash:         txHash.Hex(),
+		PrevStatus:     prev.Status,
+		Status:         status,
+		Reason:         reason,
+		OperationTimes: NewOperationTimes(),
+	}).Error
+	return errors.Wrapf(err, "failed to create status change of device %s", prev.ID)
+}
+
+// rollbackDeviceStatus reverts the status changes caused by the chain events of the blocks after ancestor,
+// newest first. A change is only reverted if the device still has the status set by it, so a binding
+// handshake made after the chain event is kept. A device reverted to a binding status is bound to its owner,
+// which is restored from the chain journal before.
+func rollbackDeviceStatus(tx *gorm.DB, ancestor uint64) error {
+	cs := []*DeviceStatusChange{}
+	if err := tx.Where("block_number > ?", ancestor).Order("id DESC").Find(&cs).Error; err != nil {
+		return errors.Wrap(err, "failed to query rolled back device status changes")
+	}
+	for _, c := range cs {
+		values := map[string]any{"status": c.PrevStatus}
+		if c.PrevStatus == PROPOSAL || c.PrevStatus == CONFIRM {
+			values["proposer"] = gorm.Expr("owner")
+		}
+		if err := tx.Model(&Device{}).Where("id = ? AND status = ?", c.DeviceID, c.Status).Updates(values).Error; err != nil {
+			return errors.Wrapf(err, "failed to revert status of device %s", c.DeviceID)
+		}
+	}
+	err := tx.Where("block_number > ?", ancestor).Delete(&DeviceStatusChange{}).Error
+	return errors.Wrap(err, "failed to delete rolled back device status changes")
+}
+
+// ProposeDevice records the proposal of the binding handshake. A device is bound to the holder of its ioID
+// nft, so only the owner can propose, and a removed or deactivated device can not be proposed, it reports
+// false otherwise. A bound device can be proposed again to rebind it, e.g. on another data channel.
+func (d *DB) ProposeDevice(id string, proposer common.Address) (bool, error) {
+	id = strings.ToLower(id)
+	values := map[string]any{"proposer": proposer.String()}
+	ok, err := d.transitDeviceStatus(id, PROPOSAL, StatusReasonProposed, values,
+		"id = ? AND owner = ? AND status IN ?", id, proposer.String(), []int32{CREATED, PROPOSAL, CONFIRM})
+	return ok, errors.Wrap(err, "failed to propose device")
+}
+
+// ConfirmDevice completes the binding handshake once the device confirmed the proposal of owner on the
+// given data channel, it reports false if owner is not the pending proposer or no longer owns the device
+func (d *DB) ConfirmDevice(id string, owner common.Address, channel uint32) (bool, error) {
+	id = strings.ToLower(id)
+	values := map[string]any{"data_channel": int32(channel)}
+	ok, err := d.transitDeviceStatus(id, CONFIRM, StatusReasonConfirmed, values,
+		"id = ? AND status = ? AND proposer = ? AND owner = ?", id, PROPOSAL, owner.String(), owner.String())
+	return ok, errors.Wrap(err, "failed to confirm device")
+}
+
+// transitDeviceStatus updates the status and values of the device id matched by query and records the change,
+// these changes are not caused by chain events so they are not journaled
+func (d *DB) transitDeviceStatus(id string, status int32, reason string, values map[string]any, query string, args ...any) (bool, error) {
+	if err := d.copyLegacyDevice(id); err != nil {
+		return false, err
+	}
+	var ok bool
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		prev, err := findDevice(tx.Clauses(clause.Locking{Strength: "UPDATE"}), query, args...)
+		if err != nil || prev == nil {
+			return err
+		}
+		values["status"] = status
+		values["updated_at"] = time.Now()
+		if err := tx.Model(&Device{}).Where("id = ?", prev.ID).Updates(values).Error; err != nil {
+			return err
+		}
+		ok = true
+		return tx.Create(&DeviceStatusChange{
+			DeviceID:       prev.ID,
+			PrevStatus:     prev.Status,
+			Status:         status,
+			Reason:         reason,
+			OperationTimes: NewOperationTimes(),
+		}).Error
+	})
+	return ok, err
+}
+
+func (d *DB) DeviceStatusChanges(id string) ([]*DeviceStatusChange, error) {
+	ts := []*DeviceStatusChange{}
+	err := d.db.Where("device_id = ?", strings.ToLower(id)).Order("block_number DESC, id DESC").Find(&ts).Error
+	return ts, errors.Wrap(err, "failed to query device status changes")
+}
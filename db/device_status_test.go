@@ -0,0 +1,136 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestBindingHandshake(t *testing.T) {
+	d := newTestDB(t)
+	d.RequireBindingHandshake()
+	owner := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	other := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	created := func() *Device {
+		return &Device{
+			ID:             "0xabc",
+			NFTID:          "1",
+			Name:           "did:io:0xabc",
+			Owner:          owner.String(),
+			OperationTimes: NewOperationTimes(),
+		}
+	}
+	status := func() *Device {
+		t.Helper()
+		got, err := d.Device("0xabc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	if err := d.UpsertDevice(10, created()); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got.Status != CREATED {
+		t.Fatalf("created device has status %d", got.Status)
+	}
+
+	if ok, err := d.ProposeDevice("0xabc", other); err != nil || ok {
+		t.Fatalf("proposal of an address which does not own the device is accepted: %v %v", ok, err)
+	}
+	if ok, err := d.ProposeDevice("0xabc", owner); err != nil || !ok {
+		t.Fatalf("failed to propose device: %v %v", ok, err)
+	}
+	if ok, err := d.ConfirmDevice("0xabc", owner, 3); err != nil || !ok {
+		t.Fatalf("failed to confirm device: %v %v", ok, err)
+	}
+	if got := status(); got.Status != CONFIRM || got.Owner != owner.String() || got.DataChannel != 3 {
+		t.Fatalf("unexpected confirmed device: status %d, owner %s, channel %d", got.Status, got.Owner, got.DataChannel)
+	}
+
+	// later chain events of the same nft and owner keep the handshake
+	if err := d.UpsertDevice(20, created()); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got.Status != CONFIRM || got.Proposer != owner.String() {
+		t.Fatalf("chain event overwrote the handshake: status %d, proposer %s", got.Status, got.Proposer)
+	}
+
+	// a transfer of the ioID nft resets the handshake
+	if err := d.UpdateOwner(30, common.Big1, other); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got.Status != CREATED || got.Owner != other.String() || got.Proposer != "" {
+		t.Fatalf("transfer did not reset the handshake: status %d, owner %s, proposer %s", got.Status, got.Owner, got.Proposer)
+	}
+	if ok, err := d.ProposeDevice("0xabc", owner); err != nil || ok {
+		t.Fatalf("proposal of the previous owner is accepted: %v %v", ok, err)
+	}
+}
+
+func TestDevicesAreBoundToOwnerWithoutHandshake(t *testing.T) {
+	d := newTestDB(t)
+	owner := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	other := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	status := func(id string) *Device {
+		t.Helper()
+		got, err := d.Device(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	// a device confirmed before the binding handshake has no proposer
+	if err := d.db.Create(&Device{
+		ID:             "0xabc",
+		NFTID:          "1",
+		Owner:          owner.String(),
+		Status:         CONFIRM,
+		ChainBlock:     5,
+		OperationTimes: NewOperationTimes(),
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	// re-indexing its ioID keeps it confirmed, even if the handshake is required afterwards
+	for i, handshake := range []bool{false, true} {
+		d.bindingHandshake = handshake
+		if err := d.UpsertDevice(uint64(10+i), &Device{
+			ID: "0xabc", NFTID: "1", Owner: owner.String(), OperationTimes: NewOperationTimes(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if got := status("0xabc"); got.Status != CONFIRM {
+			t.Fatalf("re-indexed device is unbound, handshake %t: status %d", handshake, got.Status)
+		}
+	}
+	d.bindingHandshake = false
+
+	// a new device is bound to its owner, as is the new owner after a transfer
+	if err := d.UpsertDevice(20, &Device{
+		ID: "0xdef", NFTID: "2", Owner: owner.String(), OperationTimes: NewOperationTimes(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := status("0xdef"); got.Status != CONFIRM || got.Proposer != owner.String() {
+		t.Fatalf("new device is not bound to its owner: status %d, proposer %s", got.Status, got.Proposer)
+	}
+	if err := d.UpdateOwner(30, common.Big2, other); err != nil {
+		t.Fatal(err)
+	}
+	if got := status("0xdef"); got.Status != CONFIRM || got.Owner != other.String() {
+		t.Fatalf("transferred device is unbound: status %d, owner %s", got.Status, got.Owner)
+	}
+
+	// the owner can still rebind the device with the handshake
+	if ok, err := d.ProposeDevice("0xdef", other); err != nil || !ok {
+		t.Fatalf("failed to propose a bound device: %v %v", ok, err)
+	}
+	if ok, err := d.ConfirmDevice("0xdef", other, 2); err != nil || !ok {
+		t.Fatalf("failed to confirm device: %v %v", ok, err)
+	}
+	if got := status("0xdef"); got.Status != CONFIRM || got.Proposer != other.String() || got.DataChannel != 2 {
+		t.Fatalf("unexpected rebound device: status %d, proposer %s, channel %d", got.Status, got.Proposer, got.DataChannel)
+	}
+}
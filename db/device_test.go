@@ -0,0 +1,99 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestReplayedChainEventsDoNotRevertDevice(t *testing.T) {
+	d := newTestDB(t)
+	owner := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	newOwner := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	created := func() *Device {
+		return &Device{
+			ID:             "0xabc",
+			NFTID:          "1",
+			Name:           "did:io:0xabc",
+			Owner:          owner.String(),
+			Status:         CONFIRM,
+			OperationTimes: NewOperationTimes(),
+		}
+	}
+
+	if err := d.UpsertDevice(10, created()); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdateOwner(20, common.Big1, newOwner); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RemoveDevice(30, common.Hash{}, "0xabc"); err != nil {
+		t.Fatal(err)
+	}
+	var journals int64
+	if err := d.db.Model(&chainJournal{}).Count(&journals).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// replay the events of blocks [10, 20]
+	if err := d.UpsertDevice(10, created()); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdateOwner(20, common.Big1, newOwner); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.Device("0xabc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != REMOVED || got.Owner != newOwner.String() || got.ChainBlock != 30 {
+		t.Errorf("replay reverted the device: status %d, owner %s, chain block %d", got.Status, got.Owner, got.ChainBlock)
+	}
+	var n int64
+	if err := d.db.Model(&chainJournal{}).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != journals {
+		t.Errorf("replay journaled %d rows", n-journals)
+	}
+}
+
+func TestWritesToLegacyDevice(t *testing.T) {
+	d := newTestDB(t)
+	d.oldDB = openTestDB(t, "legacy")
+	d.defaultProject = 7
+	if err := d.oldDB.Create(&Device{
+		ID:             "0xabc",
+		NFTID:          "1",
+		Owner:          "0x0000000000000000000000000000000000000001",
+		LastTimestamp:  50,
+		OperationTimes: NewOperationTimes(),
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := d.AdvanceLastTimestamp("0xabc", 50); err != nil || ok {
+		t.Fatalf("replayed timestamp of legacy device is accepted: %v %v", ok, err)
+	}
+	if ok, err := d.AdvanceLastTimestamp("0xabc", 100); err != nil || !ok {
+		t.Fatalf("newer timestamp of legacy device is rejected: %v %v", ok, err)
+	}
+	if err := d.UpdateByID("0xabc", map[string]any{"real_firmware": "pebble 2.0"}); err != nil {
+		t.Fatal(err)
+	}
+	primary, err := findDevice(d.db, "id = ?", "0xabc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if primary == nil || primary.LastTimestamp != 100 || primary.RealFirmware != "pebble 2.0" || primary.ProjectID != 7 {
+		t.Fatalf("legacy device is not copied to the primary db with the writes: %+v", primary)
+	}
+
+	if err := d.UpdateByID("0xdef", map[string]any{"state": 1}); err == nil {
+		t.Error("update of a missing device succeeded")
+	}
+	if _, err := d.AdvanceLastTimestamp("0xdef", 100); err == nil {
+		t.Error("timestamp of a missing device is accepted")
+	}
+}
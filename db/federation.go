@@ -0,0 +1,108 @@
+package db
+
+import (
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// Source restricts which databases are read during the legacy db migration period.
+// Writes always go to the primary db.
+type Source int
+
+const (
+	SourceAll Source = iota
+	SourcePrimary
+	SourceLegacy
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourcePrimary:
+		return "primary"
+	case SourceLegacy:
+		return "legacy"
+	default:
+		return "all"
+	}
+}
+
+type reader struct {
+	name string
+	db   *gorm.DB
+}
+
+// From returns a view of the db which only reads from the given source
+func (d *DB) From(s Source) *DB {
+	c := *d
+	c.source = s
+	return &c
+}
+
+// readers returns the databases to read from, the primary db comes first so its rows take precedence
+func (d *DB) readers() []reader {
+	rs := make([]reader, 0, 2)
+	if d.source != SourceLegacy {
+		rs = append(rs, reader{name: SourcePrimary.String(), db: d.db})
+	}
+	if d.source != SourcePrimary && d.oldDB != nil {
+		rs = append(rs, reader{name: SourceLegacy.String(), db: d.oldDB})
+	}
+	return rs
+}
+
+// recordReaders returns the databases to read device records from, the legacy db is skipped once its device
+// records are migrated and verified, unless it is read explicitly
+func (d *DB) recordReaders() []reader {
+	if d.recordsMigrated && d.source == SourceAll {
+		return d.From(SourcePrimary).readers()
+	}
+	return d.readers()
+}
+
+// readFirst returns the first non-nil result in readers order
+func readFirst[T any](rs []reader, f func(*gorm.DB) (*T, error)) (*T, error) {
+	for _, r := range rs {
+		t, err := f(r.db)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read from %s db", r.name)
+		}
+		if t != nil {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// readMerged returns the results of all readers, results whose key has already been read from a
+// preceding reader are dropped
+func readMerged[T any](rs []reader, key func(*T) string, f func(*gorm.DB) ([]*T, error)) ([]*T, error) {
+	res := []*T{}
+	seen := map[string]bool{}
+	for _, r := range rs {
+		ts, err := f(r.db)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read from %s db", r.name)
+		}
+		for _, t := range ts {
+			k := key(t)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
+
+// paginate applies offset and limit to merged results
+func paginate[T any](ts []*T, offset, limit int) []*T {
+	if offset >= len(ts) {
+		return []*T{}
+	}
+	ts = ts[offset:]
+	if len(ts) > limit {
+		ts = ts[:limit]
+	}
+	return ts
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// dbSourceActive returns the reported state of the db source
+func dbSourceActive(t *testing.T, source string) float64 {
+	t.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "source" && l.GetValue() == source {
+					return m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	t.Fatalf("the state of the %s db is not reported", source)
+	return 0
+}
+
+func testDSN(t *testing.T, name string) string {
+	return fmt.Sprintf("file:%s_%s?mode=memory&cache=shared", t.Name(), name)
+}
+
+// openLegacy returns a handle to the legacy db of the test with the devices and device records migrated
+func openLegacy(t *testing.T) *gorm.DB {
+	t.Helper()
+	db := openTestDB(t, "legacy")
+	if err := db.AutoMigrate(&DeviceRecord{}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestOpenWithoutLegacyDB(t *testing.T) {
+	d, err := Open(sqlite.Open(testDSN(t, "primary")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.oldDB != nil {
+		t.Fatal("expected no legacy db")
+	}
+	if dbSourceActive(t, "primary") != 1 || dbSourceActive(t, "legacy") != 0 {
+		t.Error("expected only the primary db to be reported active")
+	}
+
+	if err := d.UpsertDevice(1, &Device{ID: "0xabc", NFTID: "1", OperationTimes: NewOperationTimes()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdateByID("0xabc", map[string]any{"real_firmware": "pebble 2.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateDeviceRecord(&DeviceRecord{ID: "r1", Imei: "0xabc", Timestamp: 10, OperationTimes: NewOperationTimes()}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []Source{SourceAll, SourcePrimary} {
+		dev, err := d.From(s).Device("0xabc")
+		if err != nil || dev == nil || dev.RealFirmware != "pebble 2.0" {
+			t.Errorf("%s: unexpected device %+v %v", s, dev, err)
+		}
+		rs, err := d.From(s).DeviceRecordHistory(&DeviceRecordHistoryQuery{Imei: "0xabc", To: 100, Fields: []string{"snr"}, Limit: 10})
+		if err != nil || len(rs) != 1 {
+			t.Errorf("%s: unexpected device records %v %v", s, rs, err)
+		}
+	}
+	// nothing is read from a legacy db which is not configured
+	if dev, err := d.From(SourceLegacy).Device("0xabc"); err != nil || dev != nil {
+		t.Errorf("unexpected legacy device %+v %v", dev, err)
+	}
+	if err := d.MigrateLegacyDeviceRecords(10); err == nil || !strings.Contains(err.Error(), "legacy db is not configured") {
+		t.Errorf("expected the migration to require a legacy db, got %v", err)
+	}
+}
+
+func TestOpenWithUnreachableLegacyDB(t *testing.T) {
+	unreachable := sqlite.Open("file:" + filepath.Join(t.TempDir(), "missing", "legacy.db") + "?mode=ro")
+	d, err := Open(sqlite.Open(testDSN(t, "primary")), unreachable)
+	if err != nil {
+		t.Fatalf("expected the unreachable legacy db to be disabled, got %v", err)
+	}
+	if d.oldDB != nil {
+		t.Fatal("expected the unreachable legacy db to be disabled")
+	}
+	if dbSourceActive(t, "legacy") != 0 {
+		t.Error("expected the legacy db to be reported inactive")
+	}
+	if err := d.UpsertDevice(1, &Device{ID: "0xabc", NFTID: "1", OperationTimes: NewOperationTimes()}); err != nil {
+		t.Fatal(err)
+	}
+	if dev, err := d.Device("0xabc"); err != nil || dev == nil {
+		t.Fatalf("unexpected device %+v %v", dev, err)
+	}
+}
+
+func TestSourceFallbacks(t *testing.T) {
+	legacy := openLegacy(t)
+	d, err := Open(sqlite.Open(testDSN(t, "primary")), sqlite.Open(testDSN(t, "legacy")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.oldDB == nil || dbSourceActive(t, "legacy") != 1 {
+		t.Fatal("expected the legacy db to be active")
+	}
+
+	// 0xaaa is only in the legacy db, 0xbbb is in both with newer values in the primary db
+	for _, dev := range []*Device{
+		{ID: "0xaaa", NFTID: "1", RealFirmware: "legacy"},
+		{ID: "0xbbb", NFTID: "2", RealFirmware: "legacy"},
+	} {
+		dev.OperationTimes = NewOperationTimes()
+		if err := legacy.Create(dev).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.db.Create(&Device{ID: "0xbbb", NFTID: "2", RealFirmware: "primary", OperationTimes: NewOperationTimes()}).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*DeviceRecord{{ID: "r1", Timestamp: 10}, {ID: "r2", Timestamp: 20}} {
+		r.Imei, r.OperationTimes = "0xaaa", NewOperationTimes()
+		if err := legacy.Create(r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.CreateDeviceRecord(&DeviceRecord{ID: "r3", Imei: "0xaaa", Timestamp: 30, OperationTimes: NewOperationTimes()}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		source   Source
+		aaa, bbb string // the firmware read, empty if the device is not found
+		records  int
+	}{
+		{SourceAll, "legacy", "primary", 3},
+		{SourcePrimary, "", "primary", 1},
+		{SourceLegacy, "legacy", "legacy", 2},
+	}
+	for _, c := range cases {
+		rd := d.From(c.source)
+		for id, want := range map[string]string{"0xaaa": c.aaa, "0xbbb": c.bbb} {
+			dev, err := rd.Device(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if dev != nil {
+				got = dev.RealFirmware
+			}
+			if got != want {
+				t.Errorf("%s: device %s has firmware %q, want %q", c.source, id, got, want)
+			}
+		}
+		rs, err := rd.DeviceRecordHistory(&DeviceRecordHistoryQuery{Imei: "0xaaa", To: 100, Fields: []string{"snr"}, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) != c.records {
+			t.Errorf("%s: got %d device records, want %d", c.source, len(rs), c.records)
+		}
+	}
+
+	// the writes to a legacy device go to the primary db
+	if err := d.UpdateByID("0xaaa", map[string]any{"real_firmware": "updated"}); err != nil {
+		t.Fatal(err)
+	}
+	if dev, err := d.From(SourcePrimary).Device("0xaaa"); err != nil || dev == nil || dev.RealFirmware != "updated" {
+		t.Errorf("the legacy device is not written to the primary db: %+v %v", dev, err)
+	}
+	if dev, err := d.From(SourceLegacy).Device("0xaaa"); err != nil || dev == nil || dev.RealFirmware != "legacy" {
+		t.Errorf("the legacy db is written: %+v %v", dev, err)
+	}
+}
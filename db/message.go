@@ -1,13 +1,86 @@
 package db
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// The message statuses, MessageForwarded is the zero value so the messages created before the forwarding
+// queue existed, which take the column default, are not forwarded again
+const (
+	MessageForwarded int32 = iota
+	MessagePending
+	MessageDead
+)
 
 type Message struct {
 	gorm.Model
-	MessageID      string `gorm:"index:message_id,not null"`
-	ClientID       string `gorm:"index:message_fetch,not null,default:''"`
-	ProjectID      uint64 `gorm:"index:message_fetch,not null"`
-	ProjectVersion string `gorm:"index:message_fetch,not null,default:'0.0'"`
-	Data           []byte `gorm:"size:4096"`
-	InternalTaskID string `gorm:"index:internal_task_id,not null,default:''"`
+	MessageID      string    `gorm:"index:message_id,not null"`
+	ClientID       string    `gorm:"index:message_fetch,not null,default:''"`
+	ProjectID      uint64    `gorm:"index:message_fetch,not null"`
+	ProjectVersion string    `gorm:"index:message_fetch,not null,default:'0.0'"`
+	Data           []byte    `gorm:"size:4096"`
+	InternalTaskID string    `gorm:"index:message_internal_task_id,not null,default:''"`
+	Status         int32     `gorm:"index:message_forward;not null;default:0"`
+	Attempts       int32     `gorm:"not null;default:0"`
+	NextAttemptAt  time.Time `gorm:"index:message_forward;not null;default:CURRENT_TIMESTAMP"`
+	LastError      string    `gorm:"not null;default:''"`
+}
+
+func (d *DB) CreateMessage(t *Message) error {
+	err := d.db.Create(t).Error
+	return errors.Wrap(err, "failed to create message")
+}
+
+// PendingMessages returns the pending messages which are due to be forwarded before now
+func (d *DB) PendingMessages(now time.Time, limit int) ([]*Message, error) {
+	ts := []*Message{}
+	err := d.db.Where("status = ? AND next_attempt_at <= ?", MessagePending, now).
+		Order("id ASC").Limit(limit).Find(&ts).Error
+	return ts, errors.Wrap(err, "failed to query pending messages")
+}
+
+// DeadMessages returns the messages which are given up forwarding, newest first
+func (d *DB) DeadMessages(offset, limit int) ([]*Message, error) {
+	ts := []*Message{}
+	err := d.db.Where("status = ?", MessageDead).
+		Order("id DESC").Offset(offset).Limit(limit).Find(&ts).Error
+	return ts, errors.Wrap(err, "failed to query dead messages")
+}
+
+// ForwardedMessage marks the message as forwarded and records the task created for it
+func (d *DB) ForwardedMessage(id uint, task *Task) error {
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(task).Error; err != nil {
+			return errors.Wrap(err, "failed to create task")
+		}
+		return tx.Model(&Message{}).Where("id = ?", id).Updates(map[string]any{
+			"status":           MessageForwarded,
+			"internal_task_id": task.InternalTaskID,
+			"last_error":       "",
+		}).Error
+	})
+	return errors.Wrapf(err, "failed to update forwarded message %d", id)
+}
+
+// RetryMessage schedules the next forwarding attempt of the message
+func (d *DB) RetryMessage(id uint, attempts int32, next time.Time, lastError string) error {
+	err := d.db.Model(&Message{}).Where("id = ?", id).Updates(map[string]any{
+		"attempts":        attempts,
+		"next_attempt_at": next,
+		"last_error":      lastError,
+	}).Error
+	return errors.Wrapf(err, "failed to update retried message %d", id)
+}
+
+// DeadMessage gives up forwarding the message
+func (d *DB) DeadMessage(id uint, attempts int32, lastError string) error {
+	err := d.db.Model(&Message{}).Where("id = ?", id).Updates(map[string]any{
+		"status":     MessageDead,
+		"attempts":   attempts,
+		"last_error": lastError,
+	}).Error
+	return errors.Wrapf(err, "failed to update dead message %d", id)
 }
@@ -0,0 +1,357 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	deviceRecordTable      = "device_record"
+	deviceRecordGeoTable   = "device_record_geo_locations"
+	deviceRecordGeoIDField = "device_record_id"
+	deviceRecordGeoPKField = "id"
+)
+
+// migrationCheckpoint records the progress of copying a legacy table into the primary db,
+// rows are copied in ascending primary key order so LastKey is the resume point
+type migrationCheckpoint struct {
+	Name      string `gorm:"primary_key"`
+	LastKey   string `gorm:"not null;default:''"`
+	Copied    int64  `gorm:"not null;default:0"`
+	Completed bool   `gorm:"not null;default:false"`
+	Verified  bool   `gorm:"not null;default:false"`
+
+	OperationTimes
+}
+
+func (*migrationCheckpoint) TableName() string { return "legacy_migration_checkpoint" }
+
+// MigrationReport is the verification result of a migrated table
+type MigrationReport struct {
+	Table          string
+	LegacyRows     int64
+	MigratedRows   int64
+	MismatchedRows int64
+	MissingRows    int64
+}
+
+func (r *MigrationReport) OK() bool {
+	return r.LegacyRows == r.MigratedRows && r.MismatchedRows == 0 && r.MissingRows == 0
+}
+
+func (d *DB) checkpoint(table string) (*migrationCheckpoint, error) {
+	t := migrationCheckpoint{}
+	if err := d.db.Where("name = ?", table).First(&t).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return &migrationCheckpoint{Name: table, OperationTimes: NewOperationTimes()}, nil
+		}
+		return nil, errors.Wrapf(err, "failed to query migration checkpoint, table %s", table)
+	}
+	return &t, nil
+}
+
+func saveCheckpoint(tx *gorm.DB, t *migrationCheckpoint) error {
+	t.UpdatedAt = time.Now()
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_key", "copied", "completed", "verified", "updated_at"}),
+	}).Create(t).Error
+	return errors.Wrapf(err, "failed to save migration checkpoint, table %s", t.Name)
+}
+
+func (d *DB) requireLegacyDB() error {
+	if d.oldDB == nil {
+		return errors.New("legacy db is not configured")
+	}
+	return nil
+}
+
+// MigrateLegacyDeviceRecords copies device_record and device_record_geo_locations rows from the legacy db into
+// the primary db in batches. Each batch is committed together with its checkpoint, so an interrupted migration
+// resumes from the last committed batch. Rows which already exist in the primary db are kept.
+func (d *DB) MigrateLegacyDeviceRecords(batchSize int) error {
+	if batchSize <= 0 {
+		return errors.Errorf("invalid batch size %d", batchSize)
+	}
+	if err := d.requireLegacyDB(); err != nil {
+		return err
+	}
+	if err := d.db.AutoMigrate(&migrationCheckpoint{}); err != nil {
+		return errors.Wrap(err, "failed to migrate checkpoint model")
+	}
+	if err := d.migrateTable(deviceRecordTable, batchSize, d.copyDeviceRecords); err != nil {
+		return err
+	}
+	return d.migrateTable(deviceRecordGeoTable, batchSize, d.copyDeviceRecordGeoLocations)
+}
+
+// copyBatch copies at most batchSize rows with key greater than from, and returns the last copied key
+// and the number of rows read from the legacy db
+type copyBatch func(tx *gorm.DB, from string, batchSize int) (last string, n int, err error)
+
+func (d *DB) migrateTable(table string, batchSize int, copyFn copyBatch) error {
+	cp, err := d.checkpoint(table)
+	if err != nil {
+		return err
+	}
+	if cp.Completed {
+		slog.Info("legacy table already migrated", "table", table, "copied", cp.Copied)
+		return nil
+	}
+	slog.Info("start migrating legacy table", "table", table, "last_key", cp.LastKey, "copied", cp.Copied)
+	for {
+		var n int
+		err := d.db.Transaction(func(tx *gorm.DB) error {
+			last, read, err := copyFn(tx, cp.LastKey, batchSize)
+			if err != nil {
+				return err
+			}
+			n = read
+			if n == 0 {
+				cp.Completed = true
+			} else {
+				cp.LastKey = last
+				cp.Copied += int64(n)
+			}
+			return saveCheckpoint(tx, cp)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to migrate legacy table %s after key %s", table, cp.LastKey)
+		}
+		if n == 0 {
+			break
+		}
+		slog.Info("migrated legacy batch", "table", table, "last_key", cp.LastKey, "copied", cp.Copied)
+	}
+	slog.Info("legacy table migration completed", "table", table, "copied", cp.Copied)
+	return nil
+}
+
+func (d *DB) copyDeviceRecords(tx *gorm.DB, from string, batchSize int) (string, int, error) {
+	ts := []*DeviceRecord{}
+	if err := d.oldDB.Where("id > ?", from).Order("id ASC").Limit(batchSize).Find(&ts).Error; err != nil {
+		return "", 0, errors.Wrap(err, "failed to read legacy device records")
+	}
+	if len(ts) == 0 {
+		return from, 0, nil
+	}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ts).Error; err != nil {
+		return "", 0, errors.Wrap(err, "failed to write device records")
+	}
+	return ts[len(ts)-1].ID, len(ts), nil
+}
+
+// parseGeoKey parses the geo location primary key of a checkpoint, the migration starts from 0
+func parseGeoKey(from string) (int64, error) {
+	if from == "" {
+		return 0, nil
+	}
+	k, err := strconv.ParseInt(from, 10, 64)
+	return k, errors.Wrapf(err, "invalid geo location key %s", from)
+}
+
+// copyDeviceRecordGeoLocations pages the legacy geo locations on their primary key, and inserts them without
+// it so the primary db assigns new keys. A device record has at most one location, so the locations of
+// records which already have one in the primary db are skipped.
+func (d *DB) copyDeviceRecordGeoLocations(tx *gorm.DB, from string, batchSize int) (string, int, error) {
+	key, err := parseGeoKey(from)
+	if err != nil {
+		return "", 0, err
+	}
+	rows := []map[string]any{}
+	if err := d.oldDB.Table(deviceRecordGeoTable).Where(deviceRecordGeoPKField+" > ?", key).
+		Order(deviceRecordGeoPKField + " ASC").Limit(batchSize).Find(&rows).Error; err != nil {
+		return "", 0, errors.Wrap(err, "failed to read legacy device record geo locations")
+	}
+	if len(rows) == 0 {
+		return from, 0, nil
+	}
+	ids := make([]string, 0, len(rows))
+	for _, r := range rows {
+		ids = append(ids, fmt.Sprint(r[deviceRecordGeoIDField]))
+	}
+	existed := []string{}
+	if err := tx.Table(deviceRecordGeoTable).Where(deviceRecordGeoIDField+" IN ?", ids).
+		Pluck(deviceRecordGeoIDField, &existed).Error; err != nil {
+		return "", 0, errors.Wrap(err, "failed to query existing device record geo locations")
+	}
+	skip := make(map[string]bool, len(existed))
+	for _, id := range existed {
+		skip[id] = true
+	}
+	inserts := make([]map[string]any, 0, len(rows))
+	for i, r := range rows {
+		if skip[ids[i]] {
+			continue
+		}
+		skip[ids[i]] = true
+		row := make(map[string]any, len(r))
+		for k, v := range r {
+			if k != deviceRecordGeoPKField {
+				row[k] = v
+			}
+		}
+		inserts = append(inserts, row)
+	}
+	if len(inserts) > 0 {
+		if err := tx.Table(deviceRecordGeoTable).Create(&inserts).Error; err != nil {
+			return "", 0, errors.Wrap(err, "failed to write device record geo locations")
+		}
+	}
+	return fmt.Sprint(rows[len(rows)-1][deviceRecordGeoPKField]), len(rows), nil
+}
+
+func deviceRecordChecksum(t *DeviceRecord) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%s|%d",
+		t.ID, t.Imei, t.Operator, t.Snr, t.Vbat, t.GasResistance, t.Temperature, t.Temperature2, t.Pressure,
+		t.Humidity, t.Light, t.Gyroscope, t.Accelerometer, t.Latitude, t.Longitude, t.Signature, t.Timestamp)))
+	return hex.EncodeToString(h[:])
+}
+
+// geoChecksum hashes the columns of a geo location except its primary key, which differs between the dbs
+func geoChecksum(r map[string]any) string {
+	keys := make([]string, 0, len(r))
+	for k := range r {
+		if k != deviceRecordGeoPKField {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%v|", k, r[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyLegacyMigration compares every legacy device record and geo location with its copy in the primary db
+// by row count and content checksum. The checkpoints are marked verified if all rows match.
+func (d *DB) VerifyLegacyMigration(batchSize int) ([]*MigrationReport, error) {
+	if batchSize <= 0 {
+		return nil, errors.Errorf("invalid batch size %d", batchSize)
+	}
+	if err := d.requireLegacyDB(); err != nil {
+		return nil, err
+	}
+
+	records := &MigrationReport{Table: deviceRecordTable}
+	for from := ""; ; {
+		olds := []*DeviceRecord{}
+		if err := d.oldDB.Where("id > ?", from).Order("id ASC").Limit(batchSize).Find(&olds).Error; err != nil {
+			return nil, errors.Wrap(err, "failed to read legacy device records")
+		}
+		if len(olds) == 0 {
+			break
+		}
+		ids := make([]string, 0, len(olds))
+		for _, t := range olds {
+			ids = append(ids, t.ID)
+		}
+		news := []*DeviceRecord{}
+		if err := d.db.Where("id IN ?", ids).Find(&news).Error; err != nil {
+			return nil, errors.Wrap(err, "failed to read migrated device records")
+		}
+		sums := make(map[string]string, len(news))
+		for _, t := range news {
+			sums[t.ID] = deviceRecordChecksum(t)
+		}
+		records.LegacyRows += int64(len(olds))
+		records.MigratedRows += int64(len(news))
+		for _, t := range olds {
+			sum, ok := sums[t.ID]
+			switch {
+			case !ok:
+				records.MissingRows++
+			case sum != deviceRecordChecksum(t):
+				records.MismatchedRows++
+			}
+		}
+		from = ids[len(ids)-1]
+	}
+
+	geos := &MigrationReport{Table: deviceRecordGeoTable}
+	for from := int64(0); ; {
+		olds := []map[string]any{}
+		if err := d.oldDB.Table(deviceRecordGeoTable).Where(deviceRecordGeoPKField+" > ?", from).
+			Order(deviceRecordGeoPKField + " ASC").Limit(batchSize).Find(&olds).Error; err != nil {
+			return nil, errors.Wrap(err, "failed to read legacy device record geo locations")
+		}
+		if len(olds) == 0 {
+			break
+		}
+		ids := make([]string, 0, len(olds))
+		for _, r := range olds {
+			ids = append(ids, fmt.Sprint(r[deviceRecordGeoIDField]))
+		}
+		news := []map[string]any{}
+		if err := d.db.Table(deviceRecordGeoTable).Where(deviceRecordGeoIDField+" IN ?", ids).Find(&news).Error; err != nil {
+			return nil, errors.Wrap(err, "failed to read migrated device record geo locations")
+		}
+		sums := make(map[string]string, len(news))
+		for _, r := range news {
+			sums[fmt.Sprint(r[deviceRecordGeoIDField])] = geoChecksum(r)
+		}
+		geos.LegacyRows += int64(len(olds))
+		geos.MigratedRows += int64(len(sums))
+		for i, r := range olds {
+			sum, ok := sums[ids[i]]
+			switch {
+			case !ok:
+				geos.MissingRows++
+			case sum != geoChecksum(r):
+				geos.MismatchedRows++
+			}
+		}
+		last, err := parseGeoKey(fmt.Sprint(olds[len(olds)-1][deviceRecordGeoPKField]))
+		if err != nil {
+			return nil, err
+		}
+		from = last
+	}
+
+	reports := []*MigrationReport{records, geos}
+	for _, r := range reports {
+		if !r.OK() {
+			continue
+		}
+		cp, err := d.checkpoint(r.Table)
+		if err != nil {
+			return nil, err
+		}
+		if !cp.Completed {
+			continue
+		}
+		cp.Verified = true
+		if err := saveCheckpoint(d.db, cp); err != nil {
+			return nil, err
+		}
+	}
+	return reports, nil
+}
+
+// LegacyMigrationVerified reports whether all legacy tables have been migrated and verified,
+// after which device records are no longer read from the legacy db
+func (d *DB) LegacyMigrationVerified() (bool, error) {
+	if !d.db.Migrator().HasTable(&migrationCheckpoint{}) {
+		return false, nil
+	}
+	for _, table := range []string{deviceRecordTable, deviceRecordGeoTable} {
+		cp, err := d.checkpoint(table)
+		if err != nil {
+			return false, err
+		}
+		if !cp.Completed || !cp.Verified {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestMigrateLegacyDeviceRecords(t *testing.T) {
+	d := newTestDB(t)
+	d.oldDB = openTestDB(t, "legacy")
+	const geoTable = `CREATE TABLE device_record_geo_locations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		device_record_id TEXT NOT NULL,
+		geom TEXT NOT NULL
+	)`
+	for _, db := range []*gorm.DB{d.db, d.oldDB} {
+		if err := db.AutoMigrate(&DeviceRecord{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Exec(geoTable).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the primary db already has a location with the same key as the first legacy location
+	if err := d.db.Exec(`INSERT INTO device_record_geo_locations (id, device_record_id, geom) VALUES (1, 'p1', 'POINT(0 0)')`).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"r1", "r2", "r3"} {
+		if err := d.oldDB.Create(&DeviceRecord{ID: id, Imei: "imei", Operator: "op", Timestamp: int64(i)}).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := d.oldDB.Exec(`INSERT INTO device_record_geo_locations (device_record_id, geom) VALUES (?, ?)`,
+			id, "POINT(1 1)").Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.MigrateLegacyDeviceRecords(2); err != nil {
+		t.Fatal(err)
+	}
+	// rerunning a completed migration copies nothing
+	if err := d.MigrateLegacyDeviceRecords(2); err != nil {
+		t.Fatal(err)
+	}
+
+	var geos int64
+	if err := d.db.Table(deviceRecordGeoTable).Count(&geos).Error; err != nil {
+		t.Fatal(err)
+	}
+	if geos != 4 {
+		t.Fatalf("expected 4 geo locations, got %d", geos)
+	}
+	var owner string
+	if err := d.db.Table(deviceRecordGeoTable).Where("id = 1").Pluck(deviceRecordGeoIDField, &owner).Error; err != nil {
+		t.Fatal(err)
+	}
+	if owner != "p1" {
+		t.Fatalf("expected the primary location to be kept, got %s", owner)
+	}
+
+	reports, err := d.VerifyLegacyMigration(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range reports {
+		if !r.OK() {
+			t.Fatalf("unexpected verification report %+v", r)
+		}
+	}
+	verified, err := d.LegacyMigrationVerified()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified {
+		t.Fatal("expected the legacy migration to be verified")
+	}
+}
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OwnerNonce is a nonce of a request signed by an owner, each nonce of a signer can only be used once
+type OwnerNonce struct {
+	Signer string `gorm:"primary_key"`
+	Nonce  string `gorm:"primary_key"`
+
+	OperationTimes
+}
+
+func (*OwnerNonce) TableName() string { return "owner_nonce" }
+
+// UseOwnerNonce records the nonce of signer, it reports false if the nonce has been used. The nonces used
+// before expiredBefore are pruned, the requests which could carry them are rejected by their timestamps.
+func (d *DB) UseOwnerNonce(signer common.Address, nonce string, expiredBefore time.Time) (bool, error) {
+	var ok bool
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("created_at < ?", expiredBefore).Delete(&OwnerNonce{}).Error; err != nil {
+			return err
+		}
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&OwnerNonce{
+			Signer:         signer.String(),
+			Nonce:          nonce,
+			OperationTimes: NewOperationTimes(),
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		ok = res.RowsAffected == 1
+		return nil
+	})
+	return ok, errors.Wrap(err, "failed to use owner nonce")
+}
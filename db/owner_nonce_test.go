@@ -0,0 +1,43 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestUseOwnerNonce(t *testing.T) {
+	d := newTestDB(t)
+	signer := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	other := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	expiredBefore := time.Now().Add(-time.Hour)
+
+	for _, c := range []struct {
+		signer common.Address
+		nonce  string
+		want   bool
+	}{
+		{signer, "n1", true},
+		{signer, "n1", false},
+		{signer, "n2", true},
+		{other, "n1", true},
+	} {
+		ok, err := d.UseOwnerNonce(c.signer, c.nonce, expiredBefore)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != c.want {
+			t.Errorf("use nonce %s of %s: got %v, want %v", c.nonce, c.signer, ok, c.want)
+		}
+	}
+
+	// nonces used before expiredBefore are pruned
+	ok, err := d.UseOwnerNonce(signer, "n1", time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("expired nonce is not pruned")
+	}
+}
@@ -1,46 +1,111 @@
 package db
 
 import (
+	"log/slog"
+
 	"github.com/pkg/errors"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
+
+	"github.com/iotexproject/pebble-server/metrics"
 )
 
 type DB struct {
-	db    *gorm.DB
-	oldDB *gorm.DB
+	db     *gorm.DB
+	oldDB  *gorm.DB
+	source Source
+	// recordsMigrated is set once the legacy device records are migrated and verified, the legacy db is
+	// then no longer read for device records
+	recordsMigrated bool
+	defaultProject  uint64
+	// bindingHandshake is set if a device has to be bound to its owner by the binding handshake,
+	// otherwise a device is bound to the holder of its ioID nft
+	bindingHandshake bool
+	decoders         map[metadataDecoderKey][]*MetadataDecoder
 }
 
 func New(dsn, oldDSN string) (*DB, error) {
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+	var legacy gorm.Dialector
+	if oldDSN != "" {
+		legacy = postgres.Open(oldDSN)
+	}
+	return Open(postgres.Open(dsn), legacy)
+}
+
+// Open migrates the models of the primary db and connects the optional legacy db
+func Open(primary, legacy gorm.Dialector) (*DB, error) {
+	db, err := gorm.Open(primary, &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Silent),
 	})
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to connect postgres")
+		return nil, errors.Wrap(err, "failed to connect primary db")
 	}
 	if err := db.AutoMigrate(
 		&scannedBlockNumber{},
+		&ScannedBlock{},
+		&chainJournal{},
 		&Account{},
 		&App{},
 		&AppV2{},
 		&Bank{},
 		&BankRecord{},
 		&Device{},
+		&DeviceStatusChange{},
+		&Project{},
+		&ProjectContract{},
+		&ProjectMetadata{},
+		&QuarantinedMetadata{},
+		&Rollout{},
+		&RolloutDevice{},
 		&DeviceRecord{},
 		&Task{},
 		&Message{},
+		&OwnerNonce{},
 	); err != nil {
 		return nil, errors.Wrap(err, "failed to migrate model")
 	}
-	oldDB, err := gorm.Open(postgres.Open(oldDSN), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Silent),
-	})
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to connect old postgres")
+	if db.Dialector.Name() == "postgres" {
+		if err := migrateAppPrimaryKey(db); err != nil {
+			return nil, err
+		}
 	}
-	return &DB{
-		db:    db,
-		oldDB: oldDB,
-	}, nil
+	if err := backfillChainBlock(db); err != nil {
+		return nil, err
+	}
+	var oldDB *gorm.DB
+	if legacy != nil {
+		oldDB, err = gorm.Open(legacy, &gorm.Config{
+			Logger: logger.Default.LogMode(logger.Silent),
+		})
+		if err != nil {
+			slog.Error("failed to connect old postgres, legacy db is disabled", "error", err)
+			oldDB = nil
+		}
+	}
+	metrics.TrackDBSource(SourcePrimary.String(), true)
+	metrics.TrackDBSource(SourceLegacy.String(), oldDB != nil)
+	slog.Info("database sources", "primary", true, "legacy", oldDB != nil)
+
+	d := &DB{
+		db:       db,
+		oldDB:    oldDB,
+		decoders: map[metadataDecoderKey][]*MetadataDecoder{},
+	}
+	if oldDB != nil {
+		if d.recordsMigrated, err = d.LegacyMigrationVerified(); err != nil {
+			return nil, err
+		}
+		slog.Info("legacy device records", "migrated", d.recordsMigrated)
+	}
+	return d, nil
+}
+
+// Transaction runs fn with a db whose writes are committed together, or rolled back if fn returns an error
+func (d *DB) Transaction(fn func(tx *DB) error) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		c := *d
+		c.db = tx
+		return fn(&c)
+	})
 }
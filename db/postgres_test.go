@@ -0,0 +1,58 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestDB returns a DB backed by an in-memory sqlite database with the models migrated,
+// it only covers the queries without postgres specific sql
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	return &DB{
+		db:       openTestDB(t, "primary"),
+		decoders: map[metadataDecoderKey][]*MetadataDecoder{},
+	}
+}
+
+// openTestDB opens the in-memory sqlite database of the test with the given name
+func openTestDB(t *testing.T, name string) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s_%s?mode=memory&cache=shared", t.Name(), name)), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to get sql db: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(
+		&scannedBlockNumber{},
+		&ScannedBlock{},
+		&chainJournal{},
+		&App{},
+		&AppV2{},
+		&Device{},
+		&DeviceStatusChange{},
+		&Project{},
+		&ProjectContract{},
+		&ProjectMetadata{},
+		&QuarantinedMetadata{},
+		&Rollout{},
+		&RolloutDevice{},
+		&Message{},
+		&OwnerNonce{},
+	); err != nil {
+		t.Fatalf("failed to migrate model: %v", err)
+	}
+	return db
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Project is the state of a served ioID project indexed from the project contract events,
+// Owner is the holder of the project nft and Metadata maps metadata names to hex encoded values
+type Project struct {
+	ID        uint64            `gorm:"primary_key;autoIncrement:false"`
+	Name      string            `gorm:"not null;default:''"`
+	Owner     string            `gorm:"not null;default:''"`
+	Operators []string          `gorm:"serializer:json"`
+	Metadata  map[string]string `gorm:"serializer:json"`
+	// ChainBlock is the block of the last chain event applied to the project
+	ChainBlock uint64 `gorm:"not null;default:0"`
+
+	OperationTimes
+}
+
+func (*Project) TableName() string { return "project" }
+
+// ProjectContract records the admin of the project contract
+type ProjectContract struct {
+	Address string `gorm:"primary_key"`
+	Owner   string `gorm:"not null;default:''"`
+	// ChainBlock is the block of the last chain event applied to the contract
+	ChainBlock uint64 `gorm:"not null;default:0"`
+
+	OperationTimes
+}
+
+func (*ProjectContract) TableName() string { return "project_contract" }
+
+func (p *Project) AddOperator(operator common.Address) {
+	if !slices.Contains(p.Operators, operator.String()) {
+		p.Operators = append(p.Operators, operator.String())
+	}
+}
+
+func (p *Project) RemoveOperator(operator common.Address) {
+	p.Operators = slices.DeleteFunc(p.Operators, func(o string) bool { return o == operator.String() })
+}
+
+// UpdateProject journals the project, applies update to it and saves it, the project is created if not exists.
+// It does nothing if the project has been changed by an event of a later block.
+func (d *DB) UpdateProject(block uint64, projectID uint64, update func(p *Project)) error {
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		prev := &Project{}
+		if err := tx.Where("id = ?", projectID).First(prev).Error; err != nil {
+			if err != gorm.ErrRecordNotFound {
+				return errors.Wrap(err, "failed to query project")
+			}
+			prev = nil
+		}
+		if prev != nil && prev.ChainBlock > block {
+			return nil
+		}
+		if err := journal(tx, block, journalProject, strconv.FormatUint(projectID, 10), prev); err != nil {
+			return err
+		}
+		t := &Project{ID: projectID, OperationTimes: NewOperationTimes()}
+		if prev != nil {
+			t = prev
+			t.UpdatedAt = time.Now()
+		}
+		if t.Metadata == nil {
+			t.Metadata = map[string]string{}
+		}
+		update(t)
+		t.ChainBlock = block
+		return tx.Save(t).Error
+	})
+	return errors.Wrapf(err, "failed to update project %d", projectID)
+}
+
+func (d *DB) UpdateProjectContractOwner(block uint64, contract common.Address, owner common.Address) error {
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		prev := &ProjectContract{}
+		if err := tx.Where("address = ?", contract.String()).First(prev).Error; err != nil {
+			if err != gorm.ErrRecordNotFound {
+				return errors.Wrap(err, "failed to query project contract")
+			}
+			prev = nil
+		}
+		if prev != nil && prev.ChainBlock > block {
+			return nil
+		}
+		if err := journal(tx, block, journalProjectContract, contract.String(), prev); err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "address"}},
+			DoUpdates: clause.AssignmentColumns([]string{"owner", "chain_block", "updated_at"}),
+		}).Create(&ProjectContract{
+			Address:        contract.String(),
+			Owner:          owner.String(),
+			ChainBlock:     block,
+			OperationTimes: NewOperationTimes(),
+		}).Error
+	})
+	return errors.Wrap(err, "failed to update project contract owner")
+}
+
+func (d *DB) Project(id uint64) (*Project, error) {
+	t := Project{}
+	if err := d.db.Where("id = ?", id).First(&t).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to query project")
+	}
+	return &t, nil
+}
+
+func (d *DB) Projects() ([]*Project, error) {
+	ts := []*Project{}
+	err := d.db.Order("id ASC").Find(&ts).Error
+	return ts, errors.Wrap(err, "failed to query projects")
+}
+
+func (d *DB) ProjectContracts() ([]*ProjectContract, error) {
+	ts := []*ProjectContract{}
+	err := d.db.Order("address ASC").Find(&ts).Error
+	return ts, errors.Wrap(err, "failed to query project contracts")
+}
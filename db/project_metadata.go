@@ -0,0 +1,148 @@
+package db
+
+import (
+	"log/slog"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// ProjectMetadata is a version of a project metadata value, every AddMetadata event of a served
+// project adds a new version of its key
+type ProjectMetadata struct {
+	ID          uint64 `gorm:"primary_key"`
+	ProjectID   uint64 `gorm:"index:project_metadata_project_id_key;not null"`
+	Key         string `gorm:"index:project_metadata_project_id_key;not null"`
+	Name        string `gorm:"not null;default:''"`
+	Value       []byte
+	Version     uint64 `gorm:"not null;default:0"`
+	BlockNumber uint64 `gorm:"index:project_metadata_block_number;not null"`
+	TxHash      string `gorm:"index:project_metadata_tx_hash;not null;default:''"`
+	LogIndex    uint   `gorm:"not null;default:0"`
+
+	OperationTimes
+}
+
+func (*ProjectMetadata) TableName() string { return "project_metadata" }
+
+// QuarantinedMetadata keeps the metadata values a decoder failed to decode
+type QuarantinedMetadata struct {
+	ID          uint64 `gorm:"primary_key"`
+	MetadataID  uint64 `gorm:"not null"`
+	ProjectID   uint64 `gorm:"index:metadata_quarantine_project_id;not null"`
+	Key         string `gorm:"not null"`
+	Name        string `gorm:"not null;default:''"`
+	Value       []byte
+	BlockNumber uint64 `gorm:"index:metadata_quarantine_block_number;not null"`
+	TxHash      string `gorm:"not null;default:''"`
+	Decoder     string `gorm:"not null;default:''"`
+	Reason      string `gorm:"not null;default:''"`
+
+	OperationTimes
+}
+
+func (*QuarantinedMetadata) TableName() string { return "metadata_quarantine" }
+
+// MalformedMetadataError is returned by a decoder if the metadata value can not be decoded,
+// the value is quarantined instead of failing the block
+type MalformedMetadataError struct {
+	Reason string
+}
+
+func (e *MalformedMetadataError) Error() string {
+	return "malformed metadata: " + e.Reason
+}
+
+// MetadataDecoder derives rows from the metadata values of a key, it writes with tx so the derived rows
+// are committed together with the metadata
+type MetadataDecoder struct {
+	Name   string
+	Decode func(tx *gorm.DB, block uint64, m *ProjectMetadata) error
+}
+
+type metadataDecoderKey struct {
+	projectID uint64
+	key       common.Hash
+}
+
+// RegisterMetadataDecoder decodes the metadata of key of the project with dec, it should be called before
+// the monitor starts
+func (d *DB) RegisterMetadataDecoder(projectID uint64, key common.Hash, dec *MetadataDecoder) {
+	k := metadataDecoderKey{projectID: projectID, key: key}
+	d.decoders[k] = append(d.decoders[k], dec)
+}
+
+// UpsertProjectMetadata adds a new version of the metadata emitted by log and runs the decoders registered
+// for its key, a log which has been recorded is skipped
+func (d *DB) UpsertProjectMetadata(l *types.Log, projectID uint64, name string, key [32]byte, value []byte) error {
+	block, txHash := l.BlockNumber, l.TxHash
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		var n int64
+		if err := tx.Model(&ProjectMetadata{}).Where("tx_hash = ? AND log_index = ?", txHash.Hex(), l.Index).
+			Count(&n).Error; err != nil {
+			return errors.Wrap(err, "failed to query project metadata")
+		}
+		if n > 0 {
+			return nil
+		}
+		var version uint64
+		if err := tx.Model(&ProjectMetadata{}).Select("COALESCE(MAX(version), 0)").
+			Where("project_id = ? AND key = ?", projectID, common.Hash(key).Hex()).Scan(&version).Error; err != nil {
+			return errors.Wrap(err, "failed to query metadata version")
+		}
+		m := &ProjectMetadata{
+			ProjectID:      projectID,
+			Key:            common.Hash(key).Hex(),
+			Name:           name,
+			Value:          value,
+			Version:        version + 1,
+			BlockNumber:    block,
+			TxHash:         txHash.Hex(),
+			LogIndex:       l.Index,
+			OperationTimes: NewOperationTimes(),
+		}
+		if err := tx.Create(m).Error; err != nil {
+			return errors.Wrap(err, "failed to create project metadata")
+		}
+
+		for _, dec := range d.decoders[metadataDecoderKey{projectID: projectID, key: key}] {
+			err := dec.Decode(tx, block, m)
+			var malformed *MalformedMetadataError
+			if !errors.As(err, &malformed) {
+				if err != nil {
+					return errors.Wrapf(err, "failed to decode metadata with %s decoder", dec.Name)
+				}
+				continue
+			}
+			slog.Warn("quarantine malformed project metadata", "project_id", projectID, "name", name,
+				"decoder", dec.Name, "reason", malformed.Reason, "block_number", block)
+			if err := tx.Create(&QuarantinedMetadata{
+				MetadataID:     m.ID,
+				ProjectID:      projectID,
+				Key:            m.Key,
+				Name:           name,
+				Value:          value,
+				BlockNumber:    block,
+				TxHash:         m.TxHash,
+				Decoder:        dec.Name,
+				Reason:         malformed.Reason,
+				OperationTimes: NewOperationTimes(),
+			}).Error; err != nil {
+				return errors.Wrap(err, "failed to quarantine project metadata")
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "failed to upsert project metadata")
+}
+
+// rollbackProjectMetadata deletes the metadata versions and quarantined values of the blocks after ancestor
+func rollbackProjectMetadata(tx *gorm.DB, ancestor uint64) error {
+	if err := tx.Where("block_number > ?", ancestor).Delete(&QuarantinedMetadata{}).Error; err != nil {
+		return errors.Wrap(err, "failed to delete rolled back quarantined metadata")
+	}
+	err := tx.Where("block_number > ?", ancestor).Delete(&ProjectMetadata{}).Error
+	return errors.Wrap(err, "failed to delete rolled back project metadata")
+}
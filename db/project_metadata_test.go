@@ -0,0 +1,132 @@
+package db
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+func countRows(t *testing.T, d *DB, m any) int64 {
+	t.Helper()
+	var n int64
+	if err := d.db.Model(m).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMalformedMetadataIsQuarantined(t *testing.T) {
+	d := newTestDB(t)
+	key := common.HexToHash("0x01")
+	d.RegisterMetadataDecoder(1, key, FirmwareDecoder)
+	upsert := func(block uint64, index uint, value string) {
+		t.Helper()
+		l := &types.Log{BlockNumber: block, TxHash: common.BigToHash(new(big.Int).SetUint64(block)), Index: index}
+		if err := d.UpsertProjectMetadata(l, 1, "firmware", key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upsert(10, 0, `{"name":"pebble","version":"1.0.0","url":"https://firmware/1.0.0"}`)
+	for i, value := range []string{
+		`{"name":"pebble","version":`,
+		`{"version":"2.0.0"}`,
+		`{"name":"pebble","version":"2.0.0","hash":"0x01"}`,
+	} {
+		upsert(11, uint(i), value)
+	}
+
+	app, err := d.App(1, "pebble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app == nil || app.Version != "1.0.0" || app.Uri != "https://firmware/1.0.0" {
+		t.Fatalf("the malformed values overwrite the current app: %+v", app)
+	}
+	qs := []*QuarantinedMetadata{}
+	if err := d.db.Order("id ASC").Find(&qs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(qs) != 3 {
+		t.Fatalf("expected 3 quarantined values, got %d", len(qs))
+	}
+	for _, q := range qs {
+		if q.ProjectID != 1 || q.Key != key.Hex() || q.Decoder != FirmwareDecoder.Name || q.Reason == "" ||
+			q.BlockNumber != 11 || q.MetadataID == 0 {
+			t.Errorf("unexpected quarantined value %+v", q)
+		}
+	}
+	// every value is kept as a version of the key, the malformed ones included
+	ms := []*ProjectMetadata{}
+	if err := d.db.Order("version ASC").Find(&ms).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 4 || ms[3].Version != 4 || string(ms[1].Value) != `{"name":"pebble","version":` {
+		t.Fatalf("unexpected metadata versions %+v", ms)
+	}
+}
+
+func TestProjectMetadataIsIdempotentByLog(t *testing.T) {
+	d := newTestDB(t)
+	key := common.HexToHash("0x01")
+	d.RegisterMetadataDecoder(1, key, FirmwareDecoder)
+	txHash := common.HexToHash("0x02")
+	upsert := func(index uint, value string) {
+		t.Helper()
+		l := &types.Log{BlockNumber: 10, TxHash: txHash, Index: index}
+		if err := d.UpsertProjectMetadata(l, 1, "firmware", key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a resync applies the logs again
+	for range 2 {
+		upsert(0, `{"name":"pebble","version":"1.0.0"}`)
+		upsert(1, `{"name":`)
+	}
+	if n := countRows(t, d, &ProjectMetadata{}); n != 2 {
+		t.Fatalf("expected a version of each log, got %d", n)
+	}
+	if n := countRows(t, d, &QuarantinedMetadata{}); n != 1 {
+		t.Fatalf("expected the malformed log to be quarantined once, got %d", n)
+	}
+
+	// another log of the same transaction is a new version
+	upsert(2, `{"name":"pebble","version":"1.0.1"}`)
+	if n := countRows(t, d, &ProjectMetadata{}); n != 3 {
+		t.Fatalf("expected 3 versions, got %d", n)
+	}
+	app, err := d.App(1, "pebble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app == nil || app.Version != "1.0.1" {
+		t.Fatalf("unexpected app %+v", app)
+	}
+}
+
+func TestMetadataDecoderErrorFailsTheLog(t *testing.T) {
+	d := newTestDB(t)
+	key := common.HexToHash("0x01")
+	d.RegisterMetadataDecoder(1, key, &MetadataDecoder{
+		Name: "failing",
+		Decode: func(*gorm.DB, uint64, *ProjectMetadata) error {
+			return errors.New("connection reset")
+		},
+	})
+	l := &types.Log{BlockNumber: 10, TxHash: common.HexToHash("0x02")}
+	if err := d.UpsertProjectMetadata(l, 1, "firmware", key, []byte(`{}`)); err == nil {
+		t.Fatal("expected the decoder error to fail the log")
+	}
+	// the log is processed again with the range, so nothing of it is kept
+	if n := countRows(t, d, &ProjectMetadata{}); n != 0 {
+		t.Fatalf("the metadata of the failed log is recorded")
+	}
+	if n := countRows(t, d, &QuarantinedMetadata{}); n != 0 {
+		t.Fatalf("the value of a failing decoder is quarantined")
+	}
+}
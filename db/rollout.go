@@ -0,0 +1,318 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	RolloutActive    = "active"
+	RolloutPaused    = "paused"
+	RolloutCompleted = "completed"
+	RolloutAborted   = "aborted"
+)
+
+const (
+	RolloutDevicePending   = "pending"   // served the rollout version, not reported it yet
+	RolloutDeviceUpdated   = "updated"   // reported the rollout version
+	RolloutDeviceFailed    = "failed"    // still reported another version after the grace period
+	RolloutDeviceRegressed = "regressed" // reported another version after it had been updated
+)
+
+// Rollout stages a firmware version of a project app to a cohort of the fleet, the cohort is the devices
+// of the allow list and a percentage of the others. Devices out of the cohort are served the base version.
+type Rollout struct {
+	ID                uint64   `gorm:"primary_key"`
+	ProjectID         uint64   `gorm:"index:rollout_project_id_firmware;not null"`
+	Firmware          string   `gorm:"index:rollout_project_id_firmware;not null"`
+	Version           string   `gorm:"not null;default:''"`
+	Uri               string   `gorm:"not null;default:''"`
+	Hash              string   `gorm:"not null;default:''"`
+	Size              uint64   `gorm:"not null;default:0"`
+	MinVersion        string   `gorm:"not null;default:''"`
+	BaseVersion       string   `gorm:"not null;default:''"`
+	BaseUri           string   `gorm:"not null;default:''"`
+	BaseHash          string   `gorm:"not null;default:''"`
+	BaseSize          uint64   `gorm:"not null;default:0"`
+	Percentage        uint32   `gorm:"not null;default:0"`
+	AllowList         []string `gorm:"serializer:json"`
+	Status            string   `gorm:"not null;default:''"`
+	PauseReason       string   `gorm:"not null;default:''"`
+	MaxFailureRate    float64  `gorm:"not null;default:0"`
+	MaxRegressionRate float64  `gorm:"not null;default:0"`
+	MinSamples        uint32   `gorm:"not null;default:0"`
+	GracePeriod       int64    `gorm:"not null;default:0"` // seconds a served device has to report the version
+
+	OperationTimes
+}
+
+func (*Rollout) TableName() string { return "rollout" }
+
+// RolloutDevice tracks the version a device of the cohort reported since it was served the rollout version
+type RolloutDevice struct {
+	RolloutID       uint64    `gorm:"primary_key;autoIncrement:false"`
+	DeviceID        string    `gorm:"primary_key"`
+	BaseVersion     string    `gorm:"not null;default:''"`
+	ReportedVersion string    `gorm:"not null;default:''"`
+	Status          string    `gorm:"not null;default:''"`
+	ServedAt        time.Time `gorm:"not null"`
+
+	OperationTimes
+}
+
+func (*RolloutDevice) TableName() string { return "rollout_device" }
+
+// RolloutConflictError is returned when a rollout is created for a firmware which has an open rollout
+type RolloutConflictError struct {
+	ID uint64
+}
+
+func (e *RolloutConflictError) Error() string {
+	return fmt.Sprintf("the firmware has an open rollout %d", e.ID)
+}
+
+// Open reports whether the rollout still controls the firmware served to the devices
+func (r *Rollout) Open() bool {
+	return r.Status == RolloutActive || r.Status == RolloutPaused
+}
+
+// InCohort reports whether the device is in the cohort of the rollout, devices are bucketed by the hash
+// of the rollout and device id, so a device stays in the cohort when the percentage grows
+func (r *Rollout) InCohort(deviceID string) bool {
+	if slices.Contains(r.AllowList, deviceID) {
+		return true
+	}
+	h := sha256.Sum256([]byte(fmt.Sprintf("%d/%s", r.ID, deviceID)))
+	return binary.BigEndian.Uint64(h[:8])%100 < uint64(r.Percentage)
+}
+
+func (d *DB) CreateRollout(r *Rollout) error {
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		open, err := openRollout(tx, r.ProjectID, r.Firmware)
+		if err != nil {
+			return err
+		}
+		if open != nil {
+			return &RolloutConflictError{ID: open.ID}
+		}
+		return tx.Create(r).Error
+	})
+	return errors.Wrap(err, "failed to create rollout")
+}
+
+// UpdateRollout applies update to the rollout and saves it, it returns nil if the rollout does not exist
+func (d *DB) UpdateRollout(id uint64, update func(r *Rollout) error) (*Rollout, error) {
+	var t *Rollout
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		r := &Rollout{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).First(r).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil
+			}
+			return err
+		}
+		if err := update(r); err != nil {
+			return err
+		}
+		r.UpdatedAt = time.Now()
+		if err := tx.Save(r).Error; err != nil {
+			return err
+		}
+		t = r
+		return nil
+	})
+	return t, errors.Wrapf(err, "failed to update rollout %d", id)
+}
+
+func (d *DB) Rollout(id uint64) (*Rollout, error) {
+	t := Rollout{}
+	if err := d.db.Where("id = ?", id).First(&t).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to query rollout")
+	}
+	return &t, nil
+}
+
+// Rollouts returns the rollouts of the project, newest first
+func (d *DB) Rollouts(projectID uint64, offset, limit int) ([]*Rollout, error) {
+	ts := []*Rollout{}
+	err := d.db.Where("project_id = ?", projectID).Order("id DESC").Offset(offset).Limit(limit).Find(&ts).Error
+	return ts, errors.Wrap(err, "failed to query rollouts")
+}
+
+// OpenRollout returns the active or paused rollout of the project firmware, or nil if there is none
+func (d *DB) OpenRollout(projectID uint64, firmware string) (*Rollout, error) {
+	t, err := openRollout(d.db, projectID, firmware)
+	return t, errors.Wrap(err, "failed to query open rollout")
+}
+
+// CompletedRollout returns the last completed rollout of the project firmware, or nil if there is none
+func (d *DB) CompletedRollout(projectID uint64, firmware string) (*Rollout, error) {
+	t := Rollout{}
+	if err := d.db.Where("project_id = ? AND firmware = ? AND status = ?", projectID, firmware, RolloutCompleted).
+		Order("updated_at DESC").First(&t).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to query completed rollout")
+	}
+	return &t, nil
+}
+
+func openRollout(tx *gorm.DB, projectID uint64, firmware string) (*Rollout, error) {
+	t := Rollout{}
+	if err := tx.Where("project_id = ? AND firmware = ? AND status IN ?", projectID, firmware,
+		[]string{RolloutActive, RolloutPaused}).Order("id DESC").First(&t).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ServeRollout records the device has been served the rollout version, a device is only recorded once
+func (d *DB) ServeRollout(rolloutID uint64, deviceID, baseVersion string) error {
+	err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&RolloutDevice{
+		RolloutID:      rolloutID,
+		DeviceID:       deviceID,
+		BaseVersion:    baseVersion,
+		Status:         RolloutDevicePending,
+		ServedAt:       time.Now(),
+		OperationTimes: NewOperationTimes(),
+	}).Error
+	return errors.Wrap(err, "failed to record rollout device")
+}
+
+// ReportRolloutVersion tracks the version reported by a device served the rollout version, and pauses the
+// active rollout once enough devices settled and the failure or regression rate exceeds its limit
+func (d *DB) ReportRolloutVersion(r *Rollout, deviceID, version string) error {
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		t := &RolloutDevice{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("rollout_id = ? AND device_id = ?", r.ID, deviceID).First(t).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil
+			}
+			return err
+		}
+		status := t.Status
+		switch {
+		case version == r.Version:
+			status = RolloutDeviceUpdated
+		case t.Status == RolloutDeviceUpdated:
+			status = RolloutDeviceRegressed
+		case t.Status == RolloutDevicePending && time.Since(t.ServedAt) > time.Duration(r.GracePeriod)*time.Second:
+			status = RolloutDeviceFailed
+		}
+		if status == t.Status && version == t.ReportedVersion {
+			return nil
+		}
+		if err := tx.Model(t).Updates(map[string]any{
+			"reported_version": version,
+			"status":           status,
+			"updated_at":       time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		if r.Status != RolloutActive || (status != RolloutDeviceFailed && status != RolloutDeviceRegressed) {
+			return nil
+		}
+		return pauseUnhealthyRollout(tx, r)
+	})
+	return errors.Wrapf(err, "failed to report rollout version, rollout %d", r.ID)
+}
+
+// PauseUnhealthyRollouts checks the health of the active rollouts, so the rollouts whose devices stopped
+// reporting after they were served are paused as well
+func (d *DB) PauseUnhealthyRollouts() error {
+	rs := []*Rollout{}
+	if err := d.db.Where("status = ?", RolloutActive).Find(&rs).Error; err != nil {
+		return errors.Wrap(err, "failed to query active rollouts")
+	}
+	for _, r := range rs {
+		if err := pauseUnhealthyRollout(d.db, r); err != nil {
+			return errors.Wrapf(err, "failed to check rollout %d", r.ID)
+		}
+	}
+	return nil
+}
+
+func pauseUnhealthyRollout(tx *gorm.DB, r *Rollout) error {
+	stats, err := rolloutStats(tx, r)
+	if err != nil {
+		return err
+	}
+	updated, failed, regressed := stats[RolloutDeviceUpdated], stats[RolloutDeviceFailed], stats[RolloutDeviceRegressed]
+	settled := updated + failed + regressed
+	if settled == 0 || settled < int64(r.MinSamples) {
+		return nil
+	}
+	reason := ""
+	if rate := float64(failed) / float64(settled); rate > r.MaxFailureRate {
+		reason = fmt.Sprintf("failure rate %.3f exceeds %.3f", rate, r.MaxFailureRate)
+	} else if rate := float64(regressed) / float64(updated+regressed); updated+regressed > 0 && rate > r.MaxRegressionRate {
+		reason = fmt.Sprintf("regression rate %.3f exceeds %.3f", rate, r.MaxRegressionRate)
+	}
+	if reason == "" {
+		return nil
+	}
+	res := tx.Model(&Rollout{}).Where("id = ? AND status = ?", r.ID, RolloutActive).Updates(map[string]any{
+		"status":       RolloutPaused,
+		"pause_reason": reason,
+		"updated_at":   time.Now(),
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		slog.Warn("rollout paused", "rollout_id", r.ID, "firmware", r.Firmware, "version", r.Version, "reason", reason)
+	}
+	return nil
+}
+
+// RolloutStats returns the number of the devices of the rollout by status
+func (d *DB) RolloutStats(r *Rollout) (map[string]int64, error) {
+	stats, err := rolloutStats(d.db, r)
+	return stats, errors.Wrap(err, "failed to query rollout stats")
+}
+
+// rolloutStats counts the devices of the rollout by status, the pending devices which have not reported the
+// rollout version within the grace period are counted as failed, as devices bricked by the update never report
+func rolloutStats(tx *gorm.DB, r *Rollout) (map[string]int64, error) {
+	rows := []struct {
+		Status string
+		Count  int64
+	}{}
+	if err := tx.Model(&RolloutDevice{}).Select("status, count(*) AS count").Where("rollout_id = ?", r.ID).
+		Group("status").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	var overdue int64
+	if err := tx.Model(&RolloutDevice{}).Where("rollout_id = ? AND status = ? AND served_at < ?", r.ID,
+		RolloutDevicePending, time.Now().Add(-time.Duration(r.GracePeriod)*time.Second)).Count(&overdue).Error; err != nil {
+		return nil, err
+	}
+	stats := map[string]int64{
+		RolloutDevicePending:   0,
+		RolloutDeviceUpdated:   0,
+		RolloutDeviceFailed:    0,
+		RolloutDeviceRegressed: 0,
+	}
+	for _, row := range rows {
+		stats[row.Status] = row.Count
+	}
+	stats[RolloutDevicePending] -= overdue
+	stats[RolloutDeviceFailed] += overdue
+	return stats, nil
+}
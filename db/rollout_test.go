@@ -0,0 +1,175 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOverdueRolloutDevicesCountAsFailed(t *testing.T) {
+	d := newTestDB(t)
+	r := &Rollout{
+		ProjectID:      1,
+		Firmware:       "pebble",
+		Version:        "2.0",
+		Percentage:     100,
+		Status:         RolloutActive,
+		MaxFailureRate: 0.2,
+		MinSamples:     4,
+		GracePeriod:    3600,
+		OperationTimes: NewOperationTimes(),
+	}
+	if err := d.CreateRollout(r); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := d.ServeRollout(r.ID, fmt.Sprintf("device%d", i), "1.0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// two devices were served before the grace period and never reported
+	if err := d.db.Model(&RolloutDevice{}).Where("device_id IN ?", []string{"device0", "device1"}).
+		Update("served_at", time.Now().Add(-2*time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"device2", "device3"} {
+		if err := d.ReportRolloutVersion(r, id, "2.0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := d.RolloutStats(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[RolloutDevicePending] != 0 || stats[RolloutDeviceFailed] != 2 || stats[RolloutDeviceUpdated] != 2 {
+		t.Errorf("unexpected rollout stats %v", stats)
+	}
+
+	if err := d.PauseUnhealthyRollouts(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.Rollout(r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != RolloutPaused {
+		t.Errorf("rollout with overdue devices is not paused, status %s", got.Status)
+	}
+}
+
+func TestInCohortIsStableAsPercentageGrows(t *testing.T) {
+	devices := make([]string, 2000)
+	for i := range devices {
+		devices[i] = fmt.Sprintf("did:io:%040x", i)
+	}
+	r := &Rollout{ID: 7, AllowList: []string{devices[0]}}
+	prev := map[string]bool{}
+	for p := uint32(0); p <= 100; p += 5 {
+		r.Percentage = p
+		cohort := map[string]bool{}
+		for _, id := range devices {
+			if r.InCohort(id) {
+				cohort[id] = true
+			}
+		}
+		for id := range prev {
+			if !cohort[id] {
+				t.Fatalf("device %s leaves the cohort when the percentage grows to %d", id, p)
+			}
+		}
+		if !cohort[devices[0]] {
+			t.Fatalf("the allowed device is not in the cohort of %d%%", p)
+		}
+		// the cohort is the allowed device and about p% of the others
+		want := float64(len(devices)-1) * float64(p) / 100
+		if got := float64(len(cohort) - 1); got < want-100 || got > want+100 {
+			t.Errorf("got %v devices in the cohort of %d%%, want about %v", got, p, want)
+		}
+		prev = cohort
+	}
+	if len(prev) != len(devices) {
+		t.Fatalf("expected every device in the cohort of 100%%, got %d", len(prev))
+	}
+
+	// another rollout buckets the devices independently
+	other := &Rollout{ID: 8, Percentage: 50}
+	r.Percentage, r.AllowList = 50, nil
+	same := 0
+	for _, id := range devices {
+		if r.InCohort(id) == other.InCohort(id) {
+			same++
+		}
+	}
+	if same == len(devices) {
+		t.Error("the cohorts of different rollouts are the same")
+	}
+}
+
+func TestPauseUnhealthyRolloutsThreshold(t *testing.T) {
+	d := newTestDB(t)
+	cases := []struct {
+		name                       string
+		updated, failed, regressed int
+		pending                    int
+		minSamples                 uint32
+		paused                     bool
+		reason                     string
+	}{
+		{name: "below min samples", updated: 2, failed: 1, minSamples: 4},
+		{name: "pending devices are not samples", updated: 2, failed: 1, pending: 10, minSamples: 4},
+		{name: "at the failure rate", updated: 3, failed: 1, minSamples: 4},
+		{name: "above the failure rate", updated: 3, failed: 2, minSamples: 4, paused: true,
+			reason: "failure rate 0.400 exceeds 0.250"},
+		{name: "at the regression rate", updated: 9, regressed: 1, minSamples: 4},
+		{name: "above the regression rate", updated: 8, regressed: 2, minSamples: 4, paused: true,
+			reason: "regression rate 0.200 exceeds 0.100"},
+	}
+	rollouts := make([]*Rollout, len(cases))
+	for i, c := range cases {
+		r := &Rollout{
+			ProjectID:         1,
+			Firmware:          fmt.Sprintf("firmware%d", i),
+			Version:           "2.0",
+			Percentage:        100,
+			Status:            RolloutActive,
+			MaxFailureRate:    0.25,
+			MaxRegressionRate: 0.1,
+			MinSamples:        c.minSamples,
+			GracePeriod:       3600,
+			OperationTimes:    NewOperationTimes(),
+		}
+		if err := d.CreateRollout(r); err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for status, count := range map[string]int{
+			RolloutDeviceUpdated:   c.updated,
+			RolloutDeviceFailed:    c.failed,
+			RolloutDeviceRegressed: c.regressed,
+			RolloutDevicePending:   c.pending,
+		} {
+			for range count {
+				n++
+				if err := d.db.Create(&RolloutDevice{RolloutID: r.ID, DeviceID: fmt.Sprintf("device%d", n),
+					Status: status, ServedAt: time.Now(), OperationTimes: NewOperationTimes()}).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		rollouts[i] = r
+	}
+
+	if err := d.PauseUnhealthyRollouts(); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range cases {
+		r, err := d.Rollout(rollouts[i].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paused := r.Status == RolloutPaused; paused != c.paused || r.PauseReason != c.reason {
+			t.Errorf("%s: got status %s with reason %q", c.name, r.Status, r.PauseReason)
+		}
+	}
+}
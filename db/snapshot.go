@@ -0,0 +1,61 @@
+package db
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// IndexSnapshot is the state indexed from the chain events in the primary db, keyed by row identity
+type IndexSnapshot struct {
+	Devices  map[string]*Device
+	Apps     map[string]*App
+	AppsV2   map[string]*AppV2
+	Projects map[string]*Project
+}
+
+func (d *DB) IndexSnapshot() (*IndexSnapshot, error) {
+	devices := []*Device{}
+	if err := d.db.Find(&devices).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to query devices")
+	}
+	apps := []*App{}
+	if err := d.db.Find(&apps).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to query apps")
+	}
+	appsV2 := []*AppV2{}
+	if err := d.db.Find(&appsV2).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to query apps v2")
+	}
+	projects := []*Project{}
+	if err := d.db.Find(&projects).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to query projects")
+	}
+
+	s := &IndexSnapshot{
+		Devices:  make(map[string]*Device, len(devices)),
+		Apps:     make(map[string]*App, len(apps)),
+		AppsV2:   make(map[string]*AppV2, len(appsV2)),
+		Projects: make(map[string]*Project, len(projects)),
+	}
+	for _, t := range devices {
+		s.Devices[t.ID] = t
+	}
+	for _, t := range apps {
+		s.Apps[appJournalKey(t.ProjectID, t.ID)] = t
+	}
+	for _, t := range appsV2 {
+		s.AppsV2[appJournalKey(t.ProjectID, t.ID)] = t
+	}
+	for _, t := range projects {
+		s.Projects[strconv.FormatUint(t.ID, 10)] = t
+	}
+	return s, nil
+}
+
+// DevicesOfProjects returns the devices of the projects from the primary db
+func (d *DB) DevicesOfProjects(projectIDs []uint64) ([]*Device, error) {
+	ts := []*Device{}
+	err := d.db.Where("project_id IN ?", projectIDs).Order("id ASC").Find(&ts).Error
+	return ts, errors.Wrap(err, "failed to query devices of projects")
+}
@@ -1,6 +1,9 @@
 package db
 
-import "time"
+import (
+	"strconv"
+	"time"
+)
 
 func NewOperationTimes() OperationTimes {
 	return OperationTimes{
@@ -13,3 +16,40 @@ type OperationTimes struct {
 	CreatedAt time.Time `gorm:"not null"`
 	UpdatedAt time.Time `gorm:"not null"`
 }
+
+func toInt64(v any) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case []byte:
+		n, _ := strconv.ParseInt(string(v), 10, 64)
+		return n
+	case *any:
+		// drivers which can not type an expression column leave it boxed
+		return toInt64(*v)
+	}
+	return 0
+}
+
+func toFloat64(v any) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case []byte:
+		f, _ := strconv.ParseFloat(string(v), 64)
+		return f
+	case *any:
+		return toFloat64(*v)
+	}
+	return 0
+}
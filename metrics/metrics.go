@@ -29,12 +29,27 @@ var (
 		},
 		[]string{"method"},
 	)
+	chainLag = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "monitor_block_lag",
+			Help: "Number of confirmed blocks the contract monitor is behind.",
+		},
+	)
+	dbSourceActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "db_source_active",
+			Help: "Whether the database source is active, 1 for active and 0 for inactive.",
+		},
+		[]string{"source"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(deviceRequestsTotal)
 	prometheus.MustRegister(httpRequestsTotal)
 	prometheus.MustRegister(httpDurationHistogram)
+	prometheus.MustRegister(dbSourceActive)
+	prometheus.MustRegister(chainLag)
 }
 
 func TrackDeviceCount(deviceID string) {
@@ -48,3 +63,15 @@ func TrackRequestCount(method string) {
 func TrackRequestDuration(method string, duration time.Duration) {
 	httpDurationHistogram.WithLabelValues(method).Observe(float64(duration))
 }
+
+func TrackDBSource(source string, active bool) {
+	v := 0.0
+	if active {
+		v = 1
+	}
+	dbSourceActive.WithLabelValues(source).Set(v)
+}
+
+func TrackChainLag(blocks uint64) {
+	chainLag.Set(float64(blocks))
+}
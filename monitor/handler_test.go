@@ -0,0 +1,265 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"gorm.io/driver/sqlite"
+
+	"github.com/iotexproject/pebble-server/contract/ioid"
+	"github.com/iotexproject/pebble-server/contract/project"
+	"github.com/iotexproject/pebble-server/db"
+)
+
+var testContractAddr = &ContractAddr{
+	Project: common.HexToAddress("0x00000000000000000000000000000000000000a1"),
+	IoID:    common.HexToAddress("0x00000000000000000000000000000000000000a2"),
+}
+
+func mustABI(m interface{ GetAbi() (*abi.ABI, error) }) *abi.ABI {
+	a, err := m.GetAbi()
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+var (
+	ioidABI    = mustABI(ioid.IoidMetaData)
+	projectABI = mustABI(project.ProjectMetaData)
+)
+
+// newTestDB returns a db on an in-memory sqlite database
+func newTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	d, err := db.Open(sqlite.Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// newTestContract returns the contract monitor of the given projects which applies the logs of eth to d
+func newTestContract(t *testing.T, d *db.DB, eth *fakeEth, projectIDs ...uint64) *contract {
+	t.Helper()
+	c, err := newContract(NewHandler(d), testContractAddr, projectIDs, newFakeClient(t, eth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func addressTopic(a common.Address) common.Hash {
+	return common.BytesToHash(a.Bytes())
+}
+
+func uintTopic(n int64) common.Hash {
+	return common.BigToHash(big.NewInt(n))
+}
+
+// emit appends the log of the event emitted by address in block, the indexed arguments are given as topics
+// and the others as args
+func (e *fakeEth) emit(t *testing.T, a *abi.ABI, event string, address common.Address, block uint64, topics []common.Hash, args ...any) types.Log {
+	t.Helper()
+	ev, ok := a.Events[event]
+	if !ok {
+		t.Fatalf("unknown event %s", event)
+	}
+	data, err := ev.Inputs.NonIndexed().Pack(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := types.Log{
+		Address:     address,
+		Topics:      append([]common.Hash{ev.ID}, topics...),
+		Data:        data,
+		BlockNumber: block,
+		BlockHash:   e.blocks[block].Hash,
+		TxHash:      common.BytesToHash([]byte{byte(block), byte(len(e.logs))}),
+	}
+	for _, prev := range e.logs {
+		if prev.BlockNumber == block {
+			l.Index++
+		}
+	}
+	e.logs = append(e.logs, l)
+	return l
+}
+
+func TestSyncCommitsNothingIfALogFails(t *testing.T) {
+	d := newTestDB(t)
+	owner := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	buyer := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	device := deviceDID(common.HexToAddress("0x00000000000000000000000000000000000000d1"))
+	if err := d.UpsertDevice(1, &db.Device{ID: device, NFTID: "1", ProjectID: 1, Owner: owner.String(),
+		OperationTimes: db.NewOperationTimes()}); err != nil {
+		t.Fatal(err)
+	}
+	chain := newFakeChain(0xa, 10)
+	if err := d.UpsertScannedBlock(9, chain[9].Hash); err != nil {
+		t.Fatal(err)
+	}
+	eth := &fakeEth{blocks: chain}
+	c := newTestContract(t, d, eth, 1)
+
+	eth.emit(t, ioidABI, "Transfer", testContractAddr.IoID, 10,
+		[]common.Hash{addressTopic(owner), addressTopic(buyer), uintTopic(1)})
+	eth.emit(t, ioidABI, "RemoveDIDWallet", testContractAddr.IoID, 10,
+		[]common.Hash{addressTopic(common.HexToAddress("0xd1"))}, device)
+	// the third log misses its indexed token id
+	eth.emit(t, ioidABI, "Transfer", testContractAddr.IoID, 10,
+		[]common.Hash{addressTopic(owner), addressTopic(buyer)})
+
+	err := c.sync(context.Background(), c.filterQuery(), 10, 10)
+	if err == nil || !strings.Contains(err.Error(), "failed to parse erc721 transfer event") {
+		t.Fatalf("expected the malformed log to fail the range, got %v", err)
+	}
+	got, err := d.Device(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Owner != owner.String() || got.Status != db.CONFIRM {
+		t.Fatalf("the events before the failing log are committed: owner %s, status %d", got.Owner, got.Status)
+	}
+	if cs, err := d.DeviceStatusChanges(device); err != nil || len(cs) != 0 {
+		t.Fatalf("status changes of the failed range are committed: %v %v", cs, err)
+	}
+	if n, err := d.ScannedBlockNumber(); err != nil || n != 9 {
+		t.Fatalf("the scanned height of the failed range is committed: %d %v", n, err)
+	}
+
+	// the range is applied once the failing log is gone
+	eth.logs = eth.logs[:2]
+	if err := c.sync(context.Background(), c.filterQuery(), 10, 10); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = d.Device(device); err != nil {
+		t.Fatal(err)
+	}
+	if got.Owner != buyer.String() || got.Status != db.DEACTIVATED {
+		t.Fatalf("the events of the range are not applied: owner %s, status %d", got.Owner, got.Status)
+	}
+	if n, err := d.ScannedBlockNumber(); err != nil || n != 10 {
+		t.Fatalf("unexpected scanned height %d %v", n, err)
+	}
+}
+
+func TestBurnAndRemoveDIDWalletDeactivateDevices(t *testing.T) {
+	d := newTestDB(t)
+	owner := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	burned := deviceDID(common.HexToAddress("0x00000000000000000000000000000000000000d1"))
+	unwalleted := deviceDID(common.HexToAddress("0x00000000000000000000000000000000000000d2"))
+	for i, id := range []string{burned, unwalleted} {
+		if err := d.UpsertDevice(1, &db.Device{ID: id, NFTID: fmt.Sprint(i + 1), ProjectID: 1, Owner: owner.String(),
+			OperationTimes: db.NewOperationTimes()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chain := newFakeChain(0xa, 10)
+	if err := d.UpsertScannedBlock(9, chain[9].Hash); err != nil {
+		t.Fatal(err)
+	}
+	eth := &fakeEth{blocks: chain}
+	c := newTestContract(t, d, eth, 1)
+
+	burn := eth.emit(t, ioidABI, "Transfer", testContractAddr.IoID, 10,
+		[]common.Hash{addressTopic(owner), addressTopic(common.Address{}), uintTopic(1)})
+	remove := eth.emit(t, ioidABI, "RemoveDIDWallet", testContractAddr.IoID, 10,
+		[]common.Hash{addressTopic(common.HexToAddress("0xd2"))}, unwalleted)
+	if err := c.sync(context.Background(), c.filterQuery(), 10, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct {
+		id     string
+		l      types.Log
+		reason string
+	}{
+		{burned, burn, db.StatusReasonIoIDBurned},
+		{unwalleted, remove, db.StatusReasonWalletRemoved},
+	} {
+		got, err := d.Device(want.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != db.DEACTIVATED {
+			t.Errorf("%s: got status %d, want deactivated", want.reason, got.Status)
+		}
+		cs, err := d.DeviceStatusChanges(want.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cs) != 1 {
+			t.Fatalf("%s: expected one status change, got %d", want.reason, len(cs))
+		}
+		if ch := cs[0]; ch.PrevStatus != db.CONFIRM || ch.Status != db.DEACTIVATED || ch.Reason != want.reason ||
+			ch.BlockNumber != 10 || ch.TxHash != want.l.TxHash.Hex() {
+			t.Errorf("%s: unexpected status change %+v", want.reason, ch)
+		}
+	}
+}
+
+func TestSyncIndexesProjects(t *testing.T) {
+	d := newTestDB(t)
+	chain := newFakeChain(0xa, 11)
+	if err := d.UpsertScannedBlock(9, chain[9].Hash); err != nil {
+		t.Fatal(err)
+	}
+	eth := &fakeEth{blocks: chain}
+	c := newTestContract(t, d, eth, 1)
+	owner := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	admin := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	op1 := common.HexToAddress("0x00000000000000000000000000000000000000e1")
+	op2 := common.HexToAddress("0x00000000000000000000000000000000000000e2")
+
+	eth.emit(t, projectABI, "Transfer", testContractAddr.Project, 10,
+		[]common.Hash{addressTopic(common.Address{}), addressTopic(owner), uintTopic(1)})
+	eth.emit(t, projectABI, "SetName", testContractAddr.Project, 10, []common.Hash{uintTopic(1)}, "pebble")
+	eth.emit(t, projectABI, "AddOperator", testContractAddr.Project, 10, []common.Hash{uintTopic(1)}, op1)
+	eth.emit(t, projectABI, "AddOperator", testContractAddr.Project, 10, []common.Hash{uintTopic(1)}, op2)
+	eth.emit(t, projectABI, "AddOperator", testContractAddr.Project, 10, []common.Hash{uintTopic(1)}, op1)
+	eth.emit(t, projectABI, "OwnershipTransferred", testContractAddr.Project, 10,
+		[]common.Hash{addressTopic(owner), addressTopic(admin)})
+	// the events of the projects which are not monitored and the ownership of other contracts are skipped
+	eth.emit(t, projectABI, "SetName", testContractAddr.Project, 10, []common.Hash{uintTopic(2)}, "other")
+	eth.emit(t, projectABI, "AddOperator", testContractAddr.Project, 10, []common.Hash{uintTopic(2)}, op1)
+	eth.emit(t, projectABI, "OwnershipTransferred", testContractAddr.IoID, 10,
+		[]common.Hash{addressTopic(owner), addressTopic(admin)})
+
+	eth.emit(t, projectABI, "RemoveOperator", testContractAddr.Project, 11, []common.Hash{uintTopic(1)}, op1)
+	eth.emit(t, projectABI, "SetName", testContractAddr.Project, 11, []common.Hash{uintTopic(1)}, "pebble v2")
+
+	if err := c.sync(context.Background(), c.filterQuery(), 10, 11); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := d.Project(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil {
+		t.Fatal("project 1 is not indexed")
+	}
+	if p.Name != "pebble v2" || p.Owner != owner.String() || p.ChainBlock != 11 {
+		t.Errorf("unexpected project %+v", p)
+	}
+	if len(p.Operators) != 1 || p.Operators[0] != op2.String() {
+		t.Errorf("unexpected operators %v", p.Operators)
+	}
+	if p, err := d.Project(2); err != nil || p != nil {
+		t.Errorf("the project which is not monitored is indexed: %+v %v", p, err)
+	}
+	cs, err := d.ProjectContracts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 1 || cs[0].Address != testContractAddr.Project.String() || cs[0].Owner != admin.String() {
+		t.Errorf("unexpected project contracts %+v", cs)
+	}
+}
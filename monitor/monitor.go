@@ -2,6 +2,7 @@ package monitor
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"math/big"
 	"sort"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
@@ -17,29 +19,78 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/iotexproject/pebble-server/contract/ioid"
+	"github.com/iotexproject/pebble-server/contract/ioidregistry"
 	"github.com/iotexproject/pebble-server/contract/project"
 	"github.com/iotexproject/pebble-server/db"
+	"github.com/iotexproject/pebble-server/metrics"
 )
 
 type (
-	ScannedBlockNumber       func() (uint64, error)
-	UpsertScannedBlockNumber func(uint64) error
-	UpsertProjectMetadata    func(projectID uint64, key [32]byte, value []byte) error
-	UpsertDevice             func(t *db.Device) error
-	UpdateDeviceOwner        func(*big.Int, common.Address) error
+	ScannedBlockNumber    func() (uint64, error)
+	UpsertScannedBlock    func(uint64, common.Hash) error
+	ScannedBlockHash      func(uint64) (common.Hash, error)
+	ScannedBlocks         func() ([]*db.ScannedBlock, error)
+	RollbackBlocks        func(ancestor uint64) error
+	UpsertProjectMetadata func(l *types.Log, projectID uint64, name string, key [32]byte, value []byte) error
+	UpsertDevice          func(block uint64, t *db.Device) error
+	UpdateDeviceOwner     func(block uint64, nftID *big.Int, owner common.Address) error
+	UpdateDeviceDocument  func(block uint64, id string, uri string, hash [32]byte) error
+	RemoveDevice          func(block uint64, tx common.Hash, id string) error
+	DeactivateDevice      func(block uint64, tx common.Hash, id string, reason string) error
+	DeactivateDeviceByNFT func(block uint64, tx common.Hash, nftID *big.Int, reason string) error
+	UpdateProject         func(block uint64, projectID uint64, update func(p *db.Project)) error
+	UpdateContractOwner   func(block uint64, contract common.Address, owner common.Address) error
+	// Transaction runs fn with a handler whose writes are committed together
+	Transaction func(fn func(h *Handler) error) error
 )
 
 type Handler struct {
 	ScannedBlockNumber
-	UpsertScannedBlockNumber
+	UpsertScannedBlock
+	ScannedBlockHash
+	ScannedBlocks
+	RollbackBlocks
 	UpsertProjectMetadata
 	UpsertDevice
 	UpdateDeviceOwner
+	UpdateDeviceDocument
+	RemoveDevice
+	DeactivateDevice
+	DeactivateDeviceByNFT
+	UpdateProject
+	UpdateContractOwner
+	Transaction
+}
+
+// NewHandler returns the handler which applies the chain events to d
+func NewHandler(d *db.DB) *Handler {
+	return &Handler{
+		ScannedBlockNumber:    d.ScannedBlockNumber,
+		UpsertScannedBlock:    d.UpsertScannedBlock,
+		ScannedBlockHash:      d.ScannedBlockHash,
+		ScannedBlocks:         d.ScannedBlocks,
+		RollbackBlocks:        d.RollbackBlocks,
+		UpsertProjectMetadata: d.UpsertProjectMetadata,
+		UpsertDevice:          d.UpsertDevice,
+		UpdateDeviceOwner:     d.UpdateOwner,
+		UpdateDeviceDocument:  d.UpdateDeviceDocument,
+		RemoveDevice:          d.RemoveDevice,
+		DeactivateDevice:      d.DeactivateDevice,
+		DeactivateDeviceByNFT: d.DeactivateDeviceByNFT,
+		UpdateProject:         d.UpdateProject,
+		UpdateContractOwner:   d.UpdateProjectContractOwner,
+		Transaction: func(fn func(h *Handler) error) error {
+			return d.Transaction(func(tx *db.DB) error {
+				return fn(NewHandler(tx))
+			})
+		},
+	}
 }
 
 type ContractAddr struct {
-	IoID    common.Address
-	Project common.Address
+	IoID         common.Address
+	Project      common.Address
+	IoIDRegistry common.Address // optional, the device documents are not indexed if empty
 }
 
 type contract struct {
@@ -47,31 +98,89 @@ type contract struct {
 	addr                 *ContractAddr
 	beginningBlockNumber uint64
 	listStepSize         uint64
-	ioIDProjectID        uint64
+	projects             map[uint64]bool
+	confirmations        uint64
 	watchInterval        time.Duration
+	maxWatchInterval     time.Duration
 	client               *ethclient.Client
+	sub                  *subscription
 	projectInstance      *project.Project
 	ioidInstance         *ioid.Ioid
+	registryInstance     *ioidregistry.Ioidregistry
 }
 
 var (
 	projectAddMetadataTopic = crypto.Keccak256Hash([]byte("AddMetadata(uint256,string,bytes32,bytes)"))
 	createIoIDTopic         = crypto.Keccak256Hash([]byte("CreateIoID(address,uint256,address,string)"))
 	erc721TransferTopic     = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+	newDeviceTopic          = crypto.Keccak256Hash([]byte("NewDevice(address,address,bytes32)"))
+	updateDeviceTopic       = crypto.Keccak256Hash([]byte("UpdateDevice(address,address,bytes32)"))
+	removeDeviceTopic       = crypto.Keccak256Hash([]byte("RemoveDevice(address,address)"))
+	removeDIDWalletTopic    = crypto.Keccak256Hash([]byte("RemoveDIDWallet(address,string)"))
+	addOperatorTopic        = crypto.Keccak256Hash([]byte("AddOperator(uint256,address)"))
+	removeOperatorTopic     = crypto.Keccak256Hash([]byte("RemoveOperator(uint256,address)"))
+	setNameTopic            = crypto.Keccak256Hash([]byte("SetName(uint256,string)"))
+	ownershipTransferTopic  = crypto.Keccak256Hash([]byte("OwnershipTransferred(address,address)"))
 )
 
 var allTopic = []common.Hash{
 	projectAddMetadataTopic,
 	createIoIDTopic,
 	erc721TransferTopic,
+	newDeviceTopic,
+	updateDeviceTopic,
+	removeDeviceTopic,
+	removeDIDWalletTopic,
+	addOperatorTopic,
+	removeOperatorTopic,
+	setNameTopic,
+	ownershipTransferTopic,
+}
+
+func (c *contract) filterQuery() ethereum.FilterQuery {
+	addrs := []common.Address{c.addr.Project, c.addr.IoID}
+	if c.registryEnabled() {
+		addrs = append(addrs, c.addr.IoIDRegistry)
+	}
+	return ethereum.FilterQuery{
+		Addresses: addrs,
+		Topics:    [][]common.Hash{allTopic},
+	}
+}
+
+func (c *contract) registryEnabled() bool {
+	return c.addr.IoIDRegistry != (common.Address{})
+}
+
+func deviceDID(device common.Address) string {
+	return "did:io:" + strings.ToLower(device.Hex())
+}
+
+// document queries the current did document of the device from the ioID registry
+func (c *contract) document(device common.Address) (string, [32]byte, error) {
+	if !c.registryEnabled() {
+		return "", [32]byte{}, nil
+	}
+	uri, err := c.registryInstance.DocumentURI(nil, device)
+	if err != nil {
+		return "", [32]byte{}, errors.Wrapf(err, "failed to query device document uri, device %s", device)
+	}
+	hash, err := c.registryInstance.DocumentHash(nil, device)
+	if err != nil {
+		return "", [32]byte{}, errors.Wrapf(err, "failed to query device document hash, device %s", device)
+	}
+	return uri, hash, nil
 }
 
-func (c *contract) processLogs(logs []types.Log) error {
+func (c *contract) processLogs(h *Handler, logs []types.Log) error {
 	sort.Slice(logs, func(i, j int) bool {
 		if logs[i].BlockNumber != logs[j].BlockNumber {
 			return logs[i].BlockNumber < logs[j].BlockNumber
 		}
-		return logs[i].TxIndex < logs[j].TxIndex
+		if logs[i].TxIndex != logs[j].TxIndex {
+			return logs[i].TxIndex < logs[j].TxIndex
+		}
+		return logs[i].Index < logs[j].Index
 	})
 
 	for _, l := range logs {
@@ -81,10 +190,16 @@ func (c *contract) processLogs(logs []types.Log) error {
 			if err != nil {
 				return errors.Wrap(err, "failed to parse project add metadata event")
 			}
-			if e.ProjectId.Uint64() != c.ioIDProjectID {
+			pid := e.ProjectId.Uint64()
+			if !c.projects[pid] {
 				continue
 			}
-			if err := c.h.UpsertProjectMetadata(e.ProjectId.Uint64(), e.Key, e.Value); err != nil {
+			if err := h.UpdateProject(l.BlockNumber, pid, func(t *db.Project) {
+				t.Metadata[e.Name] = hexutil.Encode(e.Value)
+			}); err != nil {
+				return err
+			}
+			if err := h.UpsertProjectMetadata(&l, pid, e.Name, e.Key, e.Value); err != nil {
 				return err
 			}
 		case createIoIDTopic:
@@ -97,33 +212,340 @@ func (c *contract) processLogs(logs []types.Log) error {
 			if err != nil {
 				return errors.Wrapf(err, "failed to query device project, device_id %s", e.Did)
 			}
-			if pid.Uint64() != c.ioIDProjectID {
+			if !c.projects[pid.Uint64()] {
 				continue
 			}
+			// the registry may emit NewDevice before the ioID is created, so the document is read here as well
+			uri, hash, err := c.document(address)
+			if err != nil {
+				return err
+			}
 
-			if err := c.h.UpsertDevice(&db.Device{
+			if err := h.UpsertDevice(l.BlockNumber, &db.Device{
 				ID:             e.Did,
 				Name:           e.Did,
 				NFTID:          e.Id.String(),
+				ProjectID:      pid.Uint64(),
 				Owner:          e.Owner.String(),
 				Address:        address.String(),
-				Status:         db.CONFIRM,
-				Proposer:       e.Owner.String(),
+				DocumentURI:    uri,
+				DocumentHash:   hexutil.Encode(hash[:]),
 				OperationTimes: db.NewOperationTimes(),
 			}); err != nil {
 				return err
 			}
 		case erc721TransferTopic:
+			// the project contract is an erc721 as well, its token ids are project ids
+			if l.Address == c.addr.Project {
+				if err := c.transferProject(h, l); err != nil {
+					return err
+				}
+				continue
+			}
+			if l.Address != c.addr.IoID {
+				continue
+			}
 			e, err := c.ioidInstance.ParseTransfer(l)
 			if err != nil {
 				return errors.Wrap(err, "failed to parse erc721 transfer event")
 			}
-			if err := c.h.UpdateDeviceOwner(e.TokenId, e.To); err != nil {
+			if e.To == (common.Address{}) {
+				if err := h.DeactivateDeviceByNFT(l.BlockNumber, l.TxHash, e.TokenId, db.StatusReasonIoIDBurned); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := h.UpdateDeviceOwner(l.BlockNumber, e.TokenId, e.To); err != nil {
 				if err == gorm.ErrRecordNotFound {
 					continue
 				}
 				return errors.Wrap(err, "failed to update device owner")
 			}
+		case newDeviceTopic:
+			// devices of other projects have no row and are skipped by the update
+			e, err := c.registryInstance.ParseNewDevice(l)
+			if err != nil {
+				return errors.Wrap(err, "failed to parse ioid registry new device event")
+			}
+			if err := c.updateDocument(h, l.BlockNumber, e.Device, e.Hash); err != nil {
+				return err
+			}
+		case updateDeviceTopic:
+			e, err := c.registryInstance.ParseUpdateDevice(l)
+			if err != nil {
+				return errors.Wrap(err, "failed to parse ioid registry update device event")
+			}
+			if err := c.updateDocument(h, l.BlockNumber, e.Device, e.Hash); err != nil {
+				return err
+			}
+		case removeDeviceTopic:
+			e, err := c.registryInstance.ParseRemoveDevice(l)
+			if err != nil {
+				return errors.Wrap(err, "failed to parse ioid registry remove device event")
+			}
+			if err := h.RemoveDevice(l.BlockNumber, l.TxHash, deviceDID(e.Device)); err != nil {
+				return err
+			}
+		case addOperatorTopic:
+			e, err := c.projectInstance.ParseAddOperator(l)
+			if err != nil {
+				return errors.Wrap(err, "failed to parse project add operator event")
+			}
+			if !c.projects[e.ProjectId.Uint64()] {
+				continue
+			}
+			if err := h.UpdateProject(l.BlockNumber, e.ProjectId.Uint64(), func(t *db.Project) {
+				t.AddOperator(e.Operator)
+			}); err != nil {
+				return err
+			}
+		case removeOperatorTopic:
+			e, err := c.projectInstance.ParseRemoveOperator(l)
+			if err != nil {
+				return errors.Wrap(err, "failed to parse project remove operator event")
+			}
+			if !c.projects[e.ProjectId.Uint64()] {
+				continue
+			}
+			if err := h.UpdateProject(l.BlockNumber, e.ProjectId.Uint64(), func(t *db.Project) {
+				t.RemoveOperator(e.Operator)
+			}); err != nil {
+				return err
+			}
+		case setNameTopic:
+			e, err := c.projectInstance.ParseSetName(l)
+			if err != nil {
+				return errors.Wrap(err, "failed to parse project set name event")
+			}
+			if !c.projects[e.ProjectId.Uint64()] {
+				continue
+			}
+			if err := h.UpdateProject(l.BlockNumber, e.ProjectId.Uint64(), func(t *db.Project) {
+				t.Name = e.Name
+			}); err != nil {
+				return err
+			}
+		case ownershipTransferTopic:
+			if l.Address != c.addr.Project {
+				continue
+			}
+			e, err := c.projectInstance.ParseOwnershipTransferred(l)
+			if err != nil {
+				return errors.Wrap(err, "failed to parse project ownership transferred event")
+			}
+			if err := h.UpdateContractOwner(l.BlockNumber, l.Address, e.NewOwner); err != nil {
+				return err
+			}
+		case removeDIDWalletTopic:
+			e, err := c.ioidInstance.ParseRemoveDIDWallet(l)
+			if err != nil {
+				return errors.Wrap(err, "failed to parse remove did wallet event")
+			}
+			if err := h.DeactivateDevice(l.BlockNumber, l.TxHash, e.Did, db.StatusReasonWalletRemoved); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *contract) transferProject(h *Handler, l types.Log) error {
+	e, err := c.projectInstance.ParseTransfer(l)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse project transfer event")
+	}
+	if !c.projects[e.TokenId.Uint64()] {
+		return nil
+	}
+	return h.UpdateProject(l.BlockNumber, e.TokenId.Uint64(), func(t *db.Project) {
+		t.Owner = e.To.String()
+	})
+}
+
+func (c *contract) updateDocument(h *Handler, block uint64, device common.Address, hash [32]byte) error {
+	uri, _, err := c.document(device)
+	if err != nil {
+		return err
+	}
+	return h.UpdateDeviceDocument(block, deviceDID(device), uri, hash)
+}
+
+// reorgError means the blocks after ancestor have been rolled back and should be scanned again
+type reorgError struct {
+	ancestor uint64
+}
+
+func (e *reorgError) Error() string {
+	return fmt.Sprintf("chain reorg detected, rolled back to block %d", e.ancestor)
+}
+
+type blockHeader struct {
+	Hash       common.Hash `json:"hash"`
+	ParentHash common.Hash `json:"parentHash"`
+}
+
+// header queries the block hashes by rpc directly, because the hash recomputed
+// from the ethereum header fields does not match the block hash of the chain
+func (c *contract) header(ctx context.Context, number uint64) (*blockHeader, error) {
+	h := &blockHeader{}
+	if err := c.client.Client().CallContext(ctx, h, "eth_getBlockByNumber", hexutil.EncodeUint64(number), false); err != nil {
+		return nil, errors.Wrapf(err, "failed to query block header, block_number %d", number)
+	}
+	if h.Hash == (common.Hash{}) {
+		return nil, errors.Errorf("block not found, block_number %d", number)
+	}
+	return h, nil
+}
+
+func (c *contract) latestHead(ctx context.Context) (uint64, error) {
+	head, err := c.client.BlockNumber(ctx)
+	return head, errors.Wrap(err, "failed to retrieve latest block number")
+}
+
+// confirmedHead returns the latest block which has enough confirmations
+func (c *contract) confirmedHead(ctx context.Context) (uint64, error) {
+	head, err := c.latestHead(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if head < c.confirmations {
+		return 0, nil
+	}
+	return head - c.confirmations, nil
+}
+
+// checkReorg compares the parent hash of block from with the recorded hash of the block before it,
+// and rolls back to the common ancestor if they differ
+func (c *contract) checkReorg(ctx context.Context, from uint64) error {
+	if from == 0 {
+		return nil
+	}
+	recorded, err := c.h.ScannedBlockHash(from - 1)
+	if err != nil {
+		return err
+	}
+	if recorded == (common.Hash{}) {
+		return nil
+	}
+	header, err := c.header(ctx, from)
+	if err != nil {
+		return err
+	}
+	if header.ParentHash == recorded {
+		return nil
+	}
+
+	blocks, err := c.h.ScannedBlocks()
+	if err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		header, err := c.header(ctx, b.Number)
+		if err != nil {
+			return err
+		}
+		if header.Hash != common.HexToHash(b.Hash) {
+			continue
+		}
+		slog.Warn("chain reorg detected, rolling back", "block_number", from-1, "ancestor", b.Number)
+		if err := c.h.RollbackBlocks(b.Number); err != nil {
+			return errors.Wrapf(err, "failed to roll back to block %d", b.Number)
+		}
+		return &reorgError{ancestor: b.Number}
+	}
+	return errors.Errorf("failed to find common ancestor of reorged block %d", from-1)
+}
+
+func (c *contract) filterLogs(ctx context.Context, query ethereum.FilterQuery, from, to uint64) ([]types.Log, error) {
+	slog.Debug("listing chain", "from", from, "to", to)
+	query.FromBlock = new(big.Int).SetUint64(from)
+	query.ToBlock = new(big.Int).SetUint64(to)
+	logs, err := c.client.FilterLogs(ctx, query)
+	return logs, errors.Wrap(err, "failed to filter contract logs")
+}
+
+// logs returns the contract logs in [from, to], from the subscription buffer if it covers the range.
+// Without confirmations block to is the head just read, whose logs may not have been pushed yet,
+// so it is always filtered.
+func (c *contract) logs(ctx context.Context, query ethereum.FilterQuery, from, to uint64) ([]types.Log, error) {
+	if c.sub == nil {
+		return c.filterLogs(ctx, query, from, to)
+	}
+	covered := to
+	if c.confirmations == 0 {
+		if from == to {
+			return c.filterLogs(ctx, query, from, to)
+		}
+		covered = to - 1
+	}
+	logs, ok := c.sub.logsOf(from, covered)
+	if !ok {
+		return c.filterLogs(ctx, query, from, to)
+	}
+	if covered == to {
+		return logs, nil
+	}
+	head, err := c.filterLogs(ctx, query, to, to)
+	if err != nil {
+		return nil, err
+	}
+	return append(logs, head...), nil
+}
+
+// sync processes the contract logs in [from, to] and records to as the scanned height
+func (c *contract) sync(ctx context.Context, query ethereum.FilterQuery, from, to uint64) error {
+	if err := c.checkReorg(ctx, from); err != nil {
+		return err
+	}
+	header, err := c.header(ctx, to)
+	if err != nil {
+		return err
+	}
+
+	logs, err := c.logs(ctx, query, from, to)
+	if err != nil {
+		return err
+	}
+	if err := c.checkLogs(ctx, logs, to, header.Hash); err != nil {
+		// the buffered logs of a reorged block may not have been removed yet, the range is filtered next time
+		if c.sub != nil {
+			c.sub.prune(to)
+		}
+		return err
+	}
+	// the events of the range and the scanned height are committed together, so a failure midway
+	// leaves nothing applied and the range is processed again
+	if err := c.h.Transaction(func(h *Handler) error {
+		if err := c.processLogs(h, logs); err != nil {
+			return err
+		}
+		return h.UpsertScannedBlock(to, header.Hash)
+	}); err != nil {
+		return err
+	}
+	if c.sub != nil {
+		c.sub.prune(to)
+	}
+	return nil
+}
+
+// checkLogs checks that every log is in the canonical block of its number, the logs of a reorged block may
+// be returned by the chain endpoint or pushed by the subscription until the reorg is observed
+func (c *contract) checkLogs(ctx context.Context, logs []types.Log, to uint64, toHash common.Hash) error {
+	canonical := map[uint64]common.Hash{to: toHash}
+	for _, l := range logs {
+		hash, ok := canonical[l.BlockNumber]
+		if !ok {
+			header, err := c.header(ctx, l.BlockNumber)
+			if err != nil {
+				return err
+			}
+			hash = header.Hash
+			canonical[l.BlockNumber] = hash
+		}
+		if l.BlockHash != hash {
+			return errors.Errorf("log %d of block %d is in block %s, not in the canonical block %s",
+				l.Index, l.BlockNumber, l.BlockHash, hash)
 		}
 	}
 	return nil
@@ -137,37 +559,25 @@ func (c *contract) list() (uint64, error) {
 	}
 	head = max(head, h)
 
-	query := ethereum.FilterQuery{
-		Addresses: []common.Address{c.addr.Project, c.addr.IoID},
-		Topics:    [][]common.Hash{allTopic},
-	}
+	query := c.filterQuery()
 	ctx := context.Background()
 	from := head + 1
-	to := from
+	to := head
 	for {
-		header, err := c.client.HeaderByNumber(ctx, nil)
+		currentHead, err := c.confirmedHead(ctx)
 		if err != nil {
-			return 0, errors.Wrap(err, "failed to retrieve latest block header")
-		}
-		currentHead := header.Number.Uint64()
-		to = from + c.listStepSize
-		if to > currentHead {
-			to = currentHead
+			return 0, err
 		}
-		if from > to {
+		if from > currentHead {
 			break
 		}
-		slog.Debug("listing chain", "from", from, "to", to)
-		query.FromBlock = new(big.Int).SetUint64(from)
-		query.ToBlock = new(big.Int).SetUint64(to)
-		logs, err := c.client.FilterLogs(ctx, query)
-		if err != nil {
-			return 0, errors.Wrap(err, "failed to filter contract logs")
-		}
-		if err := c.processLogs(logs); err != nil {
-			return 0, err
-		}
-		if err := c.h.UpsertScannedBlockNumber(to); err != nil {
+		to = min(from+c.listStepSize, currentHead)
+		if err := c.sync(ctx, query, from, to); err != nil {
+			var re *reorgError
+			if errors.As(err, &re) {
+				from = re.ancestor + 1
+				continue
+			}
 			return 0, err
 		}
 		from = to + 1
@@ -176,68 +586,147 @@ func (c *contract) list() (uint64, error) {
 	return to, nil
 }
 
-func (c *contract) watch(listedBlockNumber uint64) {
-	scannedBlockNumber := listedBlockNumber
-	query := ethereum.FilterQuery{
-		Addresses: []common.Address{c.addr.Project, c.addr.IoID},
-		Topics:    [][]common.Hash{allTopic},
+// watchState is the scanned height of the watch loop and its current polling interval
+type watchState struct {
+	scanned  uint64
+	interval time.Duration
+}
+
+// watch follows the chain head until ctx is done. It processes ranges of up to listStepSize blocks while
+// it is behind, and backs off up to maxWatchInterval while there is no new confirmed block or syncing fails
+func (c *contract) watch(ctx context.Context, listedBlockNumber uint64) {
+	w := &watchState{scanned: listedBlockNumber, interval: c.watchInterval}
+	query := c.filterQuery()
+	timer := time.NewTimer(w.interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		timer.Reset(c.watchStep(ctx, query, w))
 	}
-	ticker := time.NewTicker(c.watchInterval)
+}
 
-	go func() {
-		for range ticker.C {
-			target := scannedBlockNumber + 1
+// watchStep syncs the next range after the scanned height of w and returns how long to wait before the next step
+func (c *contract) watchStep(ctx context.Context, query ethereum.FilterQuery, w *watchState) time.Duration {
+	w.interval = min(w.interval*2, c.maxWatchInterval)
 
-			query.FromBlock = new(big.Int).SetUint64(target)
-			query.ToBlock = new(big.Int).SetUint64(target)
-			logs, err := c.client.FilterLogs(context.Background(), query)
-			if err != nil {
-				if !strings.Contains(err.Error(), "start block > tip height") {
-					slog.Error("failed to filter contract logs", "error", err)
-				}
-				continue
-			}
-			slog.Debug("listing chain", "from", target, "to", target)
-			if err := c.processLogs(logs); err != nil {
-				slog.Error("failed to process logs", "error", err)
-				continue
-			}
-			if err := c.h.UpsertScannedBlockNumber(target); err != nil {
-				slog.Error("failed to upsert scanned block number", "error", err)
-				continue
-			}
-			scannedBlockNumber = target
+	currentHead, err := c.confirmedHead(ctx)
+	if err != nil {
+		slog.Error("failed to query confirmed head", "error", err)
+		return w.interval
+	}
+	if w.scanned >= currentHead {
+		metrics.TrackChainLag(0)
+		return w.interval
+	}
+
+	from := w.scanned + 1
+	to := min(from+c.listStepSize, currentHead)
+	if err := c.sync(ctx, query, from, to); err != nil {
+		var re *reorgError
+		if errors.As(err, &re) {
+			w.scanned = re.ancestor
+			w.interval = c.watchInterval
+		} else {
+			slog.Error("failed to sync contract logs", "error", err, "from", from, "to", to)
 		}
-	}()
+		return w.interval
+	}
+	w.scanned = to
+	metrics.TrackChainLag(currentHead - w.scanned)
+
+	w.interval = c.watchInterval
+	if w.scanned < currentHead {
+		// still behind, continue catching up without waiting
+		return 0
+	}
+	return w.interval
 }
 
-func Run(h *Handler, addr *ContractAddr, beginningBlockNumber, ioIDProjectID uint64, client *ethclient.Client) error {
+func newContract(h *Handler, addr *ContractAddr, projectIDs []uint64, client *ethclient.Client) (*contract, error) {
+	if len(projectIDs) == 0 {
+		return nil, errors.New("no project to monitor")
+	}
+	projects := make(map[uint64]bool, len(projectIDs))
+	for _, id := range projectIDs {
+		projects[id] = true
+	}
 	projectInstance, err := project.NewProject(addr.Project, client)
 	if err != nil {
-		return errors.Wrap(err, "failed to new project contract instance")
+		return nil, errors.Wrap(err, "failed to new project contract instance")
 	}
 	ioidInstance, err := ioid.NewIoid(addr.IoID, client)
 	if err != nil {
-		return errors.Wrap(err, "failed to new ioid contract instance")
+		return nil, errors.Wrap(err, "failed to new ioid contract instance")
+	}
+	registryInstance, err := ioidregistry.NewIoidregistry(addr.IoIDRegistry, client)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to new ioid registry contract instance")
 	}
 
-	c := &contract{
-		h:                    h,
-		addr:                 addr,
-		beginningBlockNumber: beginningBlockNumber,
-		ioIDProjectID:        ioIDProjectID,
-		listStepSize:         500,
-		watchInterval:        1 * time.Second,
-		client:               client,
-		projectInstance:      projectInstance,
-		ioidInstance:         ioidInstance,
+	return &contract{
+		h:                h,
+		addr:             addr,
+		projects:         projects,
+		listStepSize:     500,
+		watchInterval:    1 * time.Second,
+		maxWatchInterval: 10 * time.Second,
+		client:           client,
+		projectInstance:  projectInstance,
+		ioidInstance:     ioidInstance,
+		registryInstance: registryInstance,
+	}, nil
+}
+
+func Run(h *Handler, addr *ContractAddr, beginningBlockNumber uint64, projectIDs []uint64, confirmations uint64, client *ethclient.Client) error {
+	c, err := newContract(h, addr, projectIDs, client)
+	if err != nil {
+		return err
 	}
+	c.beginningBlockNumber = beginningBlockNumber
+	c.confirmations = confirmations
 
 	listedBlockNumber, err := c.list()
 	if err != nil {
 		return err
 	}
-	go c.watch(listedBlockNumber)
+	// log subscription only takes effect with a websocket chain endpoint
+	c.sub = newSubscription(client, c.filterQuery(), c.latestHead)
+	go c.sub.run(context.Background())
+	go c.watch(context.Background(), listedBlockNumber)
+
+	return nil
+}
 
+// Resync processes the contract events of blocks [from, to] again without touching the scanned blocks.
+// Devices and projects record the block of the last event applied to them, and the events of older blocks
+// are skipped, so resyncing scanned blocks does not revert newer state. Metadata logs which have been
+// recorded are skipped as well.
+func Resync(h *Handler, addr *ContractAddr, projectIDs []uint64, client *ethclient.Client, from, to uint64) error {
+	c, err := newContract(h, addr, projectIDs, client)
+	if err != nil {
+		return err
+	}
+	query := c.filterQuery()
+	ctx := context.Background()
+	for start := from; start <= to; start += c.listStepSize + 1 {
+		end := min(start+c.listStepSize, to)
+		query.FromBlock = new(big.Int).SetUint64(start)
+		query.ToBlock = new(big.Int).SetUint64(end)
+		logs, err := c.client.FilterLogs(ctx, query)
+		if err != nil {
+			return errors.Wrapf(err, "failed to filter contract logs, from %d to %d", start, end)
+		}
+		if err := h.Transaction(func(h *Handler) error {
+			return c.processLogs(h, logs)
+		}); err != nil {
+			return errors.Wrapf(err, "failed to resync blocks from %d to %d", start, end)
+		}
+		slog.Info("resynced blocks", "from", start, "to", end, "logs", len(logs))
+	}
 	return nil
 }
@@ -0,0 +1,399 @@
+package monitor
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/iotexproject/pebble-server/db"
+)
+
+// fakeEth serves the blocks and logs of a fake chain over rpc, the logs sent to push are
+// notified to the log subscribers
+type fakeEth struct {
+	blocks  map[uint64]*blockHeader
+	logs    []types.Log
+	push    chan types.Log
+	headErr error // returned by eth_blockNumber if set
+}
+
+// BlockNumber returns the highest block of the chain
+func (e *fakeEth) BlockNumber() (hexutil.Uint64, error) {
+	if e.headErr != nil {
+		return 0, e.headErr
+	}
+	head := uint64(0)
+	for n := range e.blocks {
+		head = max(head, n)
+	}
+	return hexutil.Uint64(head), nil
+}
+
+func (e *fakeEth) Logs(ctx context.Context, _ map[string]any) (*rpc.Subscription, error) {
+	notifier, ok := rpc.NotifierFromContext(ctx)
+	if !ok {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+	sub := notifier.CreateSubscription()
+	go func() {
+		for {
+			select {
+			case l := <-e.push:
+				if err := notifier.Notify(sub.ID, l); err != nil {
+					return
+				}
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+func (e *fakeEth) GetBlockByNumber(number hexutil.Uint64, _ bool) (*blockHeader, error) {
+	return e.blocks[uint64(number)], nil
+}
+
+func (e *fakeEth) GetLogs(q map[string]any) ([]types.Log, error) {
+	from, err := hexutil.DecodeUint64(q["fromBlock"].(string))
+	if err != nil {
+		return nil, err
+	}
+	to, err := hexutil.DecodeUint64(q["toBlock"].(string))
+	if err != nil {
+		return nil, err
+	}
+	logs := []types.Log{}
+	for _, l := range e.logs {
+		if l.BlockNumber >= from && l.BlockNumber <= to {
+			logs = append(logs, l)
+		}
+	}
+	return logs, nil
+}
+
+func newFakeClient(t *testing.T, eth *fakeEth) *ethclient.Client {
+	t.Helper()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("eth", eth); err != nil {
+		t.Fatal(err)
+	}
+	c := ethclient.NewClient(rpc.DialInProc(srv))
+	t.Cleanup(func() {
+		c.Close()
+		srv.Stop()
+	})
+	return c
+}
+
+// newFakeChain returns the headers of blocks [0, n] whose hashes are derived from fork
+func newFakeChain(fork byte, n uint64) map[uint64]*blockHeader {
+	blocks := map[uint64]*blockHeader{}
+	for i := uint64(0); i <= n; i++ {
+		h := &blockHeader{Hash: common.BytesToHash([]byte{fork, byte(i)})}
+		if i > 0 {
+			h.ParentHash = blocks[i-1].Hash
+		}
+		blocks[i] = h
+	}
+	return blocks
+}
+
+// fakeScanner records the scanned blocks of the handler
+type fakeScanner struct {
+	blocks     map[uint64]common.Hash
+	rolledBack []uint64
+}
+
+func (s *fakeScanner) handler() *Handler {
+	h := &Handler{
+		ScannedBlockHash: func(n uint64) (common.Hash, error) { return s.blocks[n], nil },
+		ScannedBlocks: func() ([]*db.ScannedBlock, error) {
+			bs := []*db.ScannedBlock{}
+			for n, h := range s.blocks {
+				bs = append(bs, &db.ScannedBlock{Number: n, Hash: h.Hex()})
+			}
+			sort.Slice(bs, func(i, j int) bool { return bs[i].Number > bs[j].Number })
+			return bs, nil
+		},
+		RollbackBlocks: func(ancestor uint64) error {
+			s.rolledBack = append(s.rolledBack, ancestor)
+			for n := range s.blocks {
+				if n > ancestor {
+					delete(s.blocks, n)
+				}
+			}
+			return nil
+		},
+		UpsertScannedBlock: func(n uint64, h common.Hash) error {
+			s.blocks[n] = h
+			return nil
+		},
+	}
+	h.Transaction = func(fn func(h *Handler) error) error { return fn(h) }
+	return h
+}
+
+func TestSyncRollsBackReorgedBlocks(t *testing.T) {
+	chainA, chainB := newFakeChain(0xa, 12), newFakeChain(0xb, 12)
+	// chain b forks from chain a after block 9
+	for i := uint64(0); i <= 9; i++ {
+		chainB[i] = chainA[i]
+	}
+	chainB[10].ParentHash = chainA[9].Hash
+
+	s := &fakeScanner{blocks: map[uint64]common.Hash{}}
+	for i := uint64(8); i <= 10; i++ {
+		s.blocks[i] = chainA[i].Hash
+	}
+	c := &contract{h: s.handler(), client: newFakeClient(t, &fakeEth{blocks: chainB})}
+
+	err := c.sync(context.Background(), ethereum.FilterQuery{}, 11, 11)
+	var re *reorgError
+	if !errors.As(err, &re) || re.ancestor != 9 {
+		t.Fatalf("expected a reorg to block 9, got %v", err)
+	}
+	if len(s.rolledBack) != 1 || s.rolledBack[0] != 9 {
+		t.Fatalf("unexpected rollbacks %v", s.rolledBack)
+	}
+
+	// the blocks after the ancestor are processed again on the new chain
+	if err := c.sync(context.Background(), ethereum.FilterQuery{}, 10, 11); err != nil {
+		t.Fatal(err)
+	}
+	if s.blocks[11] != chainB[11].Hash {
+		t.Fatalf("expected block 11 of the new chain to be scanned, got %s", s.blocks[11])
+	}
+}
+
+func TestLogsFilterUnconfirmedHead(t *testing.T) {
+	chain := newFakeChain(0xa, 12)
+	pushed := types.Log{BlockNumber: 10, BlockHash: chain[10].Hash, Topics: []common.Hash{}}
+	filtered := types.Log{BlockNumber: 11, BlockHash: chain[11].Hash, Topics: []common.Hash{}}
+	sub := newSubscription(nil, ethereum.FilterQuery{}, nil)
+	sub.alive, sub.from = true, 10
+	sub.logs[logKey{blockHash: pushed.BlockHash}] = pushed
+	c := &contract{
+		client: newFakeClient(t, &fakeEth{blocks: chain, logs: []types.Log{pushed, filtered}}),
+		sub:    sub,
+	}
+
+	// block 11 is the head without confirmations, its logs may not have been pushed yet
+	logs, err := c.logs(context.Background(), ethereum.FilterQuery{}, 10, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0].BlockNumber != 10 || logs[1].BlockNumber != 11 {
+		t.Fatalf("unexpected logs %+v", logs)
+	}
+
+	// with confirmations the covered range is read from the subscription only
+	c.confirmations = 1
+	if logs, err = c.logs(context.Background(), ethereum.FilterQuery{}, 10, 11); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].BlockNumber != 10 {
+		t.Fatalf("unexpected logs %+v", logs)
+	}
+}
+
+// waitLogs waits until the subscription buffers the logs of blocks [from, to] in the given blocks
+func waitLogs(t *testing.T, s *subscription, from, to uint64, blocks ...common.Hash) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		logs, ok := s.logsOf(from, to)
+		if !ok || len(logs) != len(blocks) {
+			continue
+		}
+		i := 0
+		for i < len(logs) && logs[i].BlockHash == blocks[i] {
+			i++
+		}
+		if i == len(logs) {
+			return
+		}
+	}
+	t.Fatalf("the subscription does not buffer the logs of blocks %v", blocks)
+}
+
+func TestSyncChecksLogBlockHashes(t *testing.T) {
+	chainA, chainB := newFakeChain(0xa, 12), newFakeChain(0xb, 12)
+	// logs of an event which is not indexed, so they are only checked
+	topics := []common.Hash{{0x01}}
+	canonical10 := types.Log{BlockNumber: 10, BlockHash: chainA[10].Hash, Topics: topics}
+	eth := &fakeEth{blocks: chainA, logs: []types.Log{canonical10}, push: make(chan types.Log)}
+	client := newFakeClient(t, eth)
+
+	s := &fakeScanner{blocks: map[uint64]common.Hash{9: chainA[9].Hash}}
+	c := &contract{h: s.handler(), client: client, confirmations: 1}
+	c.sub = newSubscription(client, ethereum.FilterQuery{}, func(context.Context) (uint64, error) { return 9, nil })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.sub.run(ctx)
+	waitAlive(t, c.sub)
+
+	// the log of a block of another fork is pushed before the reorg is observed
+	eth.push <- types.Log{BlockNumber: 10, BlockHash: chainB[10].Hash, Topics: topics}
+	waitLogs(t, c.sub, 10, 10, chainB[10].Hash)
+	if err := c.sync(ctx, ethereum.FilterQuery{}, 10, 10); err == nil {
+		t.Fatal("expected the log of another fork to be rejected")
+	}
+	if _, ok := s.blocks[10]; ok {
+		t.Fatal("block 10 is scanned with the log of another fork")
+	}
+	// the block is filtered again
+	if err := c.sync(ctx, ethereum.FilterQuery{}, 10, 10); err != nil {
+		t.Fatal(err)
+	}
+	if s.blocks[10] != chainA[10].Hash {
+		t.Fatalf("expected the canonical block 10 to be scanned, got %s", s.blocks[10])
+	}
+
+	// the logs of a reorged block are removed by the subscription, the logs of the new block are pushed
+	stale11 := types.Log{BlockNumber: 11, BlockHash: chainB[11].Hash, Topics: topics}
+	eth.push <- stale11
+	stale11.Removed = true
+	eth.push <- stale11
+	eth.push <- types.Log{BlockNumber: 11, BlockHash: chainA[11].Hash, Topics: topics, Index: 1}
+	waitLogs(t, c.sub, 11, 11, chainA[11].Hash)
+	if err := c.sync(ctx, ethereum.FilterQuery{}, 11, 11); err != nil {
+		t.Fatal(err)
+	}
+	if s.blocks[11] != chainA[11].Hash {
+		t.Fatalf("expected the canonical block 11 to be scanned, got %s", s.blocks[11])
+	}
+}
+
+// chainLag returns the reported number of blocks the monitor is behind
+func chainLag(t *testing.T) float64 {
+	t.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == "monitor_block_lag" {
+			return mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatal("the chain lag is not reported")
+	return 0
+}
+
+func TestWatchStepCatchesUpAndBacksOff(t *testing.T) {
+	chain := newFakeChain(0xa, 25)
+	eth := &fakeEth{blocks: chain}
+	s := &fakeScanner{blocks: map[uint64]common.Hash{3: chain[3].Hash}}
+	c := &contract{
+		h:                s.handler(),
+		client:           newFakeClient(t, eth),
+		confirmations:    2,
+		listStepSize:     9,
+		watchInterval:    time.Second,
+		maxWatchInterval: 8 * time.Second,
+	}
+	ctx := context.Background()
+	// the monitor is 20 blocks behind the confirmed head 23
+	w := &watchState{scanned: 3, interval: c.watchInterval}
+
+	step := func(wantScanned uint64, wantWait time.Duration, wantLag float64) {
+		t.Helper()
+		if wait := c.watchStep(ctx, ethereum.FilterQuery{}, w); wait != wantWait {
+			t.Fatalf("got wait %s, want %s", wait, wantWait)
+		}
+		if w.scanned != wantScanned || s.blocks[wantScanned] != chain[wantScanned].Hash {
+			t.Fatalf("got scanned height %d, want %d", w.scanned, wantScanned)
+		}
+		if lag := chainLag(t); lag != wantLag {
+			t.Fatalf("got chain lag %v, want %v", lag, wantLag)
+		}
+	}
+
+	// the monitor catches up by ranges of listStepSize blocks without waiting
+	step(13, 0, 10)
+	step(23, time.Second, 0)
+	// it backs off while there is no new confirmed block
+	step(23, 2*time.Second, 0)
+
+	// and while the head can not be queried, up to the max interval
+	eth.headErr = errors.New("unavailable")
+	step(23, 4*time.Second, 0)
+	step(23, 8*time.Second, 0)
+	step(23, 8*time.Second, 0)
+
+	// it follows the head with the initial interval again once a block is confirmed
+	eth.headErr = nil
+	for n, b := range newFakeChain(0xa, 27) {
+		chain[n] = b
+	}
+	step(25, time.Second, 0)
+
+	// a range which fails to sync is backed off and processed again
+	for n, b := range newFakeChain(0xa, 28) {
+		chain[n] = b
+	}
+	missing := chain[26]
+	delete(chain, 26)
+	step(25, 2*time.Second, 0)
+	chain[26] = missing
+	step(26, time.Second, 0)
+}
+
+func TestWatchFollowsLaggingHeight(t *testing.T) {
+	chain := newFakeChain(0xa, 30)
+	s := &fakeScanner{blocks: map[uint64]common.Hash{3: chain[3].Hash}}
+	h := s.handler()
+	scanned := make(chan uint64, 10)
+	upsert := h.UpsertScannedBlock
+	h.UpsertScannedBlock = func(n uint64, hash common.Hash) error {
+		scanned <- n
+		return upsert(n, hash)
+	}
+	c := &contract{
+		h:                h,
+		addr:             testContractAddr,
+		client:           newFakeClient(t, &fakeEth{blocks: chain}),
+		listStepSize:     9,
+		watchInterval:    time.Millisecond,
+		maxWatchInterval: 5 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.watch(ctx, 3)
+		close(done)
+	}()
+	for _, want := range []uint64{13, 23, 30} {
+		select {
+		case n := <-scanned:
+			if n != want {
+				t.Fatalf("got scanned height %d, want %d", n, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("block %d is not scanned", want)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watch loop does not stop with its context")
+	}
+	select {
+	case n := <-scanned:
+		t.Fatalf("unexpected scanned height %d at the head", n)
+	default:
+	}
+}
@@ -0,0 +1,173 @@
+package monitor
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pkg/errors"
+)
+
+type logKey struct {
+	blockHash common.Hash
+	index     uint
+}
+
+// subscription buffers the contract logs pushed by a websocket chain endpoint.
+// While it is alive, the logs of every block since from have been received, so the watcher
+// can use them instead of filtering logs. Once the subscription drops the buffer is dropped
+// and the watcher falls back to polling until it is resubscribed.
+// The pushed logs are only moved from the channel to the buffer while holding mu, so a reader
+// holding mu sees every log which has been pushed.
+type subscription struct {
+	client        logSubscriber
+	query         ethereum.FilterQuery
+	head          func(ctx context.Context) (uint64, error)
+	retryInterval time.Duration
+	drainInterval time.Duration
+	mu            sync.Mutex
+	alive         bool
+	from          uint64
+	ch            chan types.Log
+	logs          map[logKey]types.Log
+}
+
+type logSubscriber interface {
+	SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error)
+}
+
+func newSubscription(client logSubscriber, query ethereum.FilterQuery, head func(ctx context.Context) (uint64, error)) *subscription {
+	return &subscription{
+		client:        client,
+		query:         query,
+		head:          head,
+		retryInterval: 10 * time.Second,
+		drainInterval: 100 * time.Millisecond,
+		logs:          map[logKey]types.Log{},
+	}
+}
+
+// run keeps the subscription alive, it returns if the chain endpoint does not support subscriptions
+func (s *subscription) run(ctx context.Context) {
+	for {
+		err := s.subscribe(ctx)
+		if errors.Is(err, rpc.ErrNotificationsUnsupported) {
+			slog.Info("chain endpoint does not support log subscription, polling only")
+			return
+		}
+		slog.Warn("contract log subscription dropped, fall back to polling", "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.retryInterval):
+		}
+	}
+}
+
+func (s *subscription) subscribe(ctx context.Context) error {
+	ch := make(chan types.Log, 1024)
+	sub, err := s.client.SubscribeFilterLogs(ctx, s.query, ch)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	// the logs of the blocks after the head read after subscribing are guaranteed to be pushed
+	head, err := s.head(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.alive = true
+	s.from = head + 1
+	s.ch = ch
+	s.mu.Unlock()
+	slog.Info("contract log subscription established", "from", head+1)
+
+	defer func() {
+		s.mu.Lock()
+		s.alive = false
+		s.ch = nil
+		s.logs = map[logKey]types.Log{}
+		s.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(s.drainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-sub.Err():
+			if err == nil {
+				err = errors.New("subscription closed")
+			}
+			return err
+		case <-ticker.C:
+			s.mu.Lock()
+			s.drain()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// drain moves the pushed logs into the buffer, it must be called with mu held
+func (s *subscription) drain() {
+	for {
+		select {
+		case l := <-s.ch:
+			k := logKey{blockHash: l.BlockHash, index: l.Index}
+			if l.Removed {
+				delete(s.logs, k)
+			} else {
+				s.logs[k] = l
+			}
+		default:
+			return
+		}
+	}
+}
+
+// logsOf returns the buffered logs in [from, to], the bool reports whether the subscription covers the range
+func (s *subscription) logsOf(from, to uint64) ([]types.Log, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.alive || from < s.from {
+		return nil, false
+	}
+	s.drain()
+	logs := []types.Log{}
+	for _, l := range s.logs {
+		if l.BlockNumber >= from && l.BlockNumber <= to {
+			logs = append(logs, l)
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		if logs[i].BlockNumber != logs[j].BlockNumber {
+			return logs[i].BlockNumber < logs[j].BlockNumber
+		}
+		return logs[i].Index < logs[j].Index
+	})
+	return logs, true
+}
+
+// prune drops the buffered logs of processed blocks, the blocks are no longer covered
+// so they are filtered again if rolled back
+func (s *subscription) prune(to uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.from = max(s.from, to+1)
+	for k, l := range s.logs {
+		if l.BlockNumber <= to {
+			delete(s.logs, k)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package monitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+)
+
+type fakeSubscription struct {
+	err chan error
+}
+
+func (s *fakeSubscription) Unsubscribe()      {}
+func (s *fakeSubscription) Err() <-chan error { return s.err }
+
+type fakeSubscriber struct {
+	sub *fakeSubscription
+	ch  chan<- types.Log
+}
+
+func (f *fakeSubscriber) SubscribeFilterLogs(_ context.Context, _ ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	f.ch = ch
+	return f.sub, nil
+}
+
+func waitAlive(t *testing.T, s *subscription) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		alive := s.alive
+		s.mu.Unlock()
+		if alive {
+			return
+		}
+	}
+	t.Fatal("subscription is not established")
+}
+
+func TestSubscriptionBuffersLogs(t *testing.T) {
+	f := &fakeSubscriber{sub: &fakeSubscription{err: make(chan error, 1)}}
+	s := newSubscription(f, ethereum.FilterQuery{}, func(context.Context) (uint64, error) { return 10, nil })
+	// the logs are only moved to the buffer by logsOf
+	s.drainInterval = time.Hour
+	done := make(chan error, 1)
+	go func() { done <- s.subscribe(context.Background()) }()
+	waitAlive(t, s)
+
+	if _, ok := s.logsOf(10, 11); ok {
+		t.Fatal("expected the blocks before the subscription to be uncovered")
+	}
+
+	b11, b12 := common.HexToHash("0x11"), common.HexToHash("0x12")
+	f.ch <- types.Log{BlockNumber: 11, BlockHash: b11, Index: 1}
+	f.ch <- types.Log{BlockNumber: 11, BlockHash: b11, Index: 0}
+	f.ch <- types.Log{BlockNumber: 12, BlockHash: b12, Index: 0}
+	f.ch <- types.Log{BlockNumber: 12, BlockHash: b12, Index: 0, Removed: true}
+	logs, ok := s.logsOf(11, 12)
+	if !ok {
+		t.Fatal("expected the blocks after the subscription to be covered")
+	}
+	if len(logs) != 2 || logs[0].Index != 0 || logs[1].Index != 1 {
+		t.Fatalf("unexpected buffered logs %+v", logs)
+	}
+
+	// processed blocks are no longer covered
+	s.prune(11)
+	if _, ok := s.logsOf(11, 12); ok {
+		t.Fatal("expected the pruned blocks to be uncovered")
+	}
+	if logs, ok = s.logsOf(12, 12); !ok || len(logs) != 0 {
+		t.Fatalf("unexpected buffered logs %+v", logs)
+	}
+
+	// the buffer is dropped with the subscription
+	f.sub.err <- errors.New("connection lost")
+	if err := <-done; err == nil {
+		t.Fatal("expected the dropped subscription to return an error")
+	}
+	if _, ok := s.logsOf(12, 12); ok {
+		t.Fatal("expected a dropped subscription to cover nothing")
+	}
+}